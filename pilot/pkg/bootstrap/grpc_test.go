@@ -0,0 +1,67 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bootstrap
+
+import (
+	"os"
+	"testing"
+)
+
+// setEnv sets an environment variable and returns a function restoring the previous value.
+func setEnv(t *testing.T, key, value string) func() {
+	old, found := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if found {
+			_ = os.Setenv(key, old)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	}
+}
+
+func TestGrpcTuningFromEnv(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		defer setEnv(t, "ISTIO_GPRC_MAXSTREAMS", "")()
+		defer setEnv(t, "ISTIO_GRPC_WRITE_BUFFER_SIZE", "")()
+		tuning := grpcTuningFromEnv()
+		if tuning.maxConcurrentStreams != 100000 {
+			t.Errorf("maxConcurrentStreams = %d, want 100000", tuning.maxConcurrentStreams)
+		}
+		if tuning.writeBufferSize != 0 {
+			t.Errorf("writeBufferSize = %d, want 0", tuning.writeBufferSize)
+		}
+		if got := len(tuning.serverOptions()); got != 1 {
+			t.Errorf("got %d server options, want 1", got)
+		}
+	})
+
+	t.Run("from env", func(t *testing.T) {
+		defer setEnv(t, "ISTIO_GPRC_MAXSTREAMS", "50")()
+		defer setEnv(t, "ISTIO_GRPC_WRITE_BUFFER_SIZE", "65536")()
+		tuning := grpcTuningFromEnv()
+		if tuning.maxConcurrentStreams != 50 {
+			t.Errorf("maxConcurrentStreams = %d, want 50", tuning.maxConcurrentStreams)
+		}
+		if tuning.writeBufferSize != 65536 {
+			t.Errorf("writeBufferSize = %d, want 65536", tuning.writeBufferSize)
+		}
+		if got := len(tuning.serverOptions()); got != 2 {
+			t.Errorf("got %d server options, want 2", got)
+		}
+	})
+}
@@ -15,6 +15,7 @@
 package bootstrap
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -66,6 +67,8 @@ const (
 	CopilotTimeout = 5 * time.Second
 	// FilepathWalkInterval dictates how often the file system is walked for config
 	FilepathWalkInterval = 100 * time.Millisecond
+	// xdsDrainTimeout bounds the drain of the xDS streams on shutdown, after the drain window
+	xdsDrainTimeout = 5 * time.Second
 )
 
 var (
@@ -723,6 +726,7 @@ func (s *Server) initDiscoveryService(args *PilotArgs) error {
 	// For now we create the gRPC server sourcing data from Pilot's older data model.
 	s.initGrpcServer()
 	envoy.V2ClearCache = envoyv2.PushAll
+	envoy.V2ClearServices = envoyv2.PushServices
 	s.EnvoyXdsServer = envoyv2.NewDiscoveryServer(s.GRPCServer, environment, core.NewConfigGenerator())
 
 	s.EnvoyXdsServer.InitDebug(s.mux, s.ServiceController)
@@ -764,6 +768,11 @@ func (s *Server) initDiscoveryService(args *PilotArgs) error {
 			if err != nil {
 				log.Warna(err)
 			}
+			// Close the xDS streams cleanly, over the drain window, before the gRPC server cuts
+			// them.
+			ctx, cancel := context.WithTimeout(context.Background(), s.EnvoyXdsServer.DrainWindow()+xdsDrainTimeout)
+			_ = s.EnvoyXdsServer.DrainConnections(ctx)
+			cancel()
 			s.EnvoyXdsServer.GrpcServer.Stop()
 		}()
 
@@ -833,6 +842,29 @@ func (s *Server) initGrpcServer() {
 
 	grpcOptions = append(grpcOptions, grpc.UnaryInterceptor(middleware.ChainUnaryServer(interceptors...)))
 
+	grpcOptions = append(grpcOptions, grpcTuningFromEnv().serverOptions()...)
+
+	// envoys sending compressed requests get compressed responses, count the savings
+	grpcOptions = append(grpcOptions, grpc.StatsHandler(envoyv2.CompressionStatsHandler()))
+
+	// get the grpc server wired up
+	grpc.EnableTracing = true
+
+	s.GRPCServer = grpc.NewServer(grpcOptions...)
+}
+
+// grpcTuning holds the gRPC server settings that operators may need to adjust for
+// their fleet size. Zero values mean the gRPC default is used.
+type grpcTuning struct {
+	// maxConcurrentStreams limits the number of concurrent streams per client connection.
+	maxConcurrentStreams uint32
+
+	// writeBufferSize is the size of the per-connection write buffer, in bytes.
+	writeBufferSize int
+}
+
+// grpcTuningFromEnv reads the gRPC tuning settings from the environment.
+func grpcTuningFromEnv() grpcTuning {
 	// Temp setting, default should be enough for most supported environments. Can be used for testing
 	// envoy with lower values.
 	var maxStreams int
@@ -840,15 +872,32 @@ func (s *Server) initGrpcServer() {
 	if len(maxStreamsEnv) > 0 {
 		maxStreams, _ = strconv.Atoi(maxStreamsEnv)
 	}
-	if maxStreams == 0 {
+	if maxStreams <= 0 {
 		maxStreams = 100000
 	}
-	grpcOptions = append(grpcOptions, grpc.MaxConcurrentStreams(uint32(maxStreams)))
 
-	// get the grpc server wired up
-	grpc.EnableTracing = true
+	var writeBufferSize int
+	writeBufferEnv := os.Getenv("ISTIO_GRPC_WRITE_BUFFER_SIZE")
+	if len(writeBufferEnv) > 0 {
+		writeBufferSize, _ = strconv.Atoi(writeBufferEnv)
+	}
+	if writeBufferSize < 0 {
+		writeBufferSize = 0
+	}
 
-	s.GRPCServer = grpc.NewServer(grpcOptions...)
+	return grpcTuning{
+		maxConcurrentStreams: uint32(maxStreams),
+		writeBufferSize:      writeBufferSize,
+	}
+}
+
+// serverOptions converts the settings to gRPC server options.
+func (t grpcTuning) serverOptions() []grpc.ServerOption {
+	opts := []grpc.ServerOption{grpc.MaxConcurrentStreams(t.maxConcurrentStreams)}
+	if t.writeBufferSize > 0 {
+		opts = append(opts, grpc.WriteBufferSize(t.writeBufferSize))
+	}
+	return opts
 }
 
 func (s *Server) addStartFunc(fn startFunc) {
@@ -15,6 +15,8 @@
 package core
 
 import (
+	"context"
+
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
 
 	"istio.io/istio/pilot/pkg/model"
@@ -30,7 +32,8 @@ type ConfigGenerator interface {
 	BuildListeners(env model.Environment, node model.Proxy) ([]*v2.Listener, error)
 
 	// BuildClusters returns the list of clusters for the given proxy. This is the CDS output
-	BuildClusters(env model.Environment, node model.Proxy) ([]*v2.Cluster, error)
+	// The generation is abandoned, returning ctx.Err(), if ctx is cancelled.
+	BuildClusters(ctx context.Context, env model.Environment, node model.Proxy) ([]*v2.Cluster, error)
 
 	// BuildRoutes returns the list of routes for the given proxy. This is the RDS output
 	BuildRoutes(env model.Environment, node model.Proxy, routeName string) ([]*v2.RouteConfiguration, error)
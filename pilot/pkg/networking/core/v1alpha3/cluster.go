@@ -15,6 +15,8 @@
 package v1alpha3
 
 import (
+	"context"
+
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 
@@ -49,7 +51,8 @@ const (
 // For outbound: Cluster for each service/subset hostname or cidr with SNI set to service hostname
 // Cluster type based on resolution
 // For inbound (sidecar only): Cluster for each inbound endpoint port and for each service port
-func (configgen *ConfigGeneratorImpl) BuildClusters(env model.Environment, proxy model.Proxy) ([]*v2.Cluster, error) {
+func (configgen *ConfigGeneratorImpl) BuildClusters(ctx context.Context, env model.Environment,
+	proxy model.Proxy) ([]*v2.Cluster, error) {
 	clusters := make([]*v2.Cluster, 0)
 
 	services, err := env.Services()
@@ -58,7 +61,10 @@ func (configgen *ConfigGeneratorImpl) BuildClusters(env model.Environment, proxy
 		return nil, err
 	}
 
-	clusters = append(clusters, configgen.buildOutboundClusters(env, proxy, services)...)
+	clusters = append(clusters, configgen.buildOutboundClusters(ctx, env, proxy, services)...)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	for _, c := range clusters {
 		// Envoy requires a non-zero connect timeout
 		if c.ConnectTimeout == 0 {
@@ -79,10 +85,14 @@ func (configgen *ConfigGeneratorImpl) BuildClusters(env model.Environment, proxy
 	return clusters, nil // TODO: normalize/dedup/order
 }
 
-func (configgen *ConfigGeneratorImpl) buildOutboundClusters(env model.Environment, proxy model.Proxy,
-	services []*model.Service) []*v2.Cluster {
+// buildOutboundClusters stops early if ctx is cancelled, returning the clusters built so far.
+func (configgen *ConfigGeneratorImpl) buildOutboundClusters(ctx context.Context, env model.Environment,
+	proxy model.Proxy, services []*model.Service) []*v2.Cluster {
 	clusters := make([]*v2.Cluster, 0)
 	for _, service := range services {
+		if ctx.Err() != nil {
+			break
+		}
 		config := env.DestinationRule(service.Hostname, "")
 		for _, port := range service.Ports {
 			hosts := buildClusterHosts(env, service, port)
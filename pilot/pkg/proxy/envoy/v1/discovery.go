@@ -117,10 +117,18 @@ var (
 	clearCacheTimerSet bool
 	clearCacheMutex    sync.Mutex
 	clearCacheTime     = 1
+	// clearCacheAll is set if a change of unknown scope is pending, clearCacheHosts are the
+	// hostnames of the changed services otherwise.
+	clearCacheAll   bool
+	clearCacheHosts map[string]bool
 
 	// V2ClearCache is a function to be called when the v1 cache is cleared. This is used to
 	// avoid adding a circular dependency from v1 to v2.
 	V2ClearCache func()
+
+	// V2ClearServices, if set, is called instead of V2ClearCache when only existing services
+	// changed, with their hostnames, so the v2 pushes can be limited to the affected proxies.
+	V2ClearServices func(hostnames []string)
 )
 
 func init() {
@@ -349,11 +357,24 @@ func NewDiscoveryService(ctl model.Controller, configCache model.ConfigStoreCach
 
 	// Flush cached discovery responses whenever services, service
 	// instances, or routing configuration changes.
-	serviceHandler := func(*model.Service, model.Event) { out.clearCache() }
+	serviceHandler := func(svc *model.Service, event model.Event) {
+		if event == model.EventAdd {
+			// A new service can be referenced by any proxy.
+			out.clearCache()
+			return
+		}
+		out.clearServiceCache(svc.Hostname)
+	}
 	if err := ctl.AppendServiceHandler(serviceHandler); err != nil {
 		return nil, err
 	}
-	instanceHandler := func(*model.ServiceInstance, model.Event) { out.clearCache() }
+	instanceHandler := func(instance *model.ServiceInstance, _ model.Event) {
+		if instance.Service == nil {
+			out.clearCache()
+			return
+		}
+		out.clearServiceCache(instance.Service.Hostname)
+	}
 	if err := ctl.AppendInstanceHandler(instanceHandler); err != nil {
 		return nil, err
 	}
@@ -467,20 +488,39 @@ func (ds *DiscoveryService) ClearCacheStats(_ *restful.Request, _ *restful.Respo
 	ds.ldsCache.resetStats()
 }
 
-// clearCache will clear all envoy caches. Called by service, instance and config handlers.
-// This will impact the performance, since envoy will need to recalculate.
+// clearCache will clear all envoy caches, for a change of unknown scope. Called by the config
+// handlers, and for new services. This will impact the performance, since envoy will need to
+// recalculate.
 func (ds *DiscoveryService) clearCache() {
 	clearCacheMutex.Lock()
 	defer clearCacheMutex.Unlock()
+	clearCacheAll = true
+	ds.flushCache()
+}
 
+// clearServiceCache clears the caches for a change of the existing service with the hostname.
+// The v2 pushes only go to the proxies using the service, see V2ClearServices.
+func (ds *DiscoveryService) clearServiceCache(hostname string) {
+	clearCacheMutex.Lock()
+	defer clearCacheMutex.Unlock()
+	if clearCacheHosts == nil {
+		clearCacheHosts = map[string]bool{}
+	}
+	clearCacheHosts[hostname] = true
+	ds.flushCache()
+}
+
+// flushCache clears the caches, at most once every clearCacheTime: the changes in between are
+// merged in a single clear. Called with clearCacheMutex held.
+func (ds *DiscoveryService) flushCache() {
 	if time.Since(lastClearCache) < time.Duration(clearCacheTime)*time.Second {
 		if !clearCacheTimerSet {
 			clearCacheTimerSet = true
 			time.AfterFunc(time.Duration(clearCacheTime)*time.Second, func() {
 				clearCacheMutex.Lock()
+				defer clearCacheMutex.Unlock()
 				clearCacheTimerSet = false
-				clearCacheMutex.Unlock()
-				ds.clearCache() // it's after time - so will clear the cache
+				ds.flushCache() // it's after time - so will clear the cache
 			})
 		}
 		return
@@ -492,6 +532,18 @@ func (ds *DiscoveryService) clearCache() {
 	ds.cdsCache.clear()
 	ds.rdsCache.clear()
 	ds.ldsCache.clear()
+
+	all, hosts := clearCacheAll, clearCacheHosts
+	clearCacheAll, clearCacheHosts = false, nil
+	if !all && V2ClearServices != nil {
+		hostnames := make([]string, 0, len(hosts))
+		for h := range hosts {
+			hostnames = append(hostnames, h)
+		}
+		sort.Strings(hostnames)
+		V2ClearServices(hostnames)
+		return
+	}
 	if V2ClearCache != nil {
 		V2ClearCache()
 	}
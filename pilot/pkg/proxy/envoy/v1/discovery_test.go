@@ -20,8 +20,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	restful "github.com/emicklei/go-restful"
 
@@ -1098,6 +1100,38 @@ func TestDiscoveryCache(t *testing.T) {
 	}
 }
 
+func TestDiscoveryClearServiceCache(t *testing.T) {
+	_, _, ds := commonSetup(t)
+	all := 0
+	var services [][]string
+	V2ClearCache = func() { all++ }
+	V2ClearServices = func(hostnames []string) { services = append(services, hostnames) }
+	defer func() { V2ClearCache, V2ClearServices = nil, nil }()
+	// Clear right away, without merging with the clears of the previous tests.
+	noSquash := func() {
+		clearCacheMutex.Lock()
+		lastClearCache = time.Time{}
+		clearCacheMutex.Unlock()
+	}
+
+	noSquash()
+	ds.clearServiceCache("hello.default.svc.cluster.local")
+	want := [][]string{{"hello.default.svc.cluster.local"}}
+	if all != 0 || !reflect.DeepEqual(services, want) {
+		t.Errorf("service change cleared all %d times, services %v, want only %v", all, services, want)
+	}
+
+	// A change of unknown scope clears all, with the services changed meanwhile.
+	clearCacheMutex.Lock()
+	clearCacheHosts = map[string]bool{"world.default.svc.cluster.local": true}
+	clearCacheMutex.Unlock()
+	noSquash()
+	ds.clearCache()
+	if all != 1 || len(services) != 1 {
+		t.Errorf("config change cleared all %d times, services %v, want all once", all, services)
+	}
+}
+
 func TestDiscoveryService_AvailabilityZone(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -0,0 +1,314 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	ads "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"istio.io/istio/pkg/log"
+)
+
+var (
+	// adsOrderTimeout bounds how long an endpoint or listener response on an ADS stream waits
+	// for the pending CDS push of the proxy, set with PILOT_ADS_ORDER_TIMEOUT.
+	adsOrderTimeout = envDuration("PILOT_ADS_ORDER_TIMEOUT", 5*time.Second)
+
+	// adsOrderPoll is the interval between two checks of the pending CDS push.
+	adsOrderPoll = 5 * time.Millisecond
+)
+
+type adsContextKey struct{}
+
+// adsConnection is an ADS stream, multiplexing the xDS types of a proxy. Each type is served
+// by its push loop (streamClusters, StreamEndpoints, StreamListeners) on an adsTypeStream,
+// started on the first request of the type. The responses are sent in the CDS, EDS, LDS
+// order: an endpoint or listener response waits for the pending CDS push, so envoy doesn't
+// get endpoints or listeners of clusters it doesn't know yet.
+type adsConnection struct {
+	stream ads.AggregatedDiscoveryService_StreamAggregatedResourcesServer
+	ctx    context.Context
+
+	// sendLock serializes the Sends of the push loops on the stream, held while sending. A
+	// Send stuck past its timeout keeps it until the stream is closed, the Sends waiting for
+	// it give up once ctx is canceled, so the push loops can return.
+	sendLock chan struct{}
+
+	mutex sync.Mutex
+	// clusters is the CDS connection of the stream, once registered.
+	clusters *CdsConnection
+	// node is the last node sent by the proxy, for the requests without node: envoy only
+	// sends it in the first request of the stream.
+	node *core.Node
+	// types are the streams of the types requested so far.
+	types map[string]*adsTypeStream
+	// closed is set once no more type streams are started.
+	closed bool
+	// recvErr is returned by the type streams once the ADS stream is closed.
+	recvErr error
+}
+
+// adsTypeStream is the stream of a single xDS type on an ADS stream. It implements the stream
+// interface of each xDS service.
+type adsTypeStream struct {
+	grpc.ServerStream
+
+	ads      *adsConnection
+	typeURL  string
+	requests chan *xdsapi.DiscoveryRequest
+}
+
+// StreamAggregatedResources implements ads.AggregatedDiscoveryServiceServer, serving CDS, EDS
+// and LDS on a single stream. Requests for other types are ignored. The stream is closed when
+// the proxy closes it, or when the push loop of a type returns.
+func (s *DiscoveryServer) StreamAggregatedResources(stream ads.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	peerAddr := unknownPeerAddressStr
+	if peerInfo, ok := peer.FromContext(stream.Context()); ok {
+		peerAddr = peerInfo.Addr.String()
+	}
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	a := &adsConnection{stream: stream, sendLock: make(chan struct{}, 1), types: map[string]*adsTypeStream{}}
+	a.ctx = context.WithValue(ctx, adsContextKey{}, a)
+
+	var handlers sync.WaitGroup
+	// done receives the result of each push loop, at most one per type.
+	done := make(chan error, len(adsTypes))
+	recvDone := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvDone <- err
+				return
+			}
+			if !a.fillNode(req) {
+				recvDone <- status.Error(codes.InvalidArgument, "missing node in the initial request")
+				return
+			}
+			t := a.typeStream(s, req, &handlers, done)
+			if t == nil {
+				log.Warnf("ADS: ignoring request for unsupported type %q from %q", req.TypeUrl, peerAddr)
+				continue
+			}
+			select {
+			case t.requests <- req:
+			case <-a.ctx.Done():
+				recvDone <- a.ctx.Err()
+				return
+			}
+		}
+	}()
+
+	var err error
+	select {
+	case err = <-recvDone:
+		if status.Code(err) == codes.Canceled || err == io.EOF {
+			log.Infof("ADS: close for client %q: %v", peerAddr, err)
+			err = nil
+		} else {
+			log.Errorf("ADS: close for client %q terminated with errors %v", peerAddr, err)
+		}
+		// The push loops get the end of their stream.
+		a.close(err)
+	case err = <-done:
+		// The type is no longer served, close the stream to let the proxy reconnect. The
+		// other push loops get a canceled stream.
+		a.mutex.Lock()
+		a.closed = true
+		a.mutex.Unlock()
+		cancel()
+	}
+	// The push loops waiting to send return on the canceled context. A Send stuck past its
+	// timeout only ends once gRPC closes the stream, after this handler returns.
+	handlers.Wait()
+	for err == nil && len(done) > 0 {
+		err = <-done
+	}
+	return err
+}
+
+// adsTypes are the push loops of the types served on ADS streams, by type URL.
+var adsTypes = map[string]func(s *DiscoveryServer, t *adsTypeStream) error{
+	clusterType: func(s *DiscoveryServer, t *adsTypeStream) error {
+		return s.StreamClusters(t)
+	},
+	endpointType: func(s *DiscoveryServer, t *adsTypeStream) error {
+		return s.StreamEndpoints(t)
+	},
+	listenerType: func(s *DiscoveryServer, t *adsTypeStream) error {
+		return s.StreamListeners(t)
+	},
+}
+
+// fillNode sets the node of the earlier requests in a request without node. Returns false
+// if no request had a node.
+func (a *adsConnection) fillNode(req *xdsapi.DiscoveryRequest) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if req.Node != nil {
+		a.node = req.Node
+	} else {
+		req.Node = a.node
+	}
+	return req.Node != nil
+}
+
+// typeStream returns the stream of the request type, starting its push loop on the first
+// request. Nil for the types not served, or once the connection is closed.
+func (a *adsConnection) typeStream(s *DiscoveryServer, req *xdsapi.DiscoveryRequest,
+	handlers *sync.WaitGroup, done chan<- error) *adsTypeStream {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if t, f := a.types[req.TypeUrl]; f {
+		return t
+	}
+	run := adsTypes[req.TypeUrl]
+	if run == nil || a.closed {
+		return nil
+	}
+	t := &adsTypeStream{
+		ServerStream: a.stream,
+		ads:          a,
+		typeURL:      req.TypeUrl,
+		requests:     make(chan *xdsapi.DiscoveryRequest, 1),
+	}
+	a.types[req.TypeUrl] = t
+	handlers.Add(1)
+	go func() {
+		defer handlers.Done()
+		done <- run(s, t)
+	}()
+	return t
+}
+
+// close ends the requests of the type streams with err, io.EOF if nil. Called once the ADS
+// stream is done receiving.
+func (a *adsConnection) close(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.closed = true
+	a.recvErr = err
+	for _, t := range a.types {
+		close(t.requests)
+	}
+}
+
+// setClusters registers the CDS connection of the stream.
+func (a *adsConnection) setClusters(con *CdsConnection) {
+	a.mutex.Lock()
+	a.clusters = con
+	a.mutex.Unlock()
+}
+
+// adsFromContext returns the ADS connection of a type stream context, nil for the streams of
+// the xDS services.
+func adsFromContext(ctx context.Context) *adsConnection {
+	a, _ := ctx.Value(adsContextKey{}).(*adsConnection)
+	return a
+}
+
+// send sends a response of the type on the stream, after the pending CDS push for the
+// responses of other types. Returns Canceled if the stream is closed while waiting for the
+// Send of another type.
+func (a *adsConnection) send(typeURL string, resp *xdsapi.DiscoveryResponse) error {
+	if typeURL != clusterType {
+		a.waitClusters()
+	}
+	select {
+	case a.sendLock <- struct{}{}:
+	case <-a.ctx.Done():
+		return status.Error(codes.Canceled, a.ctx.Err().Error())
+	}
+	defer func() { <-a.sendLock }()
+	return a.stream.Send(resp)
+}
+
+// waitClusters waits, up to adsOrderTimeout, until the CDS connection of the stream has no
+// push queued or in progress.
+func (a *adsConnection) waitClusters() {
+	a.mutex.Lock()
+	con := a.clusters
+	a.mutex.Unlock()
+	if con == nil {
+		return
+	}
+	deadline := time.Now().Add(adsOrderTimeout)
+	for con.pushPending() {
+		if time.Now().After(deadline) {
+			log.Warnf("ADS: CDS push for %s %q still pending after %v, sending out of order",
+				con.key, con.PeerAddr, adsOrderTimeout)
+			return
+		}
+		select {
+		case <-time.After(adsOrderPoll):
+		case <-a.ctx.Done():
+			return
+		}
+	}
+}
+
+// Context returns the context of the ADS stream, canceled when it closes.
+func (t *adsTypeStream) Context() context.Context {
+	return t.ads.ctx
+}
+
+// Send sends the response on the ADS stream.
+func (t *adsTypeStream) Send(resp *xdsapi.DiscoveryResponse) error {
+	return t.ads.send(t.typeURL, resp)
+}
+
+// Recv returns the next request of the type.
+func (t *adsTypeStream) Recv() (*xdsapi.DiscoveryRequest, error) {
+	select {
+	case req, ok := <-t.requests:
+		if !ok {
+			t.ads.mutex.Lock()
+			defer t.ads.mutex.Unlock()
+			return nil, t.ads.recvErr
+		}
+		return req, nil
+	case <-t.ads.ctx.Done():
+		return nil, status.Error(codes.Canceled, t.ads.ctx.Err().Error())
+	}
+}
+
+// setPushing records whether a push is signaled, delayed or in progress, for the ADS ordering.
+func (con *CdsConnection) setPushing(pushing bool) {
+	var v int32
+	if pushing {
+		v = 1
+	}
+	atomic.StoreInt32(&con.pushing, v)
+}
+
+// pushPending returns true if a push to the connection is queued, delayed or in progress.
+func (con *CdsConnection) pushPending() bool {
+	return len(con.pushChannel) > 0 || atomic.LoadInt32(&con.pushing) != 0
+}
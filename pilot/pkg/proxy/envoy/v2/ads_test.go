@@ -0,0 +1,175 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// startAdsStream runs StreamAggregatedResources for the stream in the background. The
+// returned channel receives its result.
+func startAdsStream(s *DiscoveryServer, stream *fakeStream) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.StreamAggregatedResources(stream)
+	}()
+	return done
+}
+
+// addTestEdsCluster registers a cluster with an empty load assignment, without looking up
+// its endpoints in the registry.
+func addTestEdsCluster(s *DiscoveryServer, name string) {
+	c := s.getOrAddEdsCluster(name)
+	c.mutex.Lock()
+	c.LoadAssignment = &xdsapi.ClusterLoadAssignment{ClusterName: name}
+	c.mutex.Unlock()
+}
+
+func TestAdsStream(t *testing.T) {
+	const cluster = "outbound|80||a.default.svc.cluster.local"
+	s := newTestServer(newFakeGenerator(cluster))
+	addTestEdsCluster(s, cluster)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startAdsStream(s, stream)
+
+	stream.sendRequest(clusterRequest(testNodeID))
+	resp := stream.recvResponse(t)
+	if resp.TypeUrl != clusterType || len(resp.Resources) != 1 {
+		t.Fatalf("got %d resources of type %s, want the cluster", len(resp.Resources), resp.TypeUrl)
+	}
+	waitCdsCon(t, testNodeID)
+
+	// Envoy only sends the node in the first request of the stream.
+	stream.sendRequest(&xdsapi.DiscoveryRequest{TypeUrl: endpointType, ResourceNames: []string{cluster}})
+	if resp := stream.recvResponse(t); resp.TypeUrl != endpointType || len(resp.Resources) != 1 {
+		t.Fatalf("got %d resources of type %s, want the endpoints", len(resp.Resources), resp.TypeUrl)
+	}
+	stream.sendRequest(&xdsapi.DiscoveryRequest{TypeUrl: listenerType})
+	if resp := stream.recvResponse(t); resp.TypeUrl != listenerType {
+		t.Fatalf("got type %s, want the listeners", resp.TypeUrl)
+	}
+
+	// Unsupported types are ignored.
+	stream.sendRequest(&xdsapi.DiscoveryRequest{TypeUrl: typePrefix + "RouteConfiguration"})
+	stream.expectNoResponse(t, 50*time.Millisecond)
+
+	stream.close()
+	if err := waitStreamDone(t, done); err != nil {
+		t.Errorf("stream returned %v", err)
+	}
+	if n := cdsConCount(testNodeID); n != 0 {
+		t.Errorf("%d CDS connections registered after close, want 0", n)
+	}
+}
+
+func TestAdsOrdering(t *testing.T) {
+	defer resendUnchanged()()
+	const cluster = "outbound|80||a.default.svc.cluster.local"
+	g := newFakeGenerator(cluster)
+	s := newTestServer(g)
+	addTestEdsCluster(s, cluster)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startAdsStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	waitCdsCon(t, testNodeID)
+	stream.sendRequest(&xdsapi.DiscoveryRequest{TypeUrl: endpointType, ResourceNames: []string{cluster}})
+	stream.recvResponse(t)
+
+	// A slow CDS push holds the endpoints of the same config change.
+	release := make(chan struct{})
+	g.mutex.Lock()
+	g.onBuild = func() { <-release }
+	g.mutex.Unlock()
+	cdsPushAll(nil)
+	// As edsPushAll, without recomputing the endpoints.
+	c := s.getEdsCluster(cluster)
+	c.mutex.Lock()
+	for _, con := range c.EdsClients {
+		con.signalPush()
+	}
+	c.mutex.Unlock()
+	stream.expectNoResponse(t, 100*time.Millisecond)
+	close(release)
+	first, second := stream.recvResponse(t), stream.recvResponse(t)
+	if first.TypeUrl != clusterType || second.TypeUrl != endpointType {
+		t.Errorf("got %s then %s, want the clusters first", first.TypeUrl, second.TypeUrl)
+	}
+	g.mutex.Lock()
+	g.onBuild = nil
+	g.mutex.Unlock()
+}
+
+func TestAdsMissingNode(t *testing.T) {
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startAdsStream(s, stream)
+	stream.sendRequest(&xdsapi.DiscoveryRequest{TypeUrl: clusterType})
+	if err := waitStreamDone(t, done); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("stream without node returned %v, want InvalidArgument", err)
+	}
+}
+
+func TestAdsSendTimeout(t *testing.T) {
+	oldTimeout, oldOrder := cdsSendTimeout, adsOrderTimeout
+	cdsSendTimeout, adsOrderTimeout = 100*time.Millisecond, 10*time.Millisecond
+	defer func() { cdsSendTimeout, adsOrderTimeout = oldTimeout, oldOrder }()
+	// Either Send may time out first, the EDS one waiting for the CDS one.
+	sendTimeouts := func() float64 {
+		return counterValue(t, cdsSendTimeoutsCounter) + counterValue(t, edsSendTimeoutsCounter)
+	}
+	timeouts := sendTimeouts()
+
+	const cluster = "outbound|80||a.default.svc.cluster.local"
+	s := newTestServer(newFakeGenerator(cluster))
+	addTestEdsCluster(s, cluster)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startAdsStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	waitCdsCon(t, testNodeID)
+	stream.sendRequest(&xdsapi.DiscoveryRequest{TypeUrl: endpointType, ResourceNames: []string{cluster}})
+	stream.recvResponse(t)
+
+	// The CDS Send blocks past the deadline, until the stream is closed, with an EDS push
+	// queued behind it.
+	stream.slow(time.Hour)
+	cdsPushAll(nil)
+	c := s.getEdsCluster(cluster)
+	c.mutex.Lock()
+	for _, con := range c.EdsClients {
+		con.signalPush()
+	}
+	c.mutex.Unlock()
+
+	if err := waitStreamDone(t, done); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("stream returned %v, want DeadlineExceeded", err)
+	}
+	if n := sendTimeouts(); n < timeouts+1 {
+		t.Errorf("send timeouts counters moved by %v, want at least 1", n-timeouts)
+	}
+	// gRPC cancels the stream when the handler returns, ending the blocked Send.
+	stream.cancel()
+	stream.waitSendsReturned(t)
+}
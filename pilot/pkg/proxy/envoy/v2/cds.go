@@ -15,13 +15,22 @@
 package v2
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc/codes"
@@ -31,18 +40,112 @@ import (
 	"istio.io/istio/pilot/pkg/model"
 
 	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/gogo/protobuf/jsonpb"
 	"github.com/gogo/protobuf/types"
 
 	"istio.io/istio/pkg/log"
 )
 
 var (
-	cdsDebug = os.Getenv("PILOT_DEBUG_CDS") != "0"
+	// cdsDebug is 1 when the verbose logging is on, accessed atomically: the push loops read it
+	// while the debug handler and the ttl revert change it. Read with cdsDebugEnabled.
+	cdsDebug = debugFlag(os.Getenv("PILOT_DEBUG_CDS") != "0")
 
-	cdsConnectionsMux sync.Mutex
+	// cdsDebugMutex serializes the changes of cdsDebug by the debug handler and the ttl
+	// revert, and protects cdsDebugRevert.
+	cdsDebugMutex sync.Mutex
+	// cdsDebugRevert turns cdsDebug off at the end of a debug=1&ttl=N period.
+	cdsDebugRevert *time.Timer
+
+	// cdsDebounce is the delay of update pushes, set with PILOT_CDS_DEBOUNCE. The push signals
+	// received within the delay, for example from a bursty config apply, result in a single
+	// push. Zero disables the debounce.
+	cdsDebounce = envDuration("PILOT_CDS_DEBOUNCE", 100*time.Millisecond)
+
+	// cdsDebounceMax, set with PILOT_CDS_DEBOUNCE_MAX, makes cdsDebounce a quiet period: each
+	// push signal restarts the debounce, up to cdsDebounceMax after the first signal. A rolling
+	// deployment then results in a single push once the updates stop. Zero (the default) keeps
+	// a fixed delay from the first signal.
+	cdsDebounceMax = envDuration("PILOT_CDS_DEBOUNCE_MAX", 0)
+
+	// cdsSkipUnchanged skips the update pushes with the version last sent on the connection:
+	// the envoy already has these clusters. Disabled with PILOT_CDS_SKIP_UNCHANGED=0, to
+	// resend the config on each push.
+	cdsSkipUnchanged = os.Getenv("PILOT_CDS_SKIP_UNCHANGED") != "0"
+
+	// cdsMonotonicVersion, set with PILOT_CDS_MONOTONIC_VERSION=1, sends a per-connection
+	// VersionInfo increasing with each response instead of the hash of the clusters, for the
+	// tools expecting monotonic versions. Unchanged pushes are still detected on the hash.
+	cdsMonotonicVersion = os.Getenv("PILOT_CDS_MONOTONIC_VERSION") == "1"
+
+	// cdsInitialPushWindow skips the unchanged update pushes following the response to the
+	// initial request within the window, even with PILOT_CDS_SKIP_UNCHANGED=0: a config
+	// change racing with the connect would otherwise send the same clusters twice. Set with
+	// PILOT_CDS_INITIAL_PUSH_WINDOW.
+	cdsInitialPushWindow = envDuration("PILOT_CDS_INITIAL_PUSH_WINDOW", time.Second)
+
+	// cdsMaxConnections caps the CDS connections, set with PILOT_CDS_MAX_CONNECTIONS. Streams
+	// over the cap are rejected: the envoys retry, possibly reaching another pilot. Zero (the
+	// default) is unlimited.
+	cdsMaxConnections = envInt("PILOT_CDS_MAX_CONNECTIONS", 0)
+
+	// cdsSlowSend is the Send duration above which the client is considered to be
+	// applying backpressure, and a warning is logged.
+	cdsSlowSend = envDuration("PILOT_CDS_SLOW_SEND", time.Second)
+
+	// cdsKeepLastPush enables retaining a copy of the last response pushed to each
+	// connection, for /debug/cdsz?lastpush=1. Debug only, off by default.
+	cdsKeepLastPush = os.Getenv("PILOT_DEBUG_CDS_LASTPUSH") == "1"
+
+	// cdsSamplePercent is the percent of connections collecting the detailed diagnostics
+	// (lastpush, flapping), when enabled. Other connections can be sampled explicitly with
+	// /debug/cdsz?sample=1&node=NODE. Basic counters are kept for all connections.
+	cdsSamplePercent = envInt("PILOT_DEBUG_CDS_SAMPLE_PERCENT", 100)
+
+	// cdsLastPushMaxSize is the largest marshaled response retained by cdsKeepLastPush.
+	// Larger responses only keep the summary.
+	cdsLastPushMaxSize = 1024 * 1024
+
+	// cdsMaxBytesPerSec limits the bytes sent on each CDS connection. Larger pushes are
+	// spread over time instead of dropped. Zero means unlimited.
+	cdsMaxBytesPerSec = envInt("PILOT_CDS_MAX_BYTES_PER_SEC", 0)
+
+	// cdsStuckInitialRequests is the number of requests without a nonce, including the initial
+	// one, after which a connection that never ACKed is flagged as stuck.
+	cdsStuckInitialRequests = 4
+
+	// cdsSmallChangePercent, if set, logs pushes where at most this percent of the clusters
+	// changed, as candidates for a delta push.
+	// TODO: use the delta path for such pushes, once the proxies and go-control-plane
+	// support incremental CDS.
+	cdsSmallChangePercent = envInt("PILOT_CDS_SMALL_CHANGE_PERCENT", 0)
+
+	// cdsAllocWarnBytes, if set, measures the memory allocated while generating and
+	// marshaling each push, and logs the pushes allocating more. Reading the memory stats
+	// stops the world, so this is off by default. The measure includes allocations from
+	// other goroutines, it is only accurate on a quiet pilot.
+	cdsAllocWarnBytes = envInt("PILOT_CDS_ALLOC_WARN_BYTES", 0)
+
+	// cdsPushWaitTimeout bounds how long /debug/cdsz?push=1&node=NODE&wait=1 waits for the push.
+	cdsPushWaitTimeout = 10 * time.Second
+
+	errCdsFrozen           = errors.New("connection is frozen")
+	errCdsGeneration       = errors.New("cluster generation failed")
+	errCdsConnectionClosed = errors.New("connection closed")
+
+	// cdsMaxPushesPerMinute caps the pushes to each connection. Pushes beyond the cap are
+	// coalesced into one push at the next allowed time. Zero means no cap.
+	cdsMaxPushesPerMinute = envInt("PILOT_CDS_MAX_PUSHES_PER_MINUTE", 0)
+
+	// cdsPushRateWindow is the window of cdsMaxPushesPerMinute.
+	cdsPushRateWindow = time.Minute
 
 	// One connection for each Envoy connected to this pilot.
-	cdsConnections = map[string]*CdsConnection{}
+	cdsConnections = newConnectionRegistry(cdsConnectionsGauge)
+
+	// cdsPushOffset rotates the start of the push fan-out, so the same connections are not
+	// always served last under sustained churn. Accessed atomically.
+	cdsPushOffset uint64
 )
 
 // CdsConnection represents a streaming grpc connection from an envoy server.
@@ -53,37 +156,513 @@ type CdsConnection struct {
 	// Time of connection, for debugging
 	Connect time.Time
 
+	// nodeID is the node id sent in the initial request.
+	nodeID string
+
+	// key is the key of the connection in cdsConnections, unique for each stream: several
+	// envoys may connect with the same node id. Set before the connection is registered.
+	key string
+
+	// network of the proxy, from the node metadata. Only clusters reachable from the
+	// network are pushed. Empty if the proxy didn't set a network.
+	network string
+
+	// labels of the workload, from the node metadata. Used to target label-scoped pushes.
+	labels model.Labels
+
+	// profile tunes the generation for the proxy class. Nil uses the server settings.
+	profile *GenerationProfile
+
+	// hosts are the service hostnames of the clusters last generated for the connection, nil
+	// before the first push. Used to target the pushes for a service change. Protected by mutex.
+	hosts map[string]bool
+
+	// pushing is set while a push is signaled, delayed or in progress, accessed atomically.
+	// On ADS streams the endpoint and listener responses wait for the pending pushes.
+	pushing int32
+
+	// server is the DiscoveryServer serving the stream, for the batch pushes.
+	server *DiscoveryServer
+
+	// priority orders the connections in the pushes to all connections, higher first. Set
+	// before the connection is registered.
+	priority int
+
+	// version is the content version (the hash of the clusters) of the last response sent on
+	// the connection, empty before the first one. Only used by the stream goroutine.
+	version string
+
+	// versionCount is the VersionInfo of the last response with cdsMonotonicVersion. Only used
+	// by the stream goroutine.
+	versionCount uint64
+
+	// initialPushTime is the time the response to the initial request was sent. Only used
+	// by the stream goroutine.
+	initialPushTime time.Time
+
+	// subscribed is the set of cluster names in the ResourceNames of the last request. Only
+	// these clusters are pushed, nil (the default) pushes all the clusters. Only used by the
+	// stream goroutine.
+	subscribed map[string]bool
+
 	modelNode *model.Proxy
 
 	// Sending on this channel results in  push. We may also make it a channel of objects so
 	// same info can be sent to all clients, without recomputing.
 	pushChannel chan bool
+
+	// drained is closed by DrainConnections, to close the stream.
+	drained   chan struct{}
+	drainOnce sync.Once
+
+	// mutex protects the debug info below, which is read by Cdsz.
+	mutex sync.Mutex
+
+	// lastPush is the last response pushed to the envoy, if cdsKeepLastPush is set.
+	lastPush *cdsPushRecord
+
+	// changes tracks the content changes of each pushed cluster, if cdsTrackFlapping is set.
+	changes map[string]*clusterChanges
+
+	// ack tracks the responses sent and the ACKs, NACKs and stale replies of the envoy.
+	ack cdsAckState
+
+	// lastRequestTime is the time of the last request received, lastPushTime of the last
+	// response sent. Used to close idle connections, and listed in Cdsz to spot stale ones.
+	lastRequestTime time.Time
+	lastPushTime    time.Time
+
+	// pushes and bytes count the responses sent to the envoy.
+	pushes int
+	bytes  int64
+
+	// sendFailures counts the responses that failed to send.
+	sendFailures int
+
+	// coalescedPushes counts the push signals merged with an already queued push, high for
+	// envoys lagging behind the config changes.
+	coalescedPushes int
+
+	// pushedHash is the content hash of the last response sent, zero before the first one.
+	pushedHash uint64
+
+	// events is the timeline of the connection, for /debug/cdsz?events=1&node=NODE.
+	events cdsEventLog
+
+	// loops detects identical pushes in a loop. Only used by the stream goroutine.
+	loops pushLoopDetector
+
+	// pushWaiters are notified with the result of the next push, for push=1&wait=1.
+	pushWaiters []chan error
+
+	// sampled connections collect the detailed diagnostics.
+	sampled bool
+
+	// debug enables the verbose logging for the connection only, set with
+	// /debug/cdsz?debug=1&node=NODE.
+	debug bool
+
+	// frozen connections only get the response to the initial request, and no further
+	// pushes. Used for observe-only proxies, set with /debug/cdsz?freeze=1&node=NODE.
+	frozen bool
+}
+
+// cdsPushRecord keeps a copy of a pushed response, for debugging.
+type cdsPushRecord struct {
+	// Time of the push
+	Time time.Time
+
+	VersionInfo string
+	Nonce       string
+
+	// Clusters is the number of clusters in the response
+	Clusters int
+
+	// Size of the marshaled response, in bytes
+	Size int
+
+	// Truncated is set if the response was larger than cdsLastPushMaxSize and was not retained.
+	Truncated bool
+
+	// response is the marshaled DiscoveryResponse, as sent.
+	response []byte
+}
+
+// setSampled enables or disables the detailed diagnostics for the connection.
+func (con *CdsConnection) setSampled(sampled bool) {
+	con.mutex.Lock()
+	con.sampled = sampled
+	con.mutex.Unlock()
+}
+
+func (con *CdsConnection) isSampled() bool {
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	return con.sampled
+}
+
+// node returns the proxy, or nil before the initial request. For the debug handlers.
+func (con *CdsConnection) node() *model.Proxy {
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	return con.modelNode
+}
+
+// setDebug enables or disables the verbose logging of the connection, in addition to the
+// global cdsDebug.
+func (con *CdsConnection) setDebug(debug bool) {
+	con.mutex.Lock()
+	con.debug = debug
+	con.mutex.Unlock()
+}
+
+// debugging returns true if the verbose logging is enabled for the connection.
+func (con *CdsConnection) debugging() bool {
+	if cdsDebugEnabled() {
+		return true
+	}
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	return con.debug
+}
+
+// setFrozen enables or disables update pushes to the connection.
+func (con *CdsConnection) setFrozen(frozen bool) {
+	con.mutex.Lock()
+	con.frozen = frozen
+	con.mutex.Unlock()
+}
+
+func (con *CdsConnection) isFrozen() bool {
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	return con.frozen
+}
+
+// waitPush returns a channel notified with the result of the next push to the connection.
+func (con *CdsConnection) waitPush() <-chan error {
+	ch := make(chan error, 1)
+	con.mutex.Lock()
+	con.pushWaiters = append(con.pushWaiters, ch)
+	con.mutex.Unlock()
+	return ch
+}
+
+// takePushWaiters returns the channels registered with waitPush, and clears them.
+// Called when a push starts.
+func (con *CdsConnection) takePushWaiters() []chan error {
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	waiters := con.pushWaiters
+	con.pushWaiters = nil
+	return waiters
+}
+
+func notifyPush(waiters []chan error, err error) {
+	for _, ch := range waiters {
+		ch <- err
+	}
+}
+
+// signalPush queues a push to the connection, without blocking on a connection whose
+// stream is busy. Returns false if a push was already queued: it will send the current
+// config, the signal is not needed.
+func (con *CdsConnection) signalPush() bool {
+	// Pending from now: a blocked stream goroutine gets the signal before it runs.
+	con.setPushing(true)
+	select {
+	case con.pushChannel <- true:
+		return true
+	default:
+		con.mutex.Lock()
+		con.coalescedPushes++
+		con.mutex.Unlock()
+		cdsPushQueuedCounter.Inc()
+		return false
+	}
+}
+
+// recordRequest tracks the requests received after the initial one. Requests without a
+// response nonce are fresh requests: an envoy that only sends those never progressed past
+// the initial request, and the connection is flagged as stuck.
+func (con *CdsConnection) recordRequest(req *xdsapi.DiscoveryRequest) {
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	if req.ResponseNonce != "" {
+		kind, measured := con.ack.reply(req, time.Now())
+		switch kind {
+		case replyStale:
+			con.events.add(cdsEventStale, fmt.Sprintf("version %s, nonce %s", req.VersionInfo, req.ResponseNonce))
+		case replyNack:
+			cdsNacksCounter.Inc()
+			con.events.add(cdsEventNack, fmt.Sprintf("version %s: %s", req.VersionInfo, req.ErrorDetail.Message))
+		default:
+			con.events.add(cdsEventAck, "version "+req.VersionInfo)
+		}
+		if measured {
+			cdsAckLatency.Observe(con.ack.latency.Seconds())
+		}
+		return
+	}
+	con.ack.initialRequests++
+	con.events.add(cdsEventRequest, "")
+	if con.ack.replies == 0 && con.ack.initialRequests >= cdsStuckInitialRequests && !con.ack.stuck {
+		con.ack.stuck = true
+		cdsStuckInitialCounter.Inc()
+		log.Warnf("CDS: %s %q sent %d initial requests without ACK, can't accept config",
+			con.nodeID, con.PeerAddr, con.ack.initialRequests)
+	}
 }
 
-// clusters aggregate a DiscoveryResponse for pushing.
+// recordSent tracks the response sent to the envoy, to match the replies with their nonce and
+// measure the ACK latency.
+func (con *CdsConnection) recordSent(response *xdsapi.DiscoveryResponse) {
+	con.mutex.Lock()
+	con.ack.sent(response, time.Now())
+	con.mutex.Unlock()
+}
+
+// recordDelivered counts a response successfully sent to the envoy.
+func (con *CdsConnection) recordDelivered(response *xdsapi.DiscoveryResponse) {
+	size := response.Size()
+	hash := contentHash(response)
+	con.mutex.Lock()
+	con.pushes++
+	con.bytes += int64(size)
+	con.pushedHash = hash
+	con.lastPushTime = time.Now()
+	con.mutex.Unlock()
+	cdsPushesCounter.Inc()
+}
+
+// MarshalJSON implements json.Marshaler, for Cdsz. The connection is concurrently updated
+// by the stream.
+func (con *CdsConnection) MarshalJSON() ([]byte, error) {
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	var successRatio *float64
+	if r, ok := con.successRatio(); ok {
+		successRatio = &r
+	}
+	var proxyID, namespace string
+	if con.modelNode != nil {
+		proxyID, namespace = con.modelNode.ID, proxyNamespace(con.modelNode.ID)
+	}
+	var lastPush, lastRequest *time.Time
+	if !con.lastPushTime.IsZero() {
+		lastPush = &con.lastPushTime
+	}
+	if !con.lastRequestTime.IsZero() {
+		lastRequest = &con.lastRequestTime
+	}
+	return json.Marshal(struct {
+		NodeID           string `json:",omitempty"`
+		ProxyID          string `json:",omitempty"`
+		Namespace        string `json:",omitempty"`
+		PeerAddr         string
+		Connect          time.Time
+		Uptime           time.Duration
+		LastPush         *time.Time    `json:",omitempty"`
+		LastRequest      *time.Time    `json:",omitempty"`
+		Pushes           int           `json:",omitempty"`
+		Acks             int           `json:",omitempty"`
+		Nacks            int           `json:",omitempty"`
+		Network          string        `json:",omitempty"`
+		AckLatency       time.Duration `json:",omitempty"`
+		StuckInitial     bool          `json:",omitempty"`
+		PushSuccessRatio *float64      `json:",omitempty"`
+		AckedVersion     string        `json:",omitempty"`
+		LastNack         string        `json:",omitempty"`
+		StaleRequests    int           `json:",omitempty"`
+		CoalescedPushes  int           `json:",omitempty"`
+	}{con.nodeID, proxyID, namespace, con.PeerAddr, con.Connect, time.Since(con.Connect), lastPush, lastRequest, con.pushes,
+		con.ack.acks(), con.ack.nacks, con.network, con.ack.latency, con.ack.stuck, successRatio,
+		con.ack.ackedVersion, con.ack.lastNack, con.ack.stale, con.coalescedPushes})
+}
+
+// proxyNamespace returns the namespace of the proxy ID, in the <pod name>.<namespace> form
+// of kubernetes proxies. Empty for other IDs.
+func proxyNamespace(id string) string {
+	parts := strings.Split(id, ".")
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// successRatio returns the ratio of the sends that succeeded, false if nothing was sent.
+// Called with the mutex held.
+func (con *CdsConnection) successRatio() (float64, bool) {
+	sends := con.pushes + con.sendFailures
+	if sends == 0 {
+		return 0, false
+	}
+	return float64(con.pushes) / float64(sends), true
+}
+
+// recordSendFailure counts a response that failed to send.
+func (con *CdsConnection) recordSendFailure() {
+	con.mutex.Lock()
+	con.sendFailures++
+	con.mutex.Unlock()
+	cdsSendFailuresCounter.Inc()
+}
+
+// recordPush retains a copy of the response sent to the envoy.
+func (con *CdsConnection) recordPush(response *xdsapi.DiscoveryResponse) {
+	rec := &cdsPushRecord{
+		Time:        time.Now(),
+		VersionInfo: response.VersionInfo,
+		Nonce:       response.Nonce,
+		Clusters:    len(response.Resources),
+		Size:        response.Size(),
+	}
+	if rec.Size > cdsLastPushMaxSize {
+		rec.Truncated = true
+	} else {
+		data, err := response.Marshal()
+		if err != nil {
+			log.Warnf("CDS: failed to marshal response for debug %v", err)
+		}
+		rec.response = data
+	}
+
+	con.mutex.Lock()
+	con.lastPush = rec
+	con.mutex.Unlock()
+}
+
+// clusters aggregate a DiscoveryResponse for pushing. A nil or empty list of clusters
+// results in a valid, empty response.
 func (con *CdsConnection) clusters(response []*xdsapi.Cluster) *xdsapi.DiscoveryResponse {
 	out := &xdsapi.DiscoveryResponse{
 		// All resources for CDS ought to be of the type ClusterLoadAssignment
 		TypeUrl: clusterType,
 
-		// Pilot does not really care for versioning. It always supplies what's currently
-		// available to it, irrespective of whether Envoy chooses to accept or reject CDS
-		// responses. Pilot believes in eventual consistency and that at some point, Envoy
-		// will begin seeing results it deems to be good.
-		VersionInfo: versionInfo(),
-		Nonce:       nonce(),
+		Nonce:     nonce(),
+		Resources: make([]types.Any, 0, len(response)),
 	}
 
-	for _, c := range response {
-		cc, _ := types.MarshalAny(c)
-		out.Resources = append(out.Resources, *cc)
+	key, keyed := con.cacheKey()
+	keyed = keyed && cdsClusterCacheEnabled
+	epoch := atomic.LoadUint64(&cdsCacheEpoch)
+	if keyed {
+		// Another connection of the key built a response of these clusters, share it. The
+		// response only depends on the clusters, which are not modified once generated.
+		if resources, version, f := cdsClusterCache.response(key, epoch, response); f {
+			cdsSharedResponsesCounter.Inc()
+			out.Resources, out.VersionInfo = resources, version
+			return out
+		}
+	}
+	if cdsClusterCacheEnabled {
+		// Connections sharing the cached clusters also share their marshaling.
+		out.Resources = cdsClusterCache.marshal(response)
+	} else {
+		for _, c := range response {
+			if c == nil {
+				continue
+			}
+			if cc := marshalCluster(c); cc != nil {
+				out.Resources = append(out.Resources, *cc)
+			}
+		}
+	}
+	// The version is the hash of the clusters: an unchanged config has an unchanged version,
+	// letting envoy (and the push loop) recognize an identical response.
+	out.VersionInfo = strconv.FormatUint(contentHash(out), 16)
+	if keyed {
+		cdsClusterCache.addResponse(key, epoch, response, out.Resources, out.VersionInfo)
 	}
 
 	return out
 }
 
+// setVersion sets the VersionInfo of a response about to be sent on the connection to the
+// next per-connection version, if cdsMonotonicVersion is set. Returns the content version of
+// the response, built by clusters.
+func (con *CdsConnection) setVersion(response *xdsapi.DiscoveryResponse) string {
+	content := response.VersionInfo
+	if cdsMonotonicVersion {
+		con.versionCount++
+		response.VersionInfo = strconv.FormatUint(con.versionCount, 10)
+	}
+	return content
+}
+
+// marshalCluster returns the cluster as a response resource, or nil if it can't be marshaled.
+// The cluster is dropped from the response rather than sent empty, which envoy would NACK with
+// the whole response.
+func marshalCluster(c *xdsapi.Cluster) *types.Any {
+	// TODO: wrap each cluster in a named envoy.api.v2.Resource, for proxies supporting it,
+	// once go-control-plane is updated. The vendored version only has the Any resources.
+	cc, err := types.MarshalAny(c)
+	if err != nil {
+		log.Warnf("CDS: dropping cluster %q failing to marshal: %v", c.Name, err)
+		cdsInvalidClustersCounter.Inc()
+		return nil
+	}
+	return cc
+}
+
+// unchanged returns true if an update push with the version can be skipped: the envoy
+// already got it in the last response, and unchanged pushes are skipped or follow the
+// initial response closely.
+func (con *CdsConnection) unchanged(version string, now time.Time) bool {
+	if version != con.version {
+		return false
+	}
+	return cdsSkipUnchanged || now.Sub(con.initialPushTime) < cdsInitialPushWindow
+}
+
 // StreamClusters implements xdsapi.EndpointDiscoveryServiceServer.StreamEndpoints().
 func (s *DiscoveryServer) StreamClusters(stream xdsapi.ClusterDiscoveryService_StreamClustersServer) error {
+	return s.streamClusters(stream, stream)
+}
+
+// responseSender sends the responses of a stream. The gRPC stream implements it, other
+// senders (in-memory, recording, fault-injecting) allow running the push loop without gRPC.
+type responseSender interface {
+	Send(*xdsapi.DiscoveryResponse) error
+}
+
+// pushReason is the cause of a push on a CDS stream.
+type pushReason int
+
+const (
+	// pushInitial is the response to the initial request, always sent.
+	pushInitial pushReason = iota
+	// pushUpdate is a config change or a push signal, skipped if unchanged.
+	pushUpdate
+	// pushDelayed is an update delayed by the push rate of the connection.
+	pushDelayed
+)
+
+func (r pushReason) String() string {
+	switch r {
+	case pushInitial:
+		return "initial request"
+	case pushDelayed:
+		return "delayed update"
+	default:
+		return "update"
+	}
+}
+
+// event describes the push in the event log, safe if the last-known-good clusters are pushed.
+func (r pushReason) event(safe bool) string {
+	if safe {
+		return r.String() + ", safe mode"
+	}
+	return r.String()
+}
+
+// streamClusters runs the CDS push loop, receiving requests from the stream and sending
+// responses with the sender.
+func (s *DiscoveryServer) streamClusters(stream xdsapi.ClusterDiscoveryService_StreamClustersServer,
+	sender responseSender) error {
+	// A stuck Send closes the connection, rather than blocking the ACKs and pushes.
+	sender = withSendTimeout(sender, cdsSendTimeout, cdsSendTimeoutsCounter)
 	peerInfo, ok := peer.FromContext(stream.Context())
 	peerAddr := "Unknown peer address"
 	if ok {
@@ -97,79 +676,380 @@ func (s *DiscoveryServer) StreamClusters(stream xdsapi.ClusterDiscoveryService_S
 	initialRequestReceived := false
 
 	con := &CdsConnection{
+		server:      s,
 		pushChannel: make(chan bool, 1),
+		drained:     make(chan struct{}),
 		PeerAddr:    peerAddr,
 		Connect:     time.Now(),
+		sampled:     rand.Intn(100) < cdsSamplePercent,
 	}
+	con.logEvent(cdsEventConnect, peerAddr)
 	// node is the key used in the cluster map. It includes the pod name and an unique identifier,
 	// since multiple envoys may connect from the same pod.
 	var node string
+	// waiters are notified when the current push completes.
+	var waiters []chan error
+	// reason is the cause of the current push.
+	var reason pushReason
+	var limiter *byteRateLimiter
+	if cdsMaxBytesPerSec > 0 {
+		limiter = newByteRateLimiter(cdsMaxBytesPerSec)
+	}
+	// pushLimiter is set on the initial request, depending on the profile.
+	var pushLimiter *pushRateLimiter
+	// pushTimer fires at the next allowed push, if a push was delayed by pushLimiter, or
+	// at the end of the debounce if debouncing is set.
+	var pushTimer <-chan time.Time
+	var debouncing bool
+	// debounceStart is the time of the first push signal of the debounce.
+	var debounceStart time.Time
+	// deferUpdate delays an update push while pilot is overloaded or the connection is over
+	// its push rate, setting pushTimer. Returns true if the push was deferred.
+	deferUpdate := func() bool {
+		if cdsOverloaded() {
+			// Update pushes are deferred, initial requests still get their response.
+			cdsThrottledCounter.Inc()
+			if con.debugging() {
+				log.Infof("CDS: deferring PUSH for %s %q by %v, pilot is overloaded", node, peerAddr, cdsThrottleDelay)
+			}
+			pushTimer = time.After(cdsThrottleDelay)
+			return true
+		}
+		if pushLimiter != nil {
+			if wait := pushLimiter.wait(time.Now()); wait > 0 {
+				if con.debugging() {
+					log.Infof("CDS: delaying PUSH for %s %q by %v, over the push rate", node, peerAddr, wait)
+				}
+				pushTimer = time.After(wait)
+				return true
+			}
+			pushLimiter.record(time.Now())
+		}
+		return false
+	}
+	// registered is set once the connection is added, on a valid initial request. A client
+	// may disconnect before sending one.
+	var registered bool
+	defer func() {
+		if registered {
+			con.mutex.Lock()
+			if r, ok := con.successRatio(); ok {
+				cdsPushSuccessRatio.Observe(r)
+			}
+			con.mutex.Unlock()
+			keepClosedEvents(node, con.eventList())
+			s.removeCdsCon(con)
+			cdsSafeMode.forget(con.nodeID)
+			cdsClusterCounts.forget(node)
+		}
+		notifyPush(waiters, errCdsConnectionClosed)
+		notifyPush(con.takePushWaiters(), errCdsConnectionClosed)
+	}()
 	go func() {
 		defer close(reqChannel)
 		for {
 			req, err := stream.Recv()
 			if err != nil {
-				log.Errorf("CDS: close for client %s %q terminated with errors %v",
-					node, peerAddr, err)
-
-				s.removeCdsCon(node, con)
+				con.logEvent(cdsEventDisconnect, err.Error())
+				// EOF and Canceled are clean closes, for example on envoy restart.
 				if status.Code(err) == codes.Canceled || err == io.EOF {
+					log.Infof("CDS: close for client %q: %v", peerAddr, err)
 					return
 				}
+				log.Errorf("CDS: close for client %q terminated with errors %v",
+					peerAddr, err)
 				receiveError = err
 				return
 			}
 			reqChannel <- req
 		}
 	}()
+	idleCheck, stopIdleCheck := idleTicker()
+	defer stopIdleCheck()
 	for {
+		// Only a delayed push may be pending while waiting.
+		con.setPushing(pushTimer != nil)
 		// Block until either a request is received or the ticker ticks
 		select {
+		case <-stream.Context().Done():
+			// The envoy is gone, possibly while the stream was busy generating or sending.
+			return nil
+
+		case <-con.drained:
+			if con.debugging() {
+				log.Infof("CDS: drained connection %s %q", node, peerAddr)
+			}
+			return nil
+
+		case now := <-idleCheck:
+			if con.idle(now) {
+				// Usually an envoy gone without closing the stream, for example on a
+				// network partition.
+				log.Warnf("CDS: closing idle connection %s %q, no activity for %v", node, peerAddr, cdsIdleTimeout)
+				return status.Errorf(codes.DeadlineExceeded, "no activity for %v", cdsIdleTimeout)
+			}
+			continue
+
 		case discReq, ok = <-reqChannel:
 			if !ok {
 				return receiveError
 			}
+			con.recordReceived(time.Now())
 			if node == "" && discReq.Node != nil {
 				node = connectionID(discReq.Node.Id)
 			}
-			nt, err := model.ParseServiceNode(discReq.Node.Id)
-			if err != nil {
-				return err
+			var nt model.Proxy
+			var err error
+			if discReq.Node == nil {
+				if con.modelNode == nil {
+					log.Warnf("CDS: initial request without node from %q", peerAddr)
+					return status.Error(codes.InvalidArgument, "missing node in the initial request")
+				}
+				// The node is only required in the initial request.
+				nt = *con.modelNode
+			} else if nt, err = model.ParseServiceNode(discReq.Node.Id); err != nil {
+				log.Warnf("CDS: invalid node id %q from %q: %v", discReq.Node.Id, peerAddr, err)
+				if con.modelNode == nil {
+					return status.Errorf(codes.InvalidArgument, "invalid node id %q: %v", discReq.Node.Id, err)
+				}
+				// A bad request on an established stream, keep serving the node of the
+				// earlier requests.
+				nt = *con.modelNode
+			} else if con.modelNode == nil || discReq.Node.Id != con.nodeID {
+				if err := s.authenticateNode(stream.Context(), discReq.Node.Id); err != nil {
+					log.Warnf("CDS: rejecting node %q from %q: %v", discReq.Node.Id, peerAddr, err)
+					return err
+				}
 			}
 
+			// Locked for the debug handlers, the stream goroutine reads it without lock.
+			con.mutex.Lock()
 			con.modelNode = &nt
+			con.mutex.Unlock()
 
-			// Given that Pilot holds an eventually consistent data model, Pilot ignores any acknowledgements
-			// from Envoy, whether they indicate ack success or ack failure of Pilot's previous responses.
+			// Given that Pilot holds an eventually consistent data model, Pilot doesn't act on the
+			// acknowledgements from Envoy, whether they indicate ack success or ack failure of Pilot's
+			// previous responses. They are only recorded, for debugging.
 			if initialRequestReceived {
+				con.recordRequest(discReq)
+				if con.setSubscription(discReq.ResourceNames) {
+					// The envoy changed its subscription, push the new set.
+					con.signalPush()
+				}
 				// TODO: once the deps are updated, log the ErrorCode if set (missing in current version)
 				if discReq.ErrorDetail != nil {
 					log.Warnf("CDS: ACK ERROR %v %s %v", peerAddr, nt.ID, discReq.String())
+					if s.CdsCallbacks != nil {
+						s.CdsCallbacks.OnNack(node, errors.New(discReq.ErrorDetail.Message))
+					}
 				}
-				if cdsDebug {
+				if con.debugging() {
 					log.Infof("CDS: ACK %v", discReq.String())
 				}
 				continue
 			}
 			initialRequestReceived = true
+			con.nodeID = discReq.Node.Id
+			con.mutex.Lock()
+			con.network = nodeNetwork(discReq.Node)
+			con.labels = nodeLabels(discReq.Node)
+			con.profile = s.generationProfile(discReq.Node, nt)
+			con.priority = nodePriority(discReq.Node, nt)
+			con.mutex.Unlock()
+			con.recordRequest(discReq)
+			con.setSubscription(discReq.ResourceNames)
+			if max := con.profile.maxPushesPerMinute(); max > 0 {
+				pushLimiter = newPushRateLimiter(max, cdsPushRateWindow)
+			}
+			if err := s.addCdsCon(node, con); err != nil {
+				log.Warnf("CDS: rejecting connection %s %q: %v", node, peerAddr, err)
+				return err
+			}
+			registered = true
+			if a := adsFromContext(stream.Context()); a != nil {
+				a.setClusters(con)
+			}
 			// Initial request
-			if cdsDebug {
+			if con.debugging() {
 				log.Infof("CDS: REQ %s %v raw: %s ", node, peerAddr, discReq.String())
 			}
+			if s.BootstrapClusters != nil {
+				if err := s.pushBootstrapClusters(stream.Context(), sender, con, node); err != nil {
+					log.Warnf("CDS: Send failure, closing grpc %v", err)
+					return err
+				}
+			}
+			reason = pushInitial
 
 		case <-con.pushChannel:
+			reason = pushUpdate
+			waiters = append(waiters, con.takePushWaiters()...)
+			if con.modelNode == nil {
+				// No initial request yet, the node is not known. The initial request will
+				// get the current config.
+				continue
+			}
+			if con.isFrozen() {
+				if con.debugging() {
+					log.Infof("CDS: skip PUSH for frozen connection %s %q", node, peerAddr)
+				}
+				notifyPush(waiters, errCdsFrozen)
+				waiters = nil
+				continue
+			}
+			if pushTimer != nil {
+				// Coalesced with the delayed push.
+				if debouncing && cdsDebounceMax > 0 {
+					// Not quiet yet, restart the debounce within the max delay.
+					if left := cdsDebounceMax - time.Since(debounceStart); left > 0 {
+						if left > cdsDebounce {
+							left = cdsDebounce
+						}
+						pushTimer = time.After(left)
+					}
+				}
+				continue
+			}
+			if cdsDebounce > 0 {
+				pushTimer = time.After(cdsDebounce)
+				debouncing = true
+				debounceStart = time.Now()
+				continue
+			}
+			if deferUpdate() {
+				continue
+			}
+
+		case <-pushTimer:
+			pushTimer = nil
+			if !debouncing {
+				reason = pushDelayed
+				if pushLimiter != nil {
+					pushLimiter.record(time.Now())
+				}
+			} else {
+				debouncing = false
+				reason = pushUpdate
+				if deferUpdate() {
+					continue
+				}
+			}
+		}
+
+		var allocStart uint64
+		if cdsAllocWarnBytes > 0 {
+			allocStart = totalAlloc()
 		}
+		generationStart := time.Now()
+		rawClusters, safe, err := s.nodeClusters(stream.Context(), con.nodeID, con.modelNode, con.network,
+			con.profile, true)
+		if err != nil && stream.Context().Err() != nil {
+			// The envoy disconnected during the retries.
+			return nil
+		}
+		if err != nil {
+			// Keep the config the envoy has, rather than pushing an empty or partial set.
+			log.Errorf("CDS: failed to generate clusters for %s %q, skipping push: %v", node, peerAddr, err)
+			notifyPush(waiters, err)
+			waiters = nil
+			continue
+		}
+		if safe {
+			log.Warnf("CDS: safe mode, pushing last-known-good clusters to %s %q", node, peerAddr)
+		}
+		rawClusters = con.subscribedClusters(rawClusters)
 
-		rawClusters, _ := s.ConfigGenerator.BuildClusters(s.env, *con.modelNode)
+		con.setHosts(clusterHosts(rawClusters))
 
+		serializationStart := time.Now()
 		response := con.clusters(rawClusters)
-		err := stream.Send(response)
+		cdsSerializationTime.Observe(time.Since(serializationStart).Seconds())
+		if cdsVerifyMarshal {
+			checkRoundTrip(node, rawClusters, response)
+		}
+		if cdsAllocWarnBytes > 0 {
+			if alloc := totalAlloc() - allocStart; alloc > uint64(cdsAllocWarnBytes) {
+				cdsHighAllocCounter.Inc()
+				log.Warnf("CDS: high allocation for PUSH to %s %q: %d bytes for %d clusters",
+					node, peerAddr, alloc, len(response.Resources))
+			}
+		}
+		if limiter != nil {
+			if wait := limiter.reserve(response.Size()); wait > 0 {
+				if con.debugging() {
+					log.Infof("CDS: throttling PUSH for %s %q by %v", node, peerAddr, wait)
+				}
+				select {
+				case <-time.After(wait):
+				case <-stream.Context().Done():
+					return stream.Context().Err()
+				}
+			}
+		}
+		if reason != pushInitial && con.unchanged(response.VersionInfo, time.Now()) {
+			// The envoy already has these clusters.
+			if con.debugging() {
+				log.Infof("CDS: skip unchanged PUSH for %s %q, version %s", node, peerAddr, response.VersionInfo)
+			}
+			cdsUnchangedPushesCounter.Inc()
+			notifyPush(waiters, nil)
+			waiters = nil
+			continue
+		}
+		if stream.Context().Err() != nil {
+			// The envoy disconnected while the response was generated, don't attempt a
+			// doomed send.
+			if con.debugging() {
+				log.Infof("CDS: skip PUSH for closed connection %s %q", node, peerAddr)
+			}
+			return nil
+		}
+		content := con.setVersion(response)
+		// Recorded before the send, the ACK may be received before Send returns.
+		con.recordSent(response)
+		sendStart := time.Now()
+		err = sender.Send(response)
+		if sendTime := time.Since(sendStart); sendTime > cdsSlowSend {
+			log.Warnf("CDS: slow send to %s %q took %v, client is applying backpressure",
+				node, peerAddr, sendTime)
+		}
 		if err != nil {
 			log.Warnf("CDS: Send failure, closing grpc %v", err)
+			con.recordSendFailure()
+			con.logEvent(cdsEventPush, fmt.Sprintf("%s, version %s: send failed: %v", reason.event(safe), response.VersionInfo, err))
+			notifyPush(waiters, err)
+			waiters = nil
 			return err
 		}
+		notifyPush(waiters, nil)
+		waiters = nil
+		con.version = content
+		if reason == pushInitial {
+			con.initialPushTime = time.Now()
+		}
+		con.recordDelivered(response)
+		cdsPushTime.Observe(time.Since(generationStart).Seconds())
+		cdsClusterCounts.record(node, len(response.Resources), time.Now())
+		con.logEvent(cdsEventPush, fmt.Sprintf("%s, version %s, %d clusters",
+			reason.event(safe), response.VersionInfo, len(response.Resources)))
+		if s.CdsCallbacks != nil {
+			s.CdsCallbacks.OnPush(node, len(response.Resources), response.VersionInfo)
+		}
+		con.checkPushLoop(node, response)
+
+		sampled := con.isSampled()
+		if cdsKeepLastPush && sampled {
+			con.recordPush(response)
+		}
+		if (cdsTrackFlapping && sampled) || cdsSmallChangePercent > 0 {
+			changed := con.trackChanges(rawClusters)
+			if cdsSmallChangePercent > 0 && changed*100 <= cdsSmallChangePercent*len(response.Resources) {
+				log.Infof("CDS: PUSH for %s %q changed %d of %d clusters, a delta push would be smaller",
+					node, peerAddr, changed, len(response.Resources))
+			}
+		}
 
-		if cdsDebug {
+		if con.debugging() {
 			// The response can't be easily read due to 'any' marshalling.
 			log.Infof("CDS: PUSH for %s %q, Response: \n%v\n",
 				node, peerAddr, rawClusters)
@@ -177,19 +1057,75 @@ func (s *DiscoveryServer) StreamClusters(stream xdsapi.ClusterDiscoveryService_S
 	}
 }
 
-// cdsPushAll implements old style invalidation, generated when any rule or endpoint changes.
-func cdsPushAll() {
-	cdsConnectionsMux.Lock()
-	// Create a temp map to avoid locking the add/remove
-	tmpMap := map[string]*CdsConnection{}
-	for k, v := range cdsConnections {
-		tmpMap[k] = v
+// pushBootstrapClusters sends the minimal cluster set to a new connection, ahead of the
+// full set.
+func (s *DiscoveryServer) pushBootstrapClusters(ctx context.Context, sender responseSender, con *CdsConnection,
+	node string) error {
+	rawClusters, err := s.BootstrapClusters.BuildClusters(ctx, s.env, *con.modelNode)
+	if err != nil {
+		// The full set follows, the proxy only starts slower.
+		log.Warnf("CDS: failed to generate bootstrap clusters for %s %q: %v", node, con.PeerAddr, err)
+		return nil
+	}
+	response := con.clusters(con.subscribedClusters(filterByNetwork(con.network, rawClusters)))
+	content := con.setVersion(response)
+	con.recordSent(response)
+	if err := sender.Send(response); err != nil {
+		con.recordSendFailure()
+		return err
 	}
-	cdsConnectionsMux.Unlock()
+	con.version = content
+	con.recordDelivered(response)
+	con.logEvent(cdsEventPush, fmt.Sprintf("bootstrap, version %s, %d clusters",
+		response.VersionInfo, len(response.Resources)))
+	if s.CdsCallbacks != nil {
+		s.CdsCallbacks.OnPush(node, len(response.Resources), response.VersionInfo)
+	}
+	if con.debugging() {
+		log.Infof("CDS: bootstrap PUSH for %s %q, %d clusters", node, con.PeerAddr, len(response.Resources))
+	}
+	return nil
+}
+
+// totalAlloc returns the bytes allocated for heap objects since the start.
+func totalAlloc() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.TotalAlloc
+}
 
-	for _, cdsCon := range tmpMap {
-		cdsCon.pushChannel <- true
+// cdsPushAll implements old style invalidation, generated when any rule or endpoint changes.
+// If selector is set, only the connections with workload labels matching the selector are
+// pushed, for config changes scoped to these workloads.
+func cdsPushAll(selector model.Labels) {
+	cdsPushNodes(labelsFilter(selector))
+}
+
+// cdsPushList returns a copy of the connections, to avoid locking the add/remove during the
+// push. Connections are returned by decreasing priority, so gateways and critical workloads
+// are served first when pushes are slow. Within a priority connections are in round-robin
+// order: each call starts one connection later than the previous one, so every connection
+// gets to be first within the number of connections pushes.
+func cdsPushList() []*CdsConnection {
+	cons := cdsConnectionSnapshot()
+	out := make([]*CdsConnection, 0, len(cons))
+	if len(cons) == 0 {
+		return out
+	}
+	// Map iteration order is random, sort for a stable rotation.
+	keys := make([]string, 0, len(cons))
+	for k := range cons {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	start := int((atomic.AddUint64(&cdsPushOffset, 1) - 1) % uint64(len(keys)))
+	for i := range keys {
+		out = append(out, cons[keys[(start+i)%len(keys)]])
 	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].priority > out[j].priority
+	})
+	return out
 }
 
 // Cdsz implements a status and debug interface for CDS.
@@ -197,26 +1133,345 @@ func cdsPushAll() {
 func Cdsz(w http.ResponseWriter, req *http.Request) {
 	_ = req.ParseForm()
 	if req.Form.Get("debug") != "" {
-		cdsDebug = req.Form.Get("debug") == "1"
+		if node := req.Form.Get("node"); node != "" {
+			if req.Form.Get("ttl") != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("ttl is only supported for the global debug"))
+				return
+			}
+			con := getCdsCon(node)
+			if con == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			con.setDebug(req.Form.Get("debug") == "1")
+			return
+		}
+		var ttl time.Duration
+		if v := req.Form.Get("ttl"); v != "" {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("ttl must be a positive number of seconds"))
+				return
+			}
+			ttl = time.Duration(seconds) * time.Second
+		}
+		setCdsDebug(req.Form.Get("debug") == "1", ttl)
 		return
 	}
 	if req.Form.Get("push") != "" {
-		cdsPushAll()
+		if node := req.Form.Get("node"); node != "" {
+			pushCdsNode(w, node, req.Form.Get("wait") == "1")
+			return
+		}
+		filter, err := pushFilter(req.Form)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		if filter == nil && req.Form.Get("batch") == "1" {
+			cdsPushAllWithClusters(req.Context())
+		} else if filter == nil {
+			cdsPushAll(nil)
+		} else if cdsPushNodes(filter) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+	if req.Form.Get("freeze") != "" {
+		con := getCdsCon(req.Form.Get("node"))
+		if con == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		con.setFrozen(req.Form.Get("freeze") == "1")
+		return
+	}
+	if req.Form.Get("sample") != "" {
+		con := getCdsCon(req.Form.Get("node"))
+		if con == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		con.setSampled(req.Form.Get("sample") == "1")
+		return
+	}
+	if req.Form.Get("flapping") != "" {
+		writeFlapping(w, req.Form.Get("node"))
+		return
+	}
+	if req.Form.Get("events") != "" {
+		writeEvents(w, req.Form.Get("node"))
+		return
 	}
-	data, err := json.Marshal(cdsConnections)
+	if req.Form.Get("groups") != "" {
+		writeConfigGroups(w)
+		return
+	}
+	if req.Form.Get("lastpush") != "" {
+		writeLastPush(w, req.Form.Get("node"))
+		return
+	}
+	if req.Form.Get("single") != "" {
+		// Exact match of the connection key.
+		con := getCdsCon(req.Form.Get("node"))
+		if con == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, err := json.Marshal(con)
+		if err != nil {
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		_, _ = w.Write(data)
+		return
+	}
+	writeCdsConnections(w, req.Form)
+}
+
+// writeCdsConnections writes the connections, by connection key. node=SUBSTRING keeps the
+// connections whose key contains the substring, namespace=NS the proxies of the namespace.
+// sort=connect orders them by connection time, sort=lastpush by time of the last push (never
+// pushed first), oldest first; by key otherwise.
+func writeCdsConnections(w http.ResponseWriter, form url.Values) {
+	var less func(a, b *CdsConnection) bool
+	switch form.Get("sort") {
+	case "":
+	case "connect":
+		less = func(a, b *CdsConnection) bool { return a.Connect.Before(b.Connect) }
+	case "lastpush":
+		less = func(a, b *CdsConnection) bool { return a.lastPushAt().Before(b.lastPushAt()) }
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid sort, want connect or lastpush"))
+		return
+	}
+	substring, namespace := form.Get("node"), form.Get("namespace")
+
+	cons := cdsConnectionSnapshot()
+	keys := make([]string, 0, len(cons))
+	for k, con := range cons {
+		if !strings.Contains(k, substring) || (namespace != "" && !namespaceFilter(namespace)(con)) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if less != nil {
+		sort.SliceStable(keys, func(i, j int) bool {
+			return less(cons[keys[i]], cons[keys[j]])
+		})
+	}
+	// Written as an object in the order of the keys, which json.Marshal of a map would sort.
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	var err error
+	for i, k := range keys {
+		var key, con []byte
+		if key, err = json.Marshal(k); err != nil {
+			break
+		}
+		if con, err = json.Marshal(cons[k]); err != nil {
+			break
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(con)
+	}
+	buf.WriteByte('}')
 	if err != nil {
 		_, _ = w.Write([]byte(err.Error()))
 		return
 	}
 
-	_, _ = w.Write(data)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// lastPushAt returns the time of the last response sent, zero if none.
+func (con *CdsConnection) lastPushAt() time.Time {
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	return con.lastPushTime
 }
 
-// FetchClusters implements xdsapi.EndpointDiscoveryServiceServer.FetchEndpoints().
-func (s *DiscoveryServer) FetchClusters(ctx context.Context, req *xdsapi.DiscoveryRequest) (*xdsapi.DiscoveryResponse, error) {
-	return nil, errors.New("not implemented")
+// cdsDebugEnabled returns true if the verbose logging is on for all the connections.
+func cdsDebugEnabled() bool {
+	return atomic.LoadInt32(&cdsDebug) != 0
 }
 
-func (s *DiscoveryServer) removeCdsCon(node string, connection *CdsConnection) {
+// debugFlag returns the value of cdsDebug for enabled.
+func debugFlag(enabled bool) int32 {
+	if enabled {
+		return 1
+	}
+	return 0
+}
+
+// setCdsDebug sets the CDS verbosity. With a ttl, verbose logging is turned off after it, so
+// it isn't left on by accident. A later change cancels the pending revert.
+func setCdsDebug(enabled bool, ttl time.Duration) {
+	cdsDebugMutex.Lock()
+	defer cdsDebugMutex.Unlock()
+	if cdsDebugRevert != nil {
+		cdsDebugRevert.Stop()
+		cdsDebugRevert = nil
+	}
+	atomic.StoreInt32(&cdsDebug, debugFlag(enabled))
+	if enabled && ttl > 0 {
+		var revert *time.Timer
+		revert = time.AfterFunc(ttl, func() {
+			cdsDebugMutex.Lock()
+			defer cdsDebugMutex.Unlock()
+			if cdsDebugRevert != revert {
+				// Replaced by a later change.
+				return
+			}
+			atomic.StoreInt32(&cdsDebug, 0)
+			cdsDebugRevert = nil
+			log.Infof("CDS: debug ttl of %v expired, verbose logging off", ttl)
+		})
+		cdsDebugRevert = revert
+	}
+}
 
+// pushCdsNode triggers a push to the node. If wait is set, it blocks until the push is sent,
+// up to cdsPushWaitTimeout, and reports failures as 500 and timeouts as 504.
+func pushCdsNode(w http.ResponseWriter, node string, wait bool) {
+	con := getCdsCon(node)
+	if con == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var done <-chan error
+	if wait {
+		done = con.waitPush()
+	}
+	// If a push is already pending, it will notify the waiter.
+	con.signalPush()
+	if !wait {
+		return
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	case <-time.After(cdsPushWaitTimeout):
+		w.WriteHeader(http.StatusGatewayTimeout)
+		_, _ = w.Write([]byte("timeout waiting for push"))
+	}
+}
+
+// writeLastPush writes the last response pushed to the node, as json.
+func writeLastPush(w http.ResponseWriter, node string) {
+	con := getCdsCon(node)
+	if con == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	con.mutex.Lock()
+	rec := con.lastPush
+	con.mutex.Unlock()
+	if rec == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("No push recorded, set PILOT_DEBUG_CDS_LASTPUSH=1 and sample=1 to enable"))
+		return
+	}
+
+	summary, _ := json.Marshal(rec)
+	fmt.Fprintf(w, "{\"push\": %s,\n\"response\": ", summary)
+	if rec.Truncated {
+		fmt.Fprint(w, "null}\n")
+		return
+	}
+	response := &xdsapi.DiscoveryResponse{}
+	if err := response.Unmarshal(rec.response); err != nil {
+		fmt.Fprintf(w, "null, \"error\": %q}\n", err.Error())
+		return
+	}
+	jsonm := &jsonpb.Marshaler{Indent: "  "}
+	if err := jsonm.Marshal(w, response); err != nil {
+		return
+	}
+	fmt.Fprint(w, "}\n")
+}
+
+// addCdsCon tracks the connection, for push and debug. Fails with ResourceExhausted if pilot
+// already has cdsMaxConnections connections, or Unavailable if pilot is draining.
+func (s *DiscoveryServer) addCdsCon(node string, connection *CdsConnection) error {
+	connection.key = node
+	err := cdsConnections.add(node, connection.nodeID, connection, func(connections int) error {
+		// Checked under the registry lock, so DrainConnections sees all the connections
+		// added before.
+		if err := rejectDraining(connections); err != nil {
+			return err
+		}
+		if cdsMaxConnections > 0 && connections >= cdsMaxConnections {
+			cdsRejectedConnectionsCounter.Inc()
+			return status.Errorf(codes.ResourceExhausted, "pilot has the maximum of %d CDS connections", cdsMaxConnections)
+		}
+		return nil
+	})
+	if err != nil {
+		connection.key = ""
+		return err
+	}
+
+	if s.ConnectionSink != nil {
+		s.ConnectionSink.ConnectionAdded(s.connectionEvent(node, connection))
+	}
+	if s.CdsCallbacks != nil {
+		s.CdsCallbacks.OnConnect(node, connection.PeerAddr)
+	}
+	return nil
+}
+
+// getCdsCon returns the connection for the node key, or nil.
+func getCdsCon(node string) *CdsConnection {
+	con, _ := cdsConnections.get(node).(*CdsConnection)
+	return con
+}
+
+// cdsConnectionSnapshot returns a copy of the CDS connections by key.
+func cdsConnectionSnapshot() map[string]*CdsConnection {
+	snapshot := cdsConnections.snapshot()
+	out := make(map[string]*CdsConnection, len(snapshot))
+	for k, con := range snapshot {
+		out[k] = con.(*CdsConnection)
+	}
+	return out
+}
+
+// removeCdsCon is called when the gRPC stream is closed. Only the connection itself is removed,
+// by the key it was registered with.
+func (s *DiscoveryServer) removeCdsCon(connection *CdsConnection) {
+	node := connection.key
+	if node == "" || !cdsConnections.remove(node, connection) {
+		return
+	}
+
+	if s.ConnectionSink != nil {
+		s.ConnectionSink.ConnectionRemoved(s.connectionEvent(node, connection))
+	}
+	if s.CdsCallbacks != nil {
+		s.CdsCallbacks.OnDisconnect(node)
+	}
+}
+
+func (s *DiscoveryServer) connectionEvent(node string, connection *CdsConnection) ConnectionEvent {
+	return ConnectionEvent{
+		NodeID:       connection.nodeID,
+		ConnectionID: node,
+		PeerAddr:     connection.PeerAddr,
+		PilotID:      s.PilotID,
+	}
 }
@@ -0,0 +1,120 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+)
+
+// cdsAckState is the ACK bookkeeping of a CDS connection: the last response sent, and the
+// replies of the envoy matched with its nonce. Protected by the connection mutex.
+type cdsAckState struct {
+	// initialRequests counts the requests without a response nonce, and replies the requests
+	// acknowledging (or rejecting) a response. nacks counts the rejections, and stale the
+	// replies to an older response, crossing with a later push.
+	initialRequests int
+	replies         int
+	nacks           int
+	stale           int
+
+	// sentNonce, sentVersion and sentTime are of the last response sent, empty before the
+	// first one. measured is set once a reply to it measured latency.
+	sentNonce   string
+	sentVersion string
+	sentTime    time.Time
+	measured    bool
+
+	// latency is the time between the last acknowledged response and its ACK (or NACK).
+	latency time.Duration
+
+	// ackedNonce and ackedVersion are of the last response ACKed, nackedNonce of the last
+	// response NACKed and lastNack its error detail.
+	ackedNonce   string
+	ackedVersion string
+	nackedNonce  string
+	lastNack     string
+
+	// stuck is set if the envoy keeps sending initial requests and never replies, usually
+	// because it can't accept any config.
+	stuck bool
+}
+
+// replyKind classifies the reply of an envoy to a response.
+type replyKind int
+
+const (
+	// replyAck accepts the last response sent.
+	replyAck replyKind = iota
+	// replyNack rejects the last response sent.
+	replyNack
+	// replyStale replies to an older response.
+	replyStale
+)
+
+// sent records a response sent on the connection.
+func (a *cdsAckState) sent(response *xdsapi.DiscoveryResponse, now time.Time) {
+	a.sentNonce = response.Nonce
+	a.sentVersion = response.VersionInfo
+	a.sentTime = now
+	a.measured = false
+}
+
+// reply records a request with a response nonce, and returns its kind. measured is set if
+// it is the first reply to the last response sent, setting latency.
+func (a *cdsAckState) reply(req *xdsapi.DiscoveryRequest, now time.Time) (kind replyKind, measured bool) {
+	a.replies++
+	a.stuck = false
+	switch {
+	case req.ResponseNonce != a.sentNonce:
+		a.stale++
+		return replyStale, false
+	case req.ErrorDetail != nil:
+		a.nacks++
+		a.nackedNonce = req.ResponseNonce
+		a.lastNack = req.ErrorDetail.Message
+		kind = replyNack
+	default:
+		a.ackedNonce = req.ResponseNonce
+		a.ackedVersion = req.VersionInfo
+		kind = replyAck
+	}
+	if !a.measured {
+		a.latency = now.Sub(a.sentTime)
+		a.measured = true
+		measured = true
+	}
+	return kind, measured
+}
+
+// acks returns the number of replies accepting the response they reply to.
+func (a *cdsAckState) acks() int {
+	return a.replies - a.nacks - a.stale
+}
+
+// status returns the sync state of the last response sent, for /debug/syncz.
+func (a *cdsAckState) status() string {
+	switch {
+	case a.sentNonce == "":
+		return syncNotSent
+	case a.ackedNonce == a.sentNonce:
+		return syncSynced
+	case a.nackedNonce == a.sentNonce:
+		return syncNacked
+	default:
+		return syncStale
+	}
+}
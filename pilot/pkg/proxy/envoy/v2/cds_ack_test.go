@@ -0,0 +1,60 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/gogo/googleapis/google/rpc"
+)
+
+func TestCdsAckState(t *testing.T) {
+	var a cdsAckState
+	if st := a.status(); st != syncNotSent {
+		t.Errorf("got status %s before a response, want %s", st, syncNotSent)
+	}
+
+	start := time.Now()
+	a.sent(&xdsapi.DiscoveryResponse{Nonce: "n1", VersionInfo: "v1"}, start)
+	a.sent(&xdsapi.DiscoveryResponse{Nonce: "n2", VersionInfo: "v2"}, start)
+	replies := []struct {
+		req      *xdsapi.DiscoveryRequest
+		kind     replyKind
+		measured bool
+		status   string
+	}{
+		{&xdsapi.DiscoveryRequest{ResponseNonce: "n1", VersionInfo: "v1"}, replyStale, false, syncStale},
+		{&xdsapi.DiscoveryRequest{ResponseNonce: "n2", ErrorDetail: &rpc.Status{Message: "bad"}}, replyNack, true, syncNacked},
+		// Only the first reply to the response measures the latency.
+		{&xdsapi.DiscoveryRequest{ResponseNonce: "n2", VersionInfo: "v2"}, replyAck, false, syncSynced},
+	}
+	for i, r := range replies {
+		kind, measured := a.reply(r.req, start.Add(time.Second))
+		if kind != r.kind || measured != r.measured {
+			t.Errorf("reply %d: got kind %d, measured %v, want %d, %v", i, kind, measured, r.kind, r.measured)
+		}
+		if st := a.status(); st != r.status {
+			t.Errorf("reply %d: got status %s, want %s", i, st, r.status)
+		}
+	}
+	if a.acks() != 1 || a.nacks != 1 || a.stale != 1 {
+		t.Errorf("got %d acks, %d nacks and %d stale replies, want 1 of each", a.acks(), a.nacks, a.stale)
+	}
+	if a.latency != time.Second || a.lastNack != "bad" || a.ackedVersion != "v2" {
+		t.Errorf("got latency %v, last NACK %q and acked version %q", a.latency, a.lastNack, a.ackedVersion)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+)
+
+// ClusterAlias keeps a renamed cluster available under its old name during a migration, for
+// example a change of the naming scheme, so proxies still referencing the old name don't
+// break. The cluster is pushed under both names until the end of the window.
+type ClusterAlias struct {
+	// OldName is the name the cluster had before the migration.
+	OldName string
+
+	// NewName is the name currently generated for the cluster.
+	NewName string
+
+	// Until is the end of the migration window. The alias is no longer pushed after it.
+	Until time.Time
+}
+
+// addClusterAliases appends a copy of each aliased cluster under its old name, unless a
+// cluster with the old name is still generated. It is applied to the generated clusters
+// after the cluster cache, so the aliases are removed at the end of their window even if the
+// clusters are still cached: a push of the connections is scheduled then.
+func (s *DiscoveryServer) addClusterAliases(clusters []*xdsapi.Cluster, now time.Time) []*xdsapi.Cluster {
+	if len(s.ClusterAliases) == 0 {
+		return clusters
+	}
+	var next time.Time
+	byName := make(map[string]*xdsapi.Cluster, len(clusters))
+	for _, c := range clusters {
+		if c != nil {
+			byName[c.Name] = c
+		}
+	}
+	for _, a := range s.ClusterAliases {
+		if !now.Before(a.Until) {
+			continue
+		}
+		if next.IsZero() || a.Until.Before(next) {
+			next = a.Until
+		}
+		c := byName[a.NewName]
+		if c == nil || byName[a.OldName] != nil {
+			continue
+		}
+		alias := *c
+		alias.Name = a.OldName
+		if c.EdsClusterConfig != nil && c.EdsClusterConfig.ServiceName == "" {
+			// EDS uses the cluster name by default, the alias must get the endpoints of
+			// the renamed cluster.
+			eds := *c.EdsClusterConfig
+			eds.ServiceName = c.Name
+			alias.EdsClusterConfig = &eds
+		}
+		byName[a.OldName] = &alias
+		clusters = append(clusters, &alias)
+	}
+	if !next.IsZero() {
+		s.scheduleAliasPush(next)
+	}
+	return clusters
+}
+
+// scheduleAliasPush schedules a push of the connections of the server at until, the end of a
+// migration window, unless one is already scheduled by then. The push removes the expired
+// aliases, and schedules the end of the next window. The config didn't change, the cached
+// clusters are kept.
+func (s *DiscoveryServer) scheduleAliasPush(until time.Time) {
+	s.aliasMutex.Lock()
+	defer s.aliasMutex.Unlock()
+	if !s.aliasPush.IsZero() && !until.Before(s.aliasPush) {
+		return
+	}
+	s.aliasPush = until
+	time.AfterFunc(time.Until(until), func() {
+		s.aliasMutex.Lock()
+		if s.aliasPush.Equal(until) {
+			s.aliasPush = time.Time{}
+		}
+		s.aliasMutex.Unlock()
+		for _, con := range cdsPushList() {
+			if con.server == s {
+				con.signalPush()
+			}
+		}
+	})
+}
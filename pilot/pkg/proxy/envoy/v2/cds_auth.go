@@ -0,0 +1,46 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// NodeAuthenticator verifies that the caller is the node it claims to be, for example by
+// matching the identity of its client certificate with the service account of the node.
+type NodeAuthenticator interface {
+	// Authenticate returns an error if the peer is not allowed to get the config of the
+	// node. The peer is nil if the stream has no peer information.
+	Authenticate(p *peer.Peer, nodeID string) error
+}
+
+// authenticateNode checks the node ID claimed in a request with the NodeAuthenticator,
+// returning a PermissionDenied status on mismatch. All nodes are accepted without
+// NodeAuthenticator.
+func (s *DiscoveryServer) authenticateNode(ctx context.Context, nodeID string) error {
+	if s.NodeAuthenticator == nil {
+		return nil
+	}
+	p, _ := peer.FromContext(ctx)
+	if err := s.NodeAuthenticator.Authenticate(p, nodeID); err != nil {
+		cdsAuthFailuresCounter.Inc()
+		return status.Errorf(codes.PermissionDenied, "node %q: %v", nodeID, err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// ipAuthenticator accepts the nodes connecting from their own IP.
+type ipAuthenticator struct{}
+
+func (ipAuthenticator) Authenticate(p *peer.Peer, nodeID string) error {
+	node, err := model.ParseServiceNode(nodeID)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return fmt.Errorf("no peer")
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return err
+	}
+	if host != node.IPAddress {
+		return fmt.Errorf("peer %s is not %s", host, node.IPAddress)
+	}
+	return nil
+}
+
+func TestCdsNodeAuthenticator(t *testing.T) {
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	s.NodeAuthenticator = ipAuthenticator{}
+	spoofed := "sidecar~10.1.1.9~other-1.testns~testns.svc.cluster.local"
+	failures := counterValue(t, cdsAuthFailuresCounter)
+
+	// testNodeID is at 10.1.1.1.
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	if resp := stream.recvResponse(t); len(resp.Resources) != 1 {
+		t.Errorf("got %d clusters for an authenticated node, want 1", len(resp.Resources))
+	}
+	// Switching to another node on the stream is checked too.
+	stream.sendRequest(clusterRequest(spoofed))
+	if err := waitStreamDone(t, done); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("stream switching to a spoofed node returned %v, want PermissionDenied", err)
+	}
+
+	stream = newFakeStream("10.1.1.1:5000")
+	done = startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(spoofed))
+	if err := waitStreamDone(t, done); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("stream for a spoofed node returned %v, want PermissionDenied", err)
+	}
+	if n := stream.sendCount(); n != 0 {
+		t.Errorf("got %d responses for a spoofed node, want 0", n)
+	}
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.1.1.1")}})
+	if _, err := s.FetchClusters(ctx, clusterRequest(spoofed)); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("fetch for a spoofed node returned %v, want PermissionDenied", err)
+	}
+	if n := counterValue(t, cdsAuthFailuresCounter); n != failures+3 {
+		t.Errorf("auth failures counter moved by %v, want 3", n-failures)
+	}
+}
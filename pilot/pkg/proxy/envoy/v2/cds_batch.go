@@ -0,0 +1,121 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"istio.io/istio/pkg/log"
+)
+
+var (
+	// cdsBatchTimeout bounds the generations of a batch push, set with PILOT_CDS_BATCH_TIMEOUT.
+	// The connections not generated for by then are signaled anyway, and generate their own
+	// clusters.
+	cdsBatchTimeout = envDuration("PILOT_CDS_BATCH_TIMEOUT", 10*time.Second)
+
+	// cdsBatchConcurrency is the number of cluster sets generated in parallel by a batch push,
+	// set with PILOT_CDS_BATCH_CONCURRENCY.
+	cdsBatchConcurrency = envInt("PILOT_CDS_BATCH_CONCURRENCY", 4)
+)
+
+// cdsPushAllWithClusters pushes to all the connections like cdsPushAll, building the response
+// of one connection for each cluster cache key before signaling the connections. It is the
+// CDS push of PushAll. Connections with the same key - identical sidecars, or gateways of the
+// same domain - then share the generated clusters, and the marshaled resources and version of
+// the response if they push the same clusters; only the nonce is per connection. Falls back to
+// cdsPushAll when the cluster cache is disabled. The generations are abandoned once ctx is
+// done, or after cdsBatchTimeout, so a stuck generator doesn't hold the push. Returns the
+// number of connections pushed.
+func cdsPushAllWithClusters(ctx context.Context) int {
+	if !cdsClusterCacheEnabled {
+		return cdsPushNodes(labelsFilter(nil))
+	}
+	cdsFetchCache.clear()
+	cdsClusterCache.clear()
+
+	ctx, cancel := context.WithTimeout(ctx, cdsBatchTimeout)
+	defer cancel()
+	cons := cdsPushList()
+	// The first connection of each key, by priority.
+	var first []*CdsConnection
+	keys := map[clusterCacheKey]bool{}
+	for _, con := range cons {
+		key, ok := con.cacheKey()
+		if !ok || keys[key] {
+			continue
+		}
+		keys[key] = true
+		first = append(first, con)
+	}
+
+	workers := cdsBatchConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	work := make(chan *CdsConnection)
+	var wg sync.WaitGroup
+	var generated int32
+	for i := 0; i < workers && i < len(first); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for con := range work {
+				if ctx.Err() == nil && con.buildSharedResponse(ctx) {
+					atomic.AddInt32(&generated, 1)
+				}
+			}
+		}()
+	}
+	for _, con := range first {
+		work <- con
+	}
+	close(work)
+	wg.Wait()
+	if ctx.Err() != nil {
+		log.Warnf("CDS: batch push generated %d of the %d cluster sets: %v",
+			atomic.LoadInt32(&generated), len(first), ctx.Err())
+	}
+
+	queued := 0
+	for _, con := range cons {
+		if !con.signalPush() {
+			queued++
+		}
+	}
+	if queued > 0 && cdsDebugEnabled() {
+		log.Infof("CDS: %d connections already had a push queued", queued)
+	}
+	return len(cons)
+}
+
+// buildSharedResponse generates the clusters of the connection and builds the response of its
+// proxy, cached for the connections of the same key. The connection builds its own response
+// on its push if it subscribed to some clusters. A failed generation is retried and reported
+// by the connection on its push. Returns false if the generation failed.
+func (con *CdsConnection) buildSharedResponse(ctx context.Context) bool {
+	con.mutex.Lock()
+	node, profile, network := con.modelNode, con.profile, con.network
+	con.mutex.Unlock()
+	clusters, err := con.server.generateClusters(ctx, *node, profile)
+	if err != nil {
+		return false
+	}
+	con.clusters(con.server.proxyClusters(clusters, node, network, profile))
+	return true
+}
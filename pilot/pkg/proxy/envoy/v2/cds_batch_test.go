@@ -0,0 +1,244 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// addTestGateways registers n gateways of the same domain on the server, sharing their
+// cluster cache key.
+func addTestGateways(s *DiscoveryServer, n int) ([]*CdsConnection, func()) {
+	cons := make([]*CdsConnection, 0, n)
+	for i := 0; i < n; i++ {
+		con := &CdsConnection{server: s, pushChannel: make(chan bool, 1), modelNode: &model.Proxy{
+			Type:      model.Router,
+			IPAddress: fmt.Sprintf("10.1.%d.%d", i/256, i%256),
+			ID:        fmt.Sprintf("gw-%d.istio-system", i),
+			Domain:    "istio-system.svc.cluster.local",
+		}}
+		key := fmt.Sprintf("%s-gw%d", testNodeID, i)
+		_ = s.addCdsCon(key, con)
+		cons = append(cons, con)
+	}
+	return cons, func() {
+		for _, con := range cons {
+			s.removeCdsCon(con)
+		}
+	}
+}
+
+func TestCdsPushAllWithClusters(t *testing.T) {
+	withClusterCache(true, func() {
+		g := newFakeGenerator("outbound|80||a.default.svc.cluster.local", "outbound|80||b.default.svc.cluster.local")
+		s := newTestServer(g)
+		cons, cleanup := addTestGateways(s, 3)
+		defer cleanup()
+
+		if n := cdsPushAllWithClusters(context.Background()); n != len(cons) {
+			t.Fatalf("pushed %d connections, want %d", n, len(cons))
+		}
+		if n := g.callCount(); n != 1 {
+			t.Errorf("got %d generations for %d identical gateways, want 1", n, len(cons))
+		}
+		for i, con := range cons {
+			select {
+			case <-con.pushChannel:
+			default:
+				t.Errorf("connection %d not signaled", i)
+			}
+		}
+
+		// The connections reuse the response built by the batch.
+		shared := counterValue(t, cdsSharedResponsesCounter)
+		first, second := pushedResponse(t, s, cons[0]), pushedResponse(t, s, cons[1])
+		if n := g.callCount(); n != 1 {
+			t.Errorf("got %d generations after the connection pushes, want 1", n)
+		}
+		if len(first.Resources) != 2 || len(second.Resources) != 2 {
+			t.Fatalf("got %d and %d clusters, want 2", len(first.Resources), len(second.Resources))
+		}
+		if &first.Resources[0] != &second.Resources[0] {
+			t.Error("response resources built for each connection, want shared")
+		}
+		if n := counterValue(t, cdsSharedResponsesCounter) - shared; n != 2 {
+			t.Errorf("got %v shared responses, want 2", n)
+		}
+		if first.VersionInfo != second.VersionInfo || first.Nonce == second.Nonce {
+			t.Errorf("got versions %s, %s and nonces %s, %s: want the same version and distinct nonces",
+				first.VersionInfo, second.VersionInfo, first.Nonce, second.Nonce)
+		}
+	})
+}
+
+func TestCdsSharedResponseOtherClusters(t *testing.T) {
+	withClusterCache(true, func() {
+		g := newFakeGenerator("outbound|80||a.default.svc.cluster.local", "outbound|80||b.default.svc.cluster.local")
+		s := newTestServer(g)
+		cons, cleanup := addTestGateways(s, 2)
+		defer cleanup()
+		cdsPushAllWithClusters(context.Background())
+
+		// A connection subscribed to some of the clusters builds its own response.
+		cons[1].setSubscription([]string{"outbound|80||a.default.svc.cluster.local"})
+		shared := counterValue(t, cdsSharedResponsesCounter)
+		clusters, err := s.generateClusters(context.Background(), *cons[1].modelNode, cons[1].profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := cons[1].clusters(cons[1].subscribedClusters(s.orderClusters(clusters, cons[1].profile)))
+		if len(response.Resources) != 1 {
+			t.Errorf("got %d clusters, want the subscribed one", len(response.Resources))
+		}
+		if n := counterValue(t, cdsSharedResponsesCounter) - shared; n != 0 {
+			t.Errorf("got %v shared responses for other clusters, want 0", n)
+		}
+		if full := pushedResponse(t, s, cons[0]); full.VersionInfo == response.VersionInfo {
+			t.Errorf("got the version %s of the full response, want another", response.VersionInfo)
+		}
+	})
+}
+
+func TestCdsPushAllSharesResponses(t *testing.T) {
+	defer resendUnchanged()()
+	withClusterCache(true, func() {
+		g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+		s := newTestServer(g)
+		// Two sidecars of the same pod IP and domain share their cluster cache key.
+		first := newFakeStream("10.1.1.1:5000")
+		firstDone := startClusterStream(s, first)
+		first.sendRequest(clusterRequest("sidecar~10.1.1.1~app-1.testns~testns.svc.cluster.local"))
+		first.recvResponse(t)
+		second := newFakeStream("10.1.1.1:5001")
+		secondDone := startClusterStream(s, second)
+		second.sendRequest(clusterRequest("sidecar~10.1.1.1~app-2.testns~testns.svc.cluster.local"))
+		second.recvResponse(t)
+
+		calls, shared := g.callCount(), counterValue(t, cdsSharedResponsesCounter)
+		PushAll()
+		firstResponse, secondResponse := first.recvResponse(t), second.recvResponse(t)
+		if n := g.callCount() - calls; n != 1 {
+			t.Errorf("got %d generations for the push, want 1", n)
+		}
+		if &firstResponse.Resources[0] != &secondResponse.Resources[0] {
+			t.Error("response resources built for each connection, want shared")
+		}
+		if n := counterValue(t, cdsSharedResponsesCounter) - shared; n != 2 {
+			t.Errorf("got %v shared responses, want 2", n)
+		}
+
+		first.close()
+		second.close()
+		waitStreamDone(t, firstDone)
+		waitStreamDone(t, secondDone)
+	})
+}
+
+func TestCdsPushAllWithClustersUncached(t *testing.T) {
+	withClusterCache(false, func() {
+		g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+		s := newTestServer(g)
+		cons, cleanup := addTestGateways(s, 2)
+		defer cleanup()
+
+		// Without a cache the clusters can't be shared: the connections are only signaled.
+		if n := cdsPushAllWithClusters(context.Background()); n != len(cons) {
+			t.Fatalf("pushed %d connections, want %d", n, len(cons))
+		}
+		if n := g.callCount(); n != 0 {
+			t.Errorf("got %d generations with the cache disabled, want 0", n)
+		}
+	})
+}
+
+func TestCdsPushAllWithClustersTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { cdsBatchTimeout = timeout }(cdsBatchTimeout)
+	cdsBatchTimeout = 50 * time.Millisecond
+	withClusterCache(true, func() {
+		g := &blockingGenerator{started: make(chan struct{}), result: make(chan error, 1)}
+		s := &DiscoveryServer{ConfigGenerator: g}
+		cons, cleanup := addTestGateways(s, 2)
+		defer cleanup()
+
+		// The stuck generation is abandoned, and the connections are still signaled.
+		pushed := make(chan int, 1)
+		go func() { pushed <- cdsPushAllWithClusters(context.Background()) }()
+		select {
+		case n := <-pushed:
+			if n != len(cons) {
+				t.Errorf("pushed %d connections, want %d", n, len(cons))
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("batch push blocked by a stuck generator")
+		}
+		if err := <-g.result; err != context.DeadlineExceeded {
+			t.Errorf("generation ended with %v, want DeadlineExceeded", err)
+		}
+		for i, con := range cons {
+			select {
+			case <-con.pushChannel:
+			default:
+				t.Errorf("connection %d not signaled", i)
+			}
+		}
+	})
+}
+
+// pushedResponse returns the response of the connection push, as sent by streamClusters.
+func pushedResponse(t testing.TB, s *DiscoveryServer, con *CdsConnection) *xdsapi.DiscoveryResponse {
+	clusters, err := s.generateClusters(context.Background(), *con.modelNode, con.profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return con.clusters(s.orderClusters(clusters, con.profile))
+}
+
+// benchmarkCdsPushAll measures a push of 1000 clusters to the given number of identical
+// gateways, signaling each connection to generate its clusters or with the clusters
+// generated once for all.
+func benchmarkCdsPushAll(b *testing.B, connections int, batch bool) {
+	names := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		names = append(names, fmt.Sprintf("outbound|80||svc%d.default.svc.cluster.local", i))
+	}
+	s := newTestServer(newFakeGenerator(names...))
+	// Without the batch, each connection generates and marshals its clusters.
+	withClusterCache(batch, func() {
+		cons, cleanup := addTestGateways(s, connections)
+		defer cleanup()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if batch {
+				cdsPushAllWithClusters(context.Background())
+			} else {
+				cdsPushAll(nil)
+			}
+			for _, con := range cons {
+				<-con.pushChannel
+				_ = pushedResponse(b, s, con)
+			}
+		}
+	})
+}
+
+func BenchmarkCdsPushAllPerConnection100(b *testing.B) { benchmarkCdsPushAll(b, 100, false) }
+func BenchmarkCdsPushAllWithClusters100(b *testing.B)  { benchmarkCdsPushAll(b, 100, true) }
@@ -0,0 +1,165 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gogo/protobuf/jsonpb"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// cdsBundle is the support bundle of a connection, returned by /debug/cdsz/bundle.
+type cdsBundle struct {
+	Node string
+
+	// Connection is the record listed by /debug/cdsz
+	Connection json.RawMessage
+
+	// LastPush is the summary of the last push, if PILOT_DEBUG_CDS_LASTPUSH is set
+	LastPush *cdsPushRecord `json:",omitempty"`
+
+	// Flapping clusters, if PILOT_DEBUG_CDS_FLAPPING is set
+	Flapping []string `json:",omitempty"`
+
+	// Clusters currently generated for the node
+	Clusters []json.RawMessage
+
+	// Errors collecting the sections
+	Errors []string `json:",omitempty"`
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// cdsBundleHandler implements /debug/cdsz/bundle?node=NODE. It returns a single json file
+// with all the diagnostics of the connection, to attach to bug reports.
+func (s *DiscoveryServer) cdsBundleHandler(w http.ResponseWriter, req *http.Request) {
+	_ = req.ParseForm()
+	node := req.Form.Get("node")
+	con := getCdsCon(node)
+	if con == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	bundle := s.cdsBundle(node, con)
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"cds-%s.json\"", unsafeFileChars.ReplaceAllString(node, "_")))
+	_, _ = w.Write(data)
+}
+
+func (s *DiscoveryServer) cdsBundle(node string, con *CdsConnection) *cdsBundle {
+	bundle := &cdsBundle{Node: node, Clusters: []json.RawMessage{}}
+
+	record, err := json.Marshal(con)
+	if err != nil {
+		bundle.Errors = append(bundle.Errors, "connection: "+err.Error())
+	}
+	bundle.Connection = record
+
+	con.mutex.Lock()
+	bundle.LastPush = con.lastPush
+	network := con.network
+	profile := con.profile
+	con.mutex.Unlock()
+	if flapping := con.flappingClusters(); len(flapping) > 0 {
+		bundle.Flapping = flapping
+	}
+
+	proxy := con.node()
+	if proxy == nil {
+		bundle.Errors = append(bundle.Errors, "clusters: no initial request")
+		return bundle
+	}
+	clusters, errs := s.connectionClusters(*proxy, network, profile)
+	bundle.Clusters = clusters
+	for _, err := range errs {
+		bundle.Errors = append(bundle.Errors, "clusters: "+err.Error())
+	}
+	return bundle
+}
+
+// connectionClusters generates the clusters of a connection, in the order they are pushed,
+// as json. Clusters failing to marshal are skipped and their errors returned.
+func (s *DiscoveryServer) connectionClusters(proxy model.Proxy, network string,
+	profile *GenerationProfile) ([]json.RawMessage, []error) {
+	var errs []error
+	rawClusters, err := s.buildClusters(context.Background(), proxy, profile)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	out := []json.RawMessage{}
+	jsonm := &jsonpb.Marshaler{}
+	rawClusters = s.postProcessClusters(rawClusters, &proxy)
+	for _, c := range s.orderClusters(filterByNetwork(network, rawClusters), profile) {
+		buf := &bytes.Buffer{}
+		if err := jsonm.Marshal(buf, c); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		out = append(out, buf.Bytes())
+	}
+	return out, errs
+}
+
+// cdsz implements /debug/cdsz. "clusters=1&node=NODE" returns the clusters currently
+// generated for the connection, other requests are handled by Cdsz.
+func (s *DiscoveryServer) cdsz(w http.ResponseWriter, req *http.Request) {
+	_ = req.ParseForm()
+	if req.Form.Get("clusters") == "" {
+		Cdsz(w, req)
+		return
+	}
+	con := getCdsCon(req.Form.Get("node"))
+	if con == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	proxy := con.node()
+	if proxy == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	con.mutex.Lock()
+	network, profile := con.network, con.profile
+	con.mutex.Unlock()
+	clusters, errs := s.connectionClusters(*proxy, network, profile)
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(errs[0].Error()))
+		return
+	}
+	data, err := json.MarshalIndent(clusters, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,250 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/gogo/protobuf/types"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+var (
+	// cdsClusterCacheEnabled shares the generated clusters between the connections with the
+	// same cache key, until the next config change. Disabled with PILOT_CDS_CACHE=0.
+	cdsClusterCacheEnabled = os.Getenv("PILOT_CDS_CACHE") != "0"
+
+	cdsClusterCache = &clusterCache{
+		entries:   map[clusterCacheKey][]*xdsapi.Cluster{},
+		resources: map[*xdsapi.Cluster]*types.Any{},
+		responses: map[clusterCacheKey]*cachedResponse{},
+	}
+
+	// cdsCacheEpoch is incremented on each config change. Clusters generated in an older
+	// epoch are not cached, since the generation may have read the old config.
+	cdsCacheEpoch uint64
+)
+
+type clusterCacheKey struct {
+	server  *DiscoveryServer
+	proxy   string
+	profile *GenerationProfile
+}
+
+// clusterCache holds the clusters generated since the last config change.
+type clusterCache struct {
+	mutex   sync.Mutex
+	epoch   uint64
+	entries map[clusterCacheKey][]*xdsapi.Cluster
+
+	// resources are the cached clusters marshaled for the responses, nil until the first
+	// response with the cluster. Connections sharing the clusters share their marshaling.
+	resources map[*xdsapi.Cluster]*types.Any
+
+	// responses are the last response resources built for each key, shared with the
+	// connections of the key pushing the same clusters.
+	responses map[clusterCacheKey]*cachedResponse
+}
+
+// cachedResponse is the marshaled resources and content version of a response, for the
+// clusters it was built from.
+type cachedResponse struct {
+	clusters  []*xdsapi.Cluster
+	resources []types.Any
+	version   string
+}
+
+// get returns a copy of the cached clusters, which the caller may reorder or filter.
+func (c *clusterCache) get(key clusterCacheKey, epoch uint64) ([]*xdsapi.Cluster, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.epoch != epoch {
+		return nil, false
+	}
+	clusters, f := c.entries[key]
+	if !f {
+		return nil, false
+	}
+	return append([]*xdsapi.Cluster(nil), clusters...), true
+}
+
+// add caches a copy of the clusters generated in epoch, unless the config changed since.
+func (c *clusterCache) add(key clusterCacheKey, epoch uint64, clusters []*xdsapi.Cluster) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if epoch != atomic.LoadUint64(&cdsCacheEpoch) {
+		return
+	}
+	if c.epoch != epoch {
+		c.epoch = epoch
+		c.entries = map[clusterCacheKey][]*xdsapi.Cluster{}
+		c.resources = map[*xdsapi.Cluster]*types.Any{}
+		c.responses = map[clusterCacheKey]*cachedResponse{}
+	}
+	c.entries[key] = append([]*xdsapi.Cluster(nil), clusters...)
+	for _, cluster := range clusters {
+		if _, f := c.resources[cluster]; !f && cluster != nil {
+			c.resources[cluster] = nil
+		}
+	}
+}
+
+// marshal returns the clusters marshaled for a response, reusing the marshaling of the
+// cached clusters. Nil clusters and clusters failing to marshal are skipped.
+func (c *clusterCache) marshal(clusters []*xdsapi.Cluster) []types.Any {
+	out := make([]types.Any, len(clusters))
+	missing := make([]int, 0, len(clusters))
+	c.mutex.Lock()
+	for i, cluster := range clusters {
+		if a := c.resources[cluster]; a != nil {
+			out[i] = *a
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	c.mutex.Unlock()
+	if len(missing) == 0 {
+		return out
+	}
+
+	marshaled := make([]*types.Any, len(missing))
+	for j, i := range missing {
+		if clusters[i] != nil {
+			marshaled[j] = marshalCluster(clusters[i])
+		}
+	}
+	c.mutex.Lock()
+	for j, i := range missing {
+		if marshaled[j] == nil {
+			continue
+		}
+		out[i] = *marshaled[j]
+		// Only the clusters of the current cache entries, bounding the memory.
+		if _, f := c.resources[clusters[i]]; f {
+			c.resources[clusters[i]] = marshaled[j]
+		}
+	}
+	c.mutex.Unlock()
+
+	valid := out[:0]
+	for _, a := range out {
+		if a.TypeUrl != "" {
+			valid = append(valid, a)
+		}
+	}
+	return valid
+}
+
+// clear drops all cached clusters, called when the config changes.
+func (c *clusterCache) clear() {
+	c.mutex.Lock()
+	atomic.AddUint64(&cdsCacheEpoch, 1)
+	c.entries = map[clusterCacheKey][]*xdsapi.Cluster{}
+	c.resources = map[*xdsapi.Cluster]*types.Any{}
+	c.responses = map[clusterCacheKey]*cachedResponse{}
+	c.mutex.Unlock()
+}
+
+// response returns the resources and version of the response cached for the key, if it was
+// built from the same clusters in the same order. The resources are shared, not copied.
+func (c *clusterCache) response(key clusterCacheKey, epoch uint64,
+	clusters []*xdsapi.Cluster) ([]types.Any, string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	r := c.responses[key]
+	if c.epoch != epoch || r == nil || len(r.clusters) != len(clusters) {
+		return nil, "", false
+	}
+	for i := range clusters {
+		if clusters[i] != r.clusters[i] {
+			return nil, "", false
+		}
+	}
+	return r.resources, r.version, true
+}
+
+// addResponse caches the resources and version of a response built from the clusters in
+// epoch, replacing the response of the key. Only for the keys with cached clusters, bounding
+// the memory.
+func (c *clusterCache) addResponse(key clusterCacheKey, epoch uint64, clusters []*xdsapi.Cluster,
+	resources []types.Any, version string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, f := c.entries[key]; !f || c.epoch != epoch {
+		return
+	}
+	c.responses[key] = &cachedResponse{
+		clusters: append([]*xdsapi.Cluster(nil), clusters...),
+		// Capped, so a caller appending to the resources doesn't write to the shared array.
+		resources: resources[:len(resources):len(resources)],
+		version:   version,
+	}
+}
+
+// defaultClusterCacheKey keys the clusters by the proxy attributes the v1alpha3 generator
+// depends on: sidecar clusters include the inbound clusters of the instances at the proxy IP,
+// gateway clusters only depend on the type and domain.
+func defaultClusterCacheKey(node model.Proxy) string {
+	if node.Type == model.Sidecar {
+		return string(node.Type) + "~" + node.IPAddress + "~" + node.Domain
+	}
+	return string(node.Type) + "~~" + node.Domain
+}
+
+// clusterCacheKey returns the key of the clusters generated for the node with the profile.
+func (s *DiscoveryServer) clusterCacheKey(node model.Proxy, profile *GenerationProfile) clusterCacheKey {
+	keyFunc := s.ClusterCacheKey
+	if keyFunc == nil {
+		keyFunc = defaultClusterCacheKey
+	}
+	return clusterCacheKey{server: s, proxy: keyFunc(node), profile: profile}
+}
+
+// cacheKey returns the cluster cache key of the connection, false if the connection has no
+// server or node yet.
+func (con *CdsConnection) cacheKey() (clusterCacheKey, bool) {
+	con.mutex.Lock()
+	node, profile := con.modelNode, con.profile
+	con.mutex.Unlock()
+	if con.server == nil || node == nil {
+		return clusterCacheKey{}, false
+	}
+	return con.server.clusterCacheKey(*node, profile), true
+}
+
+// generateClusters returns the clusters for the node, from the cache if another connection
+// with the same key already generated them since the last config change.
+func (s *DiscoveryServer) generateClusters(ctx context.Context, node model.Proxy,
+	profile *GenerationProfile) ([]*xdsapi.Cluster, error) {
+	if !cdsClusterCacheEnabled {
+		return s.buildClustersWithRetries(ctx, node, profile)
+	}
+	key := s.clusterCacheKey(node, profile)
+	epoch := atomic.LoadUint64(&cdsCacheEpoch)
+	if clusters, f := cdsClusterCache.get(key, epoch); f {
+		cdsClusterCacheHits.Inc()
+		return clusters, nil
+	}
+	clusters, err := s.buildClustersWithRetries(ctx, node, profile)
+	if err == nil {
+		cdsClusterCache.add(key, epoch, clusters)
+	}
+	return clusters, err
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// withClusterCache runs f with the cluster cache enabled or disabled, and an empty cache.
+func withClusterCache(enabled bool, f func()) {
+	defer func(old bool) { cdsClusterCacheEnabled = old }(cdsClusterCacheEnabled)
+	cdsClusterCacheEnabled = enabled
+	cdsClusterCache.clear()
+	f()
+}
+
+func TestCdsClusterCache(t *testing.T) {
+	withClusterCache(true, func() {
+		g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+		s := newTestServer(g)
+		ctx := context.Background()
+		gw1 := model.Proxy{Type: model.Router, IPAddress: "10.1.1.2", ID: "gw-1.istio-system", Domain: "istio-system.svc.cluster.local"}
+		gw2 := model.Proxy{Type: model.Router, IPAddress: "10.1.1.3", ID: "gw-2.istio-system", Domain: "istio-system.svc.cluster.local"}
+
+		first, err := s.generateClusters(ctx, gw1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := s.generateClusters(ctx, gw2, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := g.callCount(); n != 1 {
+			t.Fatalf("got %d generations for two gateways, want 1", n)
+		}
+		if !reflect.DeepEqual(first, second) {
+			t.Fatalf("cached clusters %v, want %v", second, first)
+		}
+		// Each connection gets its own slice, to reorder or filter.
+		second[0] = nil
+		if third, _ := s.generateClusters(ctx, gw1, nil); third[0] == nil {
+			t.Fatal("cached clusters modified by a connection")
+		}
+
+		// A config change invalidates the cache.
+		g.setClusters("outbound|80||b.default.svc.cluster.local")
+		cdsPushAll(nil)
+		clusters, _ := s.generateClusters(ctx, gw2, nil)
+		if len(clusters) != 1 || clusters[0].Name != "outbound|80||b.default.svc.cluster.local" {
+			t.Fatalf("got %v after a config change, want b", clusters)
+		}
+		if n := g.callCount(); n != 2 {
+			t.Fatalf("got %d generations, want 2", n)
+		}
+	})
+}
+
+func TestCdsClusterCacheKey(t *testing.T) {
+	withClusterCache(true, func() {
+		g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+		s := newTestServer(g)
+		ctx := context.Background()
+		sidecar1 := model.Proxy{Type: model.Sidecar, IPAddress: "10.1.1.1", ID: "app-1.testns", Domain: "testns.svc.cluster.local"}
+		sidecar2 := model.Proxy{Type: model.Sidecar, IPAddress: "10.1.1.2", ID: "app-2.testns", Domain: "testns.svc.cluster.local"}
+
+		// Sidecars have their own inbound clusters.
+		_, _ = s.generateClusters(ctx, sidecar1, nil)
+		_, _ = s.generateClusters(ctx, sidecar2, nil)
+		if n := g.callCount(); n != 2 {
+			t.Fatalf("got %d generations for two sidecars, want 2", n)
+		}
+
+		// The profile is part of the key.
+		_, _ = s.generateClusters(ctx, sidecar1, &GenerationProfile{})
+		if n := g.callCount(); n != 3 {
+			t.Fatalf("got %d generations, want 3", n)
+		}
+
+		s.ClusterCacheKey = func(node model.Proxy) string { return node.Domain }
+		_, _ = s.generateClusters(ctx, sidecar1, nil)
+		_, _ = s.generateClusters(ctx, sidecar2, nil)
+		if n := g.callCount(); n != 4 {
+			t.Fatalf("got %d generations with a custom key, want 4", n)
+		}
+
+		// Servers don't share clusters.
+		_, _ = newTestServer(g).generateClusters(ctx, sidecar1, nil)
+		if n := g.callCount(); n != 5 {
+			t.Fatalf("got %d generations, want 5", n)
+		}
+	})
+}
+
+func TestCdsClusterCacheSkipsStale(t *testing.T) {
+	withClusterCache(true, func() {
+		g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+		s := newTestServer(g)
+		ctx := context.Background()
+		gw := model.Proxy{Type: model.Router, IPAddress: "10.1.1.2", Domain: "istio-system.svc.cluster.local"}
+
+		// The config changes during the generation: its result may be stale.
+		g.onBuild = func() { cdsClusterCache.clear() }
+		_, _ = s.generateClusters(ctx, gw, nil)
+		g.onBuild = nil
+		_, _ = s.generateClusters(ctx, gw, nil)
+		if n := g.callCount(); n != 2 {
+			t.Fatalf("got %d generations, want 2", n)
+		}
+
+		// Failed generations are not cached.
+		cdsPushAll(nil)
+		g.setError(errors.New("generation failed"))
+		_, _ = s.generateClusters(ctx, gw, nil)
+		g.setError(nil)
+		if clusters, err := s.generateClusters(ctx, gw, nil); err != nil || len(clusters) != 1 {
+			t.Fatalf("got %v, %v after a failed generation, want 1 cluster", clusters, err)
+		}
+	})
+}
+
+func TestCdsClusterCacheDisabled(t *testing.T) {
+	withClusterCache(false, func() {
+		g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+		s := newTestServer(g)
+		gw := model.Proxy{Type: model.Router, IPAddress: "10.1.1.2", Domain: "istio-system.svc.cluster.local"}
+		_, _ = s.generateClusters(context.Background(), gw, nil)
+		_, _ = s.generateClusters(context.Background(), gw, nil)
+		if n := g.callCount(); n != 2 {
+			t.Fatalf("got %d generations with the cache disabled, want 2", n)
+		}
+	})
+}
+
+// benchmarkCdsPush measures a push of 1000 clusters to the given number of gateways, which
+// share their clusters when cached.
+func benchmarkCdsPush(b *testing.B, connections int, cached bool) {
+	names := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		names = append(names, fmt.Sprintf("outbound|80||svc%d.default.svc.cluster.local", i))
+	}
+	s := newTestServer(newFakeGenerator(names...))
+	cons := make([]*CdsConnection, 0, connections)
+	for i := 0; i < connections; i++ {
+		cons = append(cons, &CdsConnection{modelNode: &model.Proxy{
+			Type:      model.Router,
+			IPAddress: fmt.Sprintf("10.1.%d.%d", i/256, i%256),
+			ID:        fmt.Sprintf("gw-%d.istio-system", i),
+			Domain:    "istio-system.svc.cluster.local",
+		}})
+	}
+
+	withClusterCache(cached, func() {
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			cdsClusterCache.clear()
+			for _, con := range cons {
+				clusters, err := s.generateClusters(context.Background(), *con.modelNode, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_ = con.clusters(clusters)
+			}
+		}
+	})
+}
+
+func BenchmarkCdsPushUncached10(b *testing.B)  { benchmarkCdsPush(b, 10, false) }
+func BenchmarkCdsPushCached10(b *testing.B)    { benchmarkCdsPush(b, 10, true) }
+func BenchmarkCdsPushUncached100(b *testing.B) { benchmarkCdsPush(b, 100, false) }
+func BenchmarkCdsPushCached100(b *testing.B)   { benchmarkCdsPush(b, 100, true) }
@@ -0,0 +1,97 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogo/googleapis/google/rpc"
+)
+
+// recordingCallbacks records the lifecycle events as strings.
+type recordingCallbacks struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (r *recordingCallbacks) record(format string, args ...interface{}) {
+	r.mutex.Lock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+	r.mutex.Unlock()
+}
+
+func (r *recordingCallbacks) OnConnect(node string, peer string) {
+	r.record("connect %s %s", node, peer)
+}
+
+func (r *recordingCallbacks) OnPush(node string, clusterCount int, version string) {
+	r.record("push %s %d %s", node, clusterCount, version)
+}
+
+func (r *recordingCallbacks) OnNack(node string, err error) {
+	r.record("nack %s %v", node, err)
+}
+
+func (r *recordingCallbacks) OnDisconnect(node string) {
+	r.record("disconnect %s", node)
+}
+
+func (r *recordingCallbacks) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.events)
+}
+
+func TestCdsCallbacks(t *testing.T) {
+	callbacks := &recordingCallbacks{}
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	s.CdsCallbacks = callbacks
+
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	resp := stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+
+	nack := clusterRequest(testNodeID)
+	nack.VersionInfo, nack.ResponseNonce = resp.VersionInfo, resp.Nonce
+	nack.ErrorDetail = &rpc.Status{Message: "invalid cluster"}
+	stream.sendRequest(nack)
+	deadline := time.Now().Add(testTimeout)
+	for callbacks.count() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the NACK callback")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stream.close()
+	_ = waitStreamDone(t, done)
+
+	want := []string{
+		"connect " + key + " 10.1.1.1:5000",
+		"push " + key + " 1 " + resp.VersionInfo,
+		"nack " + key + " invalid cluster",
+		"disconnect " + key,
+	}
+	callbacks.mutex.Lock()
+	defer callbacks.mutex.Unlock()
+	if !reflect.DeepEqual(callbacks.events, want) {
+		t.Errorf("got events %q, want %q", callbacks.events, want)
+	}
+}
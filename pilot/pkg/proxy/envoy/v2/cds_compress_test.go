@@ -0,0 +1,93 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"google.golang.org/grpc"
+)
+
+func TestCdsCompression(t *testing.T) {
+	names := make([]string, 0, 200)
+	for i := 0; i < 200; i++ {
+		names = append(names, fmt.Sprintf("outbound|80||svc%d.default.svc.cluster.local", i))
+	}
+	s := newTestServer(newFakeGenerator(names...))
+	grpcServer := grpc.NewServer(grpc.StatsHandler(CompressionStatsHandler()))
+	xdsapi.RegisterClusterDiscoveryServiceServer(grpcServer, s)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = grpcServer.Serve(l) }()
+	defer grpcServer.Stop()
+
+	// fetch returns the response to an initial request on a new stream.
+	fetch := func(opts ...grpc.CallOption) *xdsapi.DiscoveryResponse {
+		t.Helper()
+		conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = conn.Close() }()
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		stream, err := xdsapi.NewClusterDiscoveryServiceClient(conn).StreamClusters(ctx, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Send(clusterRequest(testNodeID)); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Close cleanly, so the server stream is done with logging before the next test.
+		if err := stream.CloseSend(); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(testTimeout)
+		for cdsConCount(testNodeID) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("timeout waiting for the stream to close")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return resp
+	}
+
+	// An envoy not compressing its requests gets uncompressed responses.
+	saved := counterValue(t, cdsCompressionSavedBytes)
+	if resp := fetch(); len(resp.Resources) != len(names) {
+		t.Fatalf("got %d clusters, want %d", len(resp.Resources), len(names))
+	}
+	if n := counterValue(t, cdsCompressionSavedBytes); n != saved {
+		t.Errorf("saved %v bytes on an uncompressed stream, want 0", n-saved)
+	}
+
+	if resp := fetch(grpc.UseCompressor("gzip")); len(resp.Resources) != len(names) {
+		t.Fatalf("got %d compressed clusters, want %d", len(resp.Resources), len(names))
+	}
+	if n := counterValue(t, cdsCompressionSavedBytes); n <= saved {
+		t.Error("no bytes saved on a gzip stream")
+	}
+}
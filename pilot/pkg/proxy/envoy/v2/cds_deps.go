@@ -0,0 +1,135 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// Kinds of config inputs in the dependency listing.
+const (
+	dependencyService         = "Service"
+	dependencyDestinationRule = "DestinationRule"
+)
+
+// ConfigDependency is a config input contributing to the clusters of a node.
+type ConfigDependency struct {
+	// Kind of the input, for example Service, ServiceEntry or DestinationRule.
+	Kind      string
+	Name      string
+	Namespace string `json:",omitempty"`
+
+	// Clusters are the names of the clusters the input contributed to.
+	Clusters []string
+}
+
+// ClusterDependencyReporter is implemented by ConfigGenerators able to list the config
+// inputs of the clusters they generate for a node.
+type ClusterDependencyReporter interface {
+	ClusterDependencies(env model.Environment, node model.Proxy) ([]ConfigDependency, error)
+}
+
+// cdsDeps is returned by /debug/cdsz/deps.
+type cdsDeps struct {
+	Node string
+
+	// Source is "generator" if the ConfigGenerator reported the inputs, or "cluster names"
+	// if they were derived from the generated clusters.
+	Source string
+
+	Dependencies []ConfigDependency
+}
+
+// cdsDepsHandler implements /debug/cdsz/deps?node=NODE, listing the config objects affecting
+// the clusters of the connection.
+func (s *DiscoveryServer) cdsDepsHandler(w http.ResponseWriter, req *http.Request) {
+	_ = req.ParseForm()
+	node := req.Form.Get("node")
+	con := getCdsCon(node)
+	if con == nil || con.node() == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	deps, err := s.clusterDependencies(*con.node(), con.profile)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	deps.Node = node
+	data, err := json.MarshalIndent(deps, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = w.Write(data)
+}
+
+// clusterDependencies lists the config inputs of the clusters of the node, reported by the
+// ConfigGenerator if it implements ClusterDependencyReporter, or else derived from the service
+// and subset encoded in the cluster names.
+func (s *DiscoveryServer) clusterDependencies(node model.Proxy, profile *GenerationProfile) (*cdsDeps, error) {
+	if r, ok := s.ConfigGenerator.(ClusterDependencyReporter); ok {
+		deps, err := r.ClusterDependencies(s.env, node)
+		if err != nil {
+			return nil, err
+		}
+		return &cdsDeps{Source: "generator", Dependencies: deps}, nil
+	}
+	clusters, err := s.buildClusters(context.Background(), node, profile)
+	if err != nil {
+		return nil, err
+	}
+	return &cdsDeps{Source: "cluster names", Dependencies: s.dependenciesFromNames(node, clusters)}, nil
+}
+
+func (s *DiscoveryServer) dependenciesFromNames(node model.Proxy, clusters []*xdsapi.Cluster) []ConfigDependency {
+	byHost := map[string][]string{}
+	for _, c := range clusters {
+		// direction|port|subset|hostname
+		if c == nil || strings.Count(c.Name, "|") != 3 {
+			continue
+		}
+		_, _, hostname, _ := model.ParseSubsetKey(c.Name)
+		byHost[hostname] = append(byHost[hostname], c.Name)
+	}
+	hosts := make([]string, 0, len(byHost))
+	for h := range byHost {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+
+	out := []ConfigDependency{}
+	for _, h := range hosts {
+		out = append(out, ConfigDependency{Kind: dependencyService, Name: h, Clusters: byHost[h]})
+		if s.env.IstioConfigStore == nil {
+			continue
+		}
+		if rule := s.env.DestinationRule(h, node.Domain); rule != nil {
+			out = append(out, ConfigDependency{Kind: dependencyDestinationRule, Name: rule.Name,
+				Namespace: rule.Namespace, Clusters: byHost[h]})
+		}
+	}
+	return out
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// fakeConfigStore returns destination rules by hostname.
+type fakeConfigStore struct {
+	model.IstioConfigStore
+	rules map[string]*model.Config
+}
+
+func (f *fakeConfigStore) DestinationRule(name, domain string) *model.Config {
+	return f.rules[name]
+}
+
+func TestCdsDeps(t *testing.T) {
+	s := newTestServer(newFakeGenerator(
+		"outbound|80||reviews.default.svc.cluster.local",
+		"outbound|80|v1|reviews.default.svc.cluster.local",
+		"outbound|9080||ratings.default.svc.cluster.local",
+		"BlackHoleCluster"))
+	rule := &model.Config{}
+	rule.Name, rule.Namespace = "reviews", "default"
+	s.env.IstioConfigStore = &fakeConfigStore{rules: map[string]*model.Config{
+		"reviews.default.svc.cluster.local": rule,
+	}}
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+
+	w := httptest.NewRecorder()
+	s.cdsDepsHandler(w, httptest.NewRequest("GET", "/debug/cdsz/deps?node="+url.QueryEscape(key), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("deps returned %d: %s", w.Code, w.Body.String())
+	}
+	deps := &cdsDeps{}
+	if err := json.Unmarshal(w.Body.Bytes(), deps); err != nil {
+		t.Fatal(err)
+	}
+	reviews := []string{"outbound|80||reviews.default.svc.cluster.local", "outbound|80|v1|reviews.default.svc.cluster.local"}
+	want := []ConfigDependency{
+		{Kind: dependencyService, Name: "ratings.default.svc.cluster.local",
+			Clusters: []string{"outbound|9080||ratings.default.svc.cluster.local"}},
+		{Kind: dependencyService, Name: "reviews.default.svc.cluster.local", Clusters: reviews},
+		{Kind: dependencyDestinationRule, Name: "reviews", Namespace: "default", Clusters: reviews},
+	}
+	if deps.Source != "cluster names" || !reflect.DeepEqual(deps.Dependencies, want) {
+		t.Errorf("got %s, want dependencies %+v", w.Body.String(), want)
+	}
+
+	w = httptest.NewRecorder()
+	s.cdsDepsHandler(w, httptest.NewRequest("GET", "/debug/cdsz/deps?node=unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("deps for an unknown node returned %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"istio.io/istio/pkg/log"
+)
+
+var (
+	// xdsDraining is set once DrainConnections is called: new CDS, EDS and LDS streams are
+	// rejected.
+	xdsDraining int32
+
+	// drainWindow spreads the closes of DrainConnections, set with PILOT_DRAIN_WINDOW. The
+	// proxies are closed one at a time over the window, instead of all reconnecting to the
+	// other pilots at once. 0 closes all the streams at once.
+	drainWindow = envDuration("PILOT_DRAIN_WINDOW", 0)
+
+	errDraining = status.Error(codes.Unavailable, "pilot is shutting down")
+)
+
+// rejectDraining is a registry check rejecting the new connections once pilot is draining.
+func rejectDraining(int) error {
+	if atomic.LoadInt32(&xdsDraining) != 0 {
+		return errDraining
+	}
+	return nil
+}
+
+// drain asks the stream of the connection to close once its current response is sent.
+func (con *CdsConnection) drain() {
+	con.drainOnce.Do(func() {
+		if con.drained != nil {
+			close(con.drained)
+		}
+	})
+}
+
+// DrainWindow returns the window over which DrainConnections closes the streams. The
+// context of DrainConnections should allow for it.
+func (s *DiscoveryServer) DrainWindow() time.Duration {
+	return drainWindow
+}
+
+// DrainConnections closes the xDS streams cleanly, for a pilot shutting down. New streams are
+// rejected with Unavailable from then on, and the connected proxies get a final push of the
+// current config. Then the streams of each proxy are closed once their current response is
+// sent, spread over PILOT_DRAIN_WINDOW, and StreamClusters, StreamEndpoints and
+// StreamListeners return without error. Blocks until the streams are closed, or ctx is done:
+// the streams not closed yet are then closed at once.
+func (s *DiscoveryServer) DrainConnections(ctx context.Context) error {
+	atomic.StoreInt32(&xdsDraining, 1)
+	drainPush(ctx)
+
+	proxies := drainProxies()
+	log.Infof("XDS: draining %d proxies over %v", len(proxies), drainWindow)
+	start := time.Now()
+	for i, cons := range proxies {
+		if drainWindow > 0 && ctx.Err() == nil {
+			at := start.Add(drainWindow * time.Duration(i) / time.Duration(len(proxies)))
+			select {
+			case <-time.After(time.Until(at)):
+			case <-ctx.Done():
+			}
+		}
+		for _, con := range cons {
+			con.drain()
+		}
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		remaining := cdsConnections.len() + edsConnections.len() + ldsConnections.len()
+		if remaining == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Warnf("XDS: %d connections not drained: %v", remaining, ctx.Err())
+			return ctx.Err()
+		}
+	}
+}
+
+// drainPush pushes the current config to the connections before they are drained, and waits
+// for the CDS pushes to complete, up to cdsPushWaitTimeout. The EDS and LDS streams send the
+// push queued before closing.
+func drainPush(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, cdsPushWaitTimeout)
+	defer cancel()
+	cons := cdsConnectionSnapshot()
+	waiters := make([]<-chan error, 0, len(cons))
+	for _, con := range cons {
+		waiters = append(waiters, con.waitPush())
+	}
+	cdsPushAll(nil)
+	for _, con := range edsConnections.snapshot() {
+		con.(*EdsConnection).signalPush()
+	}
+	ldsPushAll()
+	for _, w := range waiters {
+		select {
+		case <-w:
+		case <-ctx.Done():
+			log.Warnf("XDS: final CDS push not completed: %v", ctx.Err())
+			return
+		}
+	}
+}
+
+// drainProxies returns the connections of the CDS, EDS and LDS registries by proxy, in node
+// id order: the streams of a proxy are closed together, so it reconnects once.
+func drainProxies() [][]xdsConnection {
+	byNode := map[string][]xdsConnection{}
+	for _, r := range []*connectionRegistry{cdsConnections, edsConnections, ldsConnections} {
+		for node, cons := range r.byNode() {
+			byNode[node] = append(byNode[node], cons...)
+		}
+	}
+	nodes := make([]string, 0, len(byNode))
+	for node := range byNode {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	out := make([][]xdsConnection, 0, len(nodes))
+	for _, node := range nodes {
+		out = append(out, byNode[node])
+	}
+	return out
+}
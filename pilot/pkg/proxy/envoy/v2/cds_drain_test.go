@@ -0,0 +1,139 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCdsDrainConnections(t *testing.T) {
+	defer atomic.StoreInt32(&xdsDraining, 0)
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	ids := []string{
+		"sidecar~10.1.1.1~reviews-v1.ns~ns.svc.cluster.local",
+		"sidecar~10.1.1.2~ratings-v1.ns~ns.svc.cluster.local",
+	}
+	// The streams are left open after the drain: closing them makes their receive goroutine
+	// log concurrently with the next tests.
+	dones := []<-chan error{}
+	for _, id := range ids {
+		stream := newFakeStream("10.1.1.1:5000")
+		done := startClusterStream(s, stream)
+		stream.sendRequest(clusterRequest(id))
+		stream.recvResponse(t)
+		waitCdsCon(t, id)
+		dones = append(dones, done)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := s.DrainConnections(ctx); err != nil {
+		t.Fatalf("drain returned %v", err)
+	}
+	for i, done := range dones {
+		if err := waitStreamDone(t, done); err != nil {
+			t.Errorf("stream %d returned %v after the drain, want nil", i, err)
+		}
+	}
+	remaining := cdsConnections.len()
+	if remaining != 0 {
+		t.Errorf("%d connections left after the drain", remaining)
+	}
+
+	// New streams are rejected.
+	stream := newFakeStream("10.1.1.3:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	if err := waitStreamDone(t, done); status.Code(err) != codes.Unavailable {
+		t.Errorf("stream during the drain returned %v, want Unavailable", err)
+	}
+}
+
+func TestDrainConnectionsWindow(t *testing.T) {
+	defer resendUnchanged()()
+	defer atomic.StoreInt32(&xdsDraining, 0)
+	defer func(w time.Duration) { drainWindow = w }(drainWindow)
+	drainWindow = 200 * time.Millisecond
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	ids := []string{
+		"sidecar~10.1.1.1~reviews-v1.ns~ns.svc.cluster.local",
+		"sidecar~10.1.1.2~ratings-v1.ns~ns.svc.cluster.local",
+	}
+	// A CDS and an LDS stream for each proxy.
+	streams := [][]*fakeStream{}
+	dones := [][]<-chan error{}
+	for _, id := range ids {
+		cds := newFakeStream("10.1.1.1:5000")
+		cdsDone := startClusterStream(s, cds)
+		cds.sendRequest(clusterRequest(id))
+		cds.recvResponse(t)
+		waitCdsCon(t, id)
+
+		lds := newFakeStream("10.1.1.1:5001")
+		ldsDone := make(chan error, 1)
+		go func() { ldsDone <- s.StreamListeners(lds) }()
+		lds.sendRequest(&xdsapi.DiscoveryRequest{Node: &core.Node{Id: id}, TypeUrl: listenerType})
+		lds.recvResponse(t)
+
+		streams = append(streams, []*fakeStream{cds, lds})
+		dones = append(dones, []<-chan error{cdsDone, ldsDone})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	start := time.Now()
+	drained := make(chan error, 1)
+	go func() { drained <- s.DrainConnections(ctx) }()
+
+	// Each stream gets a final push before closing.
+	for _, proxy := range streams {
+		for _, stream := range proxy {
+			stream.recvResponse(t)
+		}
+	}
+	for i, proxy := range dones {
+		for _, done := range proxy {
+			if err := waitStreamDone(t, done); err != nil {
+				t.Errorf("stream of proxy %d returned %v after the drain, want nil", i, err)
+			}
+		}
+	}
+	// The second proxy is closed half-way through the window.
+	if d := time.Since(start); d < drainWindow/2 {
+		t.Errorf("streams closed after %v, want spread over %v", d, drainWindow)
+	}
+	if err := <-drained; err != nil {
+		t.Errorf("drain returned %v", err)
+	}
+
+	// New LDS streams are rejected too.
+	stream := newFakeStream("10.1.1.3:5000")
+	done := make(chan error, 1)
+	go func() { done <- s.StreamListeners(stream) }()
+	stream.sendRequest(&xdsapi.DiscoveryRequest{Node: &core.Node{Id: testNodeID}, TypeUrl: listenerType})
+	if err := waitStreamDone(t, done); status.Code(err) != codes.Unavailable {
+		t.Errorf("LDS stream during the drain returned %v, want Unavailable", err)
+	}
+}
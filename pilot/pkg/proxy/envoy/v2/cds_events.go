@@ -0,0 +1,135 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event types in the connection event log.
+const (
+	cdsEventConnect    = "connect"
+	cdsEventRequest    = "request"
+	cdsEventAck        = "ack"
+	cdsEventNack       = "nack"
+	cdsEventStale      = "stale"
+	cdsEventPush       = "push"
+	cdsEventDisconnect = "disconnect"
+)
+
+// cdsClosedEventLogs is the number of closed connections whose event log is kept, so the
+// timeline of a proxy that disconnected during an incident is still available.
+const cdsClosedEventLogs = 100
+
+var (
+	// cdsEventLogSize is the number of events kept for each connection, set with
+	// PILOT_DEBUG_CDS_EVENTS. Zero disables the event log.
+	cdsEventLogSize = envInt("PILOT_DEBUG_CDS_EVENTS", 64)
+
+	cdsClosedEventsMux sync.Mutex
+	// cdsClosedEvents are the event logs of the last closed connections, by connection key.
+	cdsClosedEvents = map[string][]cdsEvent{}
+	// cdsClosedOrder are the keys of cdsClosedEvents, oldest first.
+	cdsClosedOrder []string
+)
+
+// cdsEvent is an entry of the connection event log, returned by /debug/cdsz?events=1&node=NODE.
+type cdsEvent struct {
+	Time   time.Time
+	Type   string
+	Detail string `json:",omitempty"`
+}
+
+// cdsEventLog keeps the last cdsEventLogSize events of a connection.
+type cdsEventLog struct {
+	events []cdsEvent
+	// next is the position of the oldest event, once the log is full.
+	next int
+}
+
+func (l *cdsEventLog) add(eventType, detail string) {
+	if cdsEventLogSize <= 0 {
+		return
+	}
+	e := cdsEvent{Time: time.Now(), Type: eventType, Detail: detail}
+	if len(l.events) < cdsEventLogSize {
+		l.events = append(l.events, e)
+		return
+	}
+	l.events[l.next] = e
+	l.next = (l.next + 1) % len(l.events)
+}
+
+// list returns a copy of the events, oldest first.
+func (l *cdsEventLog) list() []cdsEvent {
+	out := make([]cdsEvent, 0, len(l.events))
+	out = append(out, l.events[l.next:]...)
+	return append(out, l.events[:l.next]...)
+}
+
+// logEvent adds an event to the log of the connection.
+func (con *CdsConnection) logEvent(eventType, detail string) {
+	con.mutex.Lock()
+	con.events.add(eventType, detail)
+	con.mutex.Unlock()
+}
+
+func (con *CdsConnection) eventList() []cdsEvent {
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	return con.events.list()
+}
+
+// keepClosedEvents keeps the event log of a closed connection, dropping the oldest one.
+func keepClosedEvents(node string, events []cdsEvent) {
+	if cdsEventLogSize <= 0 {
+		return
+	}
+	cdsClosedEventsMux.Lock()
+	defer cdsClosedEventsMux.Unlock()
+	if _, f := cdsClosedEvents[node]; !f {
+		cdsClosedOrder = append(cdsClosedOrder, node)
+	}
+	cdsClosedEvents[node] = events
+	if len(cdsClosedOrder) > cdsClosedEventLogs {
+		delete(cdsClosedEvents, cdsClosedOrder[0])
+		cdsClosedOrder = cdsClosedOrder[1:]
+	}
+}
+
+// writeEvents writes the event log of a connection, or of a recently closed one.
+func writeEvents(w http.ResponseWriter, node string) {
+	var events []cdsEvent
+	if con := getCdsCon(node); con != nil {
+		events = con.eventList()
+	} else {
+		cdsClosedEventsMux.Lock()
+		events = cdsClosedEvents[node]
+		cdsClosedEventsMux.Unlock()
+	}
+	if events == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"istio.io/istio/pkg/log"
+)
+
+// A config bug can make the cluster count of every proxy balloon at once. The median of the
+// cluster counts last pushed to each connection is compared with its rolling baseline, and a
+// jump beyond cdsExplosionFactor is reported as a critical error.
+
+const (
+	// cdsExplosionCheckInterval bounds how often the median is computed, pushes to all the
+	// connections are evaluated together.
+	cdsExplosionCheckInterval = time.Second
+
+	// cdsExplosionBaselineWeight is the weight of each check in the rolling baseline.
+	cdsExplosionBaselineWeight = 0.1
+)
+
+var (
+	// cdsExplosionFactor is the jump of the median cluster count over its baseline reported as
+	// an explosion, set with PILOT_CDS_EXPLOSION_FACTOR. Zero (the default) disables the check.
+	cdsExplosionFactor = envInt("PILOT_CDS_EXPLOSION_FACTOR", 0)
+
+	cdsClusterCounts = newClusterCountMonitor()
+)
+
+// clusterCountMonitor tracks the cluster count of the connections.
+type clusterCountMonitor struct {
+	mutex sync.Mutex
+	// counts are the cluster counts last pushed, by connection key.
+	counts map[string]int
+	// baseline is the rolling median cluster count. Zero until the first check.
+	baseline float64
+	// exploded is set while the median is beyond the baseline, to alert once per explosion.
+	exploded  bool
+	lastCheck time.Time
+}
+
+func newClusterCountMonitor() *clusterCountMonitor {
+	return &clusterCountMonitor{counts: map[string]int{}}
+}
+
+// record tracks the clusters pushed to the connection, and periodically checks the median.
+func (m *clusterCountMonitor) record(node string, clusters int, now time.Time) {
+	if cdsExplosionFactor <= 0 {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counts[node] = clusters
+	if now.Sub(m.lastCheck) < cdsExplosionCheckInterval {
+		return
+	}
+	m.lastCheck = now
+	m.check()
+}
+
+// forget drops a closed connection.
+func (m *clusterCountMonitor) forget(node string) {
+	m.mutex.Lock()
+	delete(m.counts, node)
+	m.mutex.Unlock()
+}
+
+// check compares the median with the baseline, then updates the baseline.
+func (m *clusterCountMonitor) check() {
+	counts := make([]int, 0, len(m.counts))
+	for _, n := range m.counts {
+		counts = append(counts, n)
+	}
+	sort.Ints(counts)
+	median := float64(counts[len(counts)/2])
+	cdsMedianClustersGauge.Set(median)
+
+	if m.baseline == 0 {
+		m.baseline = median
+		return
+	}
+	beyond := median > float64(cdsExplosionFactor)*m.baseline
+	if beyond && !m.exploded {
+		cdsClusterExplosionCounter.Inc()
+		log.Errorf("CDS: CRITICAL: median cluster count jumped to %v from a baseline of %.1f over %d connections, "+
+			"check for a mesh-wide config issue", median, m.baseline, len(counts))
+	}
+	m.exploded = beyond
+	m.baseline += cdsExplosionBaselineWeight * (median - m.baseline)
+}
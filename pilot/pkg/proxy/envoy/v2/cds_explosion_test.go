@@ -0,0 +1,60 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCdsClusterCountExplosion(t *testing.T) {
+	oldFactor := cdsExplosionFactor
+	cdsExplosionFactor = 3
+	defer func() { cdsExplosionFactor = oldFactor }()
+
+	m := newClusterCountMonitor()
+	now := time.Now()
+	// push records a push of n clusters to each of 10 connections, in a new check interval.
+	push := func(n int) {
+		now = now.Add(cdsExplosionCheckInterval)
+		for i := 0; i < 10; i++ {
+			m.record("node-"+strconv.Itoa(i), n, now)
+		}
+	}
+	explosions := counterValue(t, cdsClusterExplosionCounter)
+
+	out := captureLog(t, func() {
+		for i := 0; i < 5; i++ {
+			push(20)
+		}
+		// Normal growth.
+		push(30)
+		if n := counterValue(t, cdsClusterExplosionCounter); n != explosions {
+			t.Errorf("got %v explosions for a normal growth, want none", n-explosions)
+		}
+		// Every proxy jumps to 10x the clusters.
+		push(200)
+		push(200)
+	})
+
+	if n := counterValue(t, cdsClusterExplosionCounter); n != explosions+1 {
+		t.Errorf("got %v explosions, want 1", n-explosions)
+	}
+	if !strings.Contains(out, "CDS: CRITICAL: median cluster count jumped to 200") {
+		t.Errorf("explosion not logged, log:\n%s", out)
+	}
+}
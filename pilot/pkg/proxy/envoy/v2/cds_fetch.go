@@ -0,0 +1,147 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/log"
+)
+
+var (
+	// cdsFetchCacheTTL bounds how long a FetchClusters response is reused for the same node.
+	// The cache is also cleared on each config change. Zero disables the cache.
+	cdsFetchCacheTTL = envDuration("PILOT_CDS_FETCH_CACHE_TTL", 5*time.Second)
+
+	cdsFetchCache = &clusterFetchCache{entries: map[string]*cachedFetch{}}
+)
+
+// clusterFetchCache holds the recent FetchClusters responses, keyed by node id.
+type clusterFetchCache struct {
+	mutex   sync.Mutex
+	entries map[string]*cachedFetch
+	// swept is the time of the last sweep of the expired entries.
+	swept time.Time
+}
+
+type cachedFetch struct {
+	expires  time.Time
+	response *xdsapi.DiscoveryResponse
+}
+
+func (c *clusterFetchCache) get(node string) *xdsapi.DiscoveryResponse {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e := c.entries[node]
+	if e == nil {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, node)
+		return nil
+	}
+	return e.response
+}
+
+// add caches the response of the node. The expired entries of the other nodes are dropped, at
+// most once per cdsFetchCacheTTL, so the cache doesn't grow with the node ids polling between
+// two config changes.
+func (c *clusterFetchCache) add(node string, response *xdsapi.DiscoveryResponse) {
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now.Sub(c.swept) >= cdsFetchCacheTTL {
+		for n, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, n)
+			}
+		}
+		c.swept = now
+	}
+	c.entries[node] = &cachedFetch{expires: now.Add(cdsFetchCacheTTL), response: response}
+}
+
+// clear drops all cached responses, called when the config changes.
+func (c *clusterFetchCache) clear() {
+	c.mutex.Lock()
+	c.entries = map[string]*cachedFetch{}
+	c.mutex.Unlock()
+}
+
+// FetchClusters implements xdsapi.ClusterDiscoveryServiceServer.FetchClusters(), for envoys
+// polling with the REST variant of xDS instead of keeping a stream.
+// Responses are cached per node for cdsFetchCacheTTL, or until the next config change. The
+// version is the hash of the clusters, as on a stream: an envoy polling an unchanged config
+// gets the version it already has. A rejection of the previous response comes in the
+// ErrorDetail of the next fetch.
+func (s *DiscoveryServer) FetchClusters(ctx context.Context, req *xdsapi.DiscoveryRequest) (*xdsapi.DiscoveryResponse, error) {
+	if req.Node == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing node in request")
+	}
+	if err := s.authenticateNode(ctx, req.Node.Id); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, contextStatus(err)
+	}
+	if req.ErrorDetail != nil {
+		log.Warnf("CDS: fetch ACK ERROR %s version %q: %s", req.Node.Id, req.VersionInfo, req.ErrorDetail.Message)
+		cdsNacksCounter.Inc()
+		if s.CdsCallbacks != nil {
+			s.CdsCallbacks.OnNack(req.Node.Id, errors.New(req.ErrorDetail.Message))
+		}
+	}
+	if cdsFetchCacheTTL > 0 {
+		if response := cdsFetchCache.get(req.Node.Id); response != nil {
+			return response, nil
+		}
+	}
+	nt, err := model.ParseServiceNode(req.Node.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid node id %q: %v", req.Node.Id, err)
+	}
+	rawClusters, _, err := s.nodeClusters(ctx, req.Node.Id, &nt, nodeNetwork(req.Node),
+		s.generationProfile(req.Node, nt), false)
+	if err := ctx.Err(); err != nil {
+		// The caller is gone, don't build a response for it.
+		return nil, contextStatus(err)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate clusters: %v", err)
+	}
+
+	// Unary fetches have no connection, the response is built the same way as for a stream.
+	response := (&CdsConnection{}).clusters(rawClusters)
+	if cdsFetchCacheTTL > 0 {
+		cdsFetchCache.add(req.Node.Id, response)
+	}
+	return response, nil
+}
+
+// contextStatus returns the gRPC status error of a context error.
+func contextStatus(err error) error {
+	if err == context.DeadlineExceeded {
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Canceled, err.Error())
+}
@@ -0,0 +1,200 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/gogo/googleapis/google/rpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestFetchClustersCache(t *testing.T) {
+	cdsFetchCache.clear()
+	defer cdsFetchCache.clear()
+
+	g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+	s := newTestServer(g)
+
+	first, err := s.FetchClusters(context.Background(), clusterRequest(testNodeID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Resources) != 1 {
+		t.Fatalf("got %d clusters, want 1", len(first.Resources))
+	}
+	second, err := s.FetchClusters(context.Background(), clusterRequest(testNodeID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first || g.callCount() != 1 {
+		t.Errorf("second fetch was not served from cache, generator called %d times", g.callCount())
+	}
+
+	// A config change invalidates the cache.
+	cdsPushAll(nil)
+	if _, err := s.FetchClusters(context.Background(), clusterRequest(testNodeID)); err != nil {
+		t.Fatal(err)
+	}
+	if g.callCount() != 2 {
+		t.Errorf("fetch after config change used the cache, generator called %d times", g.callCount())
+	}
+}
+
+func TestFetchClustersCacheExpiry(t *testing.T) {
+	cdsFetchCache.clear()
+	defer cdsFetchCache.clear()
+	defer func(ttl time.Duration) { cdsFetchCacheTTL = ttl }(cdsFetchCacheTTL)
+	cdsFetchCacheTTL = 10 * time.Millisecond
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	others := []string{
+		"sidecar~10.1.1.2~ratings-v1.ns~ns.svc.cluster.local",
+		"sidecar~10.1.1.3~reviews-v1.ns~ns.svc.cluster.local",
+	}
+	for _, id := range others {
+		if _, err := s.FetchClusters(context.Background(), clusterRequest(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(2 * cdsFetchCacheTTL)
+	// The pollers are gone: their entries are dropped by the fetch of another node.
+	if _, err := s.FetchClusters(context.Background(), clusterRequest(testNodeID)); err != nil {
+		t.Fatal(err)
+	}
+	cdsFetchCache.mutex.Lock()
+	n := len(cdsFetchCache.entries)
+	cdsFetchCache.mutex.Unlock()
+	if n != 1 {
+		t.Errorf("%d cached fetches, want the expired entries of the other nodes dropped", n)
+	}
+}
+
+func TestFetchClustersErrors(t *testing.T) {
+	cdsFetchCache.clear()
+	defer cdsFetchCache.clear()
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+
+	if _, err := s.FetchClusters(context.Background(), &xdsapi.DiscoveryRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("fetch without node returned %v, want InvalidArgument", err)
+	}
+	if _, err := s.FetchClusters(context.Background(), clusterRequest("invalid")); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("fetch with an invalid node id returned %v, want InvalidArgument", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.FetchClusters(ctx, clusterRequest(testNodeID)); status.Code(err) != codes.Canceled {
+		t.Errorf("fetch with a canceled context returned %v, want Canceled", err)
+	}
+
+	resp, err := s.FetchClusters(context.Background(), clusterRequest(testNodeID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TypeUrl != clusterType || resp.VersionInfo == "" || resp.Nonce == "" {
+		t.Errorf("got type %q, version %q and nonce %q, want a CDS response",
+			resp.TypeUrl, resp.VersionInfo, resp.Nonce)
+	}
+}
+
+func TestFetchClustersVersion(t *testing.T) {
+	cdsFetchCache.clear()
+	defer cdsFetchCache.clear()
+	callbacks := &recordingCallbacks{}
+	g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+	s := newTestServer(g)
+	s.CdsCallbacks = callbacks
+
+	first, err := s.FetchClusters(context.Background(), clusterRequest(testNodeID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stream and the fetch agree on the version of the same clusters.
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	if pushed := stream.recvResponse(t); pushed.VersionInfo != first.VersionInfo {
+		t.Errorf("got version %s on the stream, want the fetched version %s", pushed.VersionInfo, first.VersionInfo)
+	}
+	stream.close()
+	_ = waitStreamDone(t, done)
+
+	// A config change with the same clusters keeps the version.
+	cdsPushAll(nil)
+	poll := clusterRequest(testNodeID)
+	poll.VersionInfo = first.VersionInfo
+	poll.ErrorDetail = &rpc.Status{Message: "invalid cluster"}
+	same, err := s.FetchClusters(context.Background(), poll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same.VersionInfo != first.VersionInfo {
+		t.Errorf("got version %s for unchanged clusters, want %s", same.VersionInfo, first.VersionInfo)
+	}
+	callbacks.mutex.Lock()
+	nacked := len(callbacks.events) > 0 && callbacks.events[len(callbacks.events)-1] == "nack "+testNodeID+" invalid cluster"
+	callbacks.mutex.Unlock()
+	if !nacked {
+		t.Errorf("got events %q, want the fetch NACK last", callbacks.events)
+	}
+
+	g.setClusters("outbound|80||b.default.svc.cluster.local")
+	cdsPushAll(nil)
+	changed, err := s.FetchClusters(context.Background(), clusterRequest(testNodeID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.VersionInfo == first.VersionInfo {
+		t.Errorf("got version %s for different clusters, want a new version", changed.VersionInfo)
+	}
+}
+
+func TestFetchClustersPipeline(t *testing.T) {
+	cdsFetchCache.clear()
+	defer cdsFetchCache.clear()
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	s.ClusterSources = []ClusterGenerator{newFakeGenerator("outbound|80||external.example.com")}
+	s.ClusterPostProcessors = []ClusterPostProcessor{func(clusters []*xdsapi.Cluster, _ *model.Proxy) []*xdsapi.Cluster {
+		return append(clusters, &xdsapi.Cluster{Name: "outbound|80||processed.default.svc.cluster.local"})
+	}}
+
+	fetched, err := s.FetchClusters(context.Background(), clusterRequest(testNodeID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	pushed := stream.recvResponse(t)
+
+	got, want := clusterNames(t, fetched), clusterNames(t, pushed)
+	if len(want) != 3 || !reflect.DeepEqual(got, want) {
+		t.Errorf("fetched clusters %v, want the streamed clusters %v with the source and processor", got, want)
+	}
+	if fetched.VersionInfo != pushed.VersionInfo {
+		t.Errorf("fetched version %s, want the streamed version %s", fetched.VersionInfo, pushed.VersionInfo)
+	}
+}
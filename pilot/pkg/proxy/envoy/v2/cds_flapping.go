@@ -0,0 +1,155 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"sort"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+)
+
+// Detection of 'flapping' clusters - clusters whose content changes on (nearly) every push,
+// usually caused by non-deterministic generation. Enabled with PILOT_DEBUG_CDS_FLAPPING=1,
+// since it hashes every cluster on every push, for the sampled connections. Results are
+// available at /debug/cdsz?flapping=1.
+
+var (
+	cdsTrackFlapping = os.Getenv("PILOT_DEBUG_CDS_FLAPPING") == "1"
+)
+
+const (
+	// cdsFlapWindow is the number of recent pushes kept for each cluster.
+	cdsFlapWindow = 10
+
+	// cdsFlapMinPushes is the number of pushes needed before a cluster can be flagged.
+	cdsFlapMinPushes = 4
+
+	// A cluster is flapping if it changed in at least cdsFlapPercent of the recent pushes.
+	cdsFlapPercent = 80
+)
+
+// clusterChanges tracks the content changes of one cluster across recent pushes.
+type clusterChanges struct {
+	// hash of the cluster content in the last push
+	hash uint64
+
+	// changed has one entry for each recent push, true if the content changed in that push.
+	changed []bool
+}
+
+func (c *clusterChanges) flapping() bool {
+	if len(c.changed) < cdsFlapMinPushes {
+		return false
+	}
+	n := 0
+	for _, changed := range c.changed {
+		if changed {
+			n++
+		}
+	}
+	return n*100 >= cdsFlapPercent*len(c.changed)
+}
+
+// trackChanges records which of the clusters pushed to the connection changed since the
+// previous push. Returns the number of changed, added or removed clusters.
+func (con *CdsConnection) trackChanges(clusters []*xdsapi.Cluster) int {
+	hashes := make(map[string]uint64, len(clusters))
+	for _, c := range clusters {
+		if c == nil {
+			continue
+		}
+		data, err := c.Marshal()
+		if err != nil {
+			continue
+		}
+		h := fnv.New64a()
+		_, _ = h.Write(data)
+		hashes[c.Name] = h.Sum64()
+	}
+
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	if con.changes == nil {
+		con.changes = map[string]*clusterChanges{}
+	}
+	changed := 0
+	for name, h := range hashes {
+		c := con.changes[name]
+		if c == nil {
+			// First time the cluster is pushed, nothing to compare with.
+			con.changes[name] = &clusterChanges{hash: h}
+			changed++
+			continue
+		}
+		c.changed = append(c.changed, c.hash != h)
+		if len(c.changed) > cdsFlapWindow {
+			c.changed = c.changed[1:]
+		}
+		if c.hash != h {
+			changed++
+		}
+		c.hash = h
+	}
+	// Forget clusters that are no longer pushed.
+	for name := range con.changes {
+		if _, found := hashes[name]; !found {
+			delete(con.changes, name)
+			changed++
+		}
+	}
+	return changed
+}
+
+// flappingClusters returns the sorted names of the clusters that changed in most recent pushes.
+func (con *CdsConnection) flappingClusters() []string {
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	out := []string{}
+	for name, c := range con.changes {
+		if c.flapping() {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// writeFlapping writes the flapping clusters of each connection as json, skipping connections
+// without flapping clusters. If node is set, only that connection is included.
+func writeFlapping(w http.ResponseWriter, node string) {
+	cons := cdsConnectionSnapshot()
+	for k := range cons {
+		if node != "" && node != k {
+			delete(cons, k)
+		}
+	}
+
+	out := map[string][]string{}
+	for k, con := range cons {
+		if flapping := con.flappingClusters(); len(flapping) > 0 {
+			out[k] = flapping
+		}
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = w.Write(data)
+}
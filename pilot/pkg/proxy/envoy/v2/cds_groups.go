@@ -0,0 +1,86 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// cdsConfigGroup is a set of connections last pushed the same clusters.
+type cdsConfigGroup struct {
+	// Hash is the content hash of the pushed clusters.
+	Hash string
+
+	// Connections are the keys of the connections, as listed by /debug/cdsz.
+	Connections []string
+}
+
+// cdsConfigGroups is returned by /debug/cdsz?groups=1. Few distinct configs for many
+// connections means generation results could be shared between connections.
+type cdsConfigGroups struct {
+	Connections     int
+	DistinctConfigs int
+	// Groups are sorted by decreasing size.
+	Groups []*cdsConfigGroup
+}
+
+// configGroups groups the connections by the content hash of their last push. Connections
+// without a push yet are skipped.
+func configGroups() *cdsConfigGroups {
+	cons := cdsConnectionSnapshot()
+	hashes := make(map[string]uint64, len(cons))
+	for k, con := range cons {
+		con.mutex.Lock()
+		if con.pushedHash != 0 {
+			hashes[k] = con.pushedHash
+		}
+		con.mutex.Unlock()
+	}
+
+	byHash := map[uint64]*cdsConfigGroup{}
+	out := &cdsConfigGroups{Connections: len(hashes), Groups: []*cdsConfigGroup{}}
+	for k, h := range hashes {
+		g := byHash[h]
+		if g == nil {
+			g = &cdsConfigGroup{Hash: fmt.Sprintf("%x", h)}
+			byHash[h] = g
+			out.Groups = append(out.Groups, g)
+		}
+		g.Connections = append(g.Connections, k)
+	}
+	for _, g := range out.Groups {
+		sort.Strings(g.Connections)
+	}
+	sort.Slice(out.Groups, func(i, j int) bool {
+		if len(out.Groups[i].Connections) != len(out.Groups[j].Connections) {
+			return len(out.Groups[i].Connections) > len(out.Groups[j].Connections)
+		}
+		return out.Groups[i].Hash < out.Groups[j].Hash
+	})
+	out.DistinctConfigs = len(out.Groups)
+	return out
+}
+
+func writeConfigGroups(w http.ResponseWriter) {
+	data, err := json.Marshal(configGroups())
+	if err != nil {
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"time"
+)
+
+var (
+	// cdsIdleTimeout closes the CDS connections without requests or pushes for the duration,
+	// set with PILOT_CDS_IDLE_TIMEOUT. Envoys with a stable config don't send anything after
+	// their ACK: the timeout must be longer than the interval between config changes, or
+	// the periodic refresh (V2_REFRESH). Zero (the default) disables the timeout.
+	cdsIdleTimeout = envDuration("PILOT_CDS_IDLE_TIMEOUT", 0)
+)
+
+// idleTicker returns the channel of the idle checks, nil if the idle timeout is disabled.
+func idleTicker() (<-chan time.Time, func()) {
+	if cdsIdleTimeout <= 0 {
+		return nil, func() {}
+	}
+	// Idle connections are closed at most a quarter of the timeout late.
+	ticker := time.NewTicker(cdsIdleTimeout / 4)
+	return ticker.C, ticker.Stop
+}
+
+// recordReceived tracks the time of the last request received from the envoy.
+func (con *CdsConnection) recordReceived(now time.Time) {
+	con.mutex.Lock()
+	con.lastRequestTime = now
+	con.mutex.Unlock()
+}
+
+// idle returns true if the connection had no request or push for cdsIdleTimeout.
+func (con *CdsConnection) idle(now time.Time) bool {
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	last := con.Connect
+	if con.lastRequestTime.After(last) {
+		last = con.lastRequestTime
+	}
+	if con.lastPushTime.After(last) {
+		last = con.lastPushTime
+	}
+	return now.Sub(last) > cdsIdleTimeout
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// nodeLabelsMetadata is the node metadata key holding the workload labels of the proxy,
+// as a struct of string values.
+const nodeLabelsMetadata = "LABELS"
+
+// nodeLabels returns the workload labels of the node, or nil if not set.
+func nodeLabels(node *core.Node) model.Labels {
+	if node == nil || node.Metadata == nil {
+		return nil
+	}
+	s := node.Metadata.Fields[nodeLabelsMetadata].GetStructValue()
+	if s == nil {
+		return nil
+	}
+	labels := make(model.Labels, len(s.Fields))
+	for k, v := range s.Fields {
+		labels[k] = v.GetStringValue()
+	}
+	return labels
+}
+
+// matchesSelector returns true if the connection should get a push for config scoped to the
+// selector. A nil selector matches all connections.
+func (con *CdsConnection) matchesSelector(selector model.Labels) bool {
+	if selector == nil {
+		return true
+	}
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	return selector.SubsetOf(con.labels)
+}
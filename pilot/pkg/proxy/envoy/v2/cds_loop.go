@@ -0,0 +1,81 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"hash/fnv"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+
+	"istio.io/istio/pkg/log"
+)
+
+// Detection of push loops: the same content pushed to a connection over and over, for
+// example when rapid ACK/NACK cycles race with pushes for config changes.
+
+var (
+	// cdsPushLoopCount is the number of identical pushes to a connection within
+	// cdsPushLoopWindow reported as a push loop. Off by default: every registry event
+	// pushes to all connections, so identical pushes are common on a busy mesh.
+	cdsPushLoopCount = envInt("PILOT_CDS_PUSH_LOOP_COUNT", 0)
+
+	cdsPushLoopWindow = envDuration("PILOT_CDS_PUSH_LOOP_WINDOW", 10*time.Second)
+)
+
+// pushLoopDetector tracks the identical pushes to a connection. Only used by the stream
+// goroutine.
+type pushLoopDetector struct {
+	// hash of the content of the last push
+	hash uint64
+	// count of the consecutive pushes with the same content, since start
+	count int
+	start time.Time
+}
+
+// contentHash returns a hash of the resources in the response, ignoring the version and nonce.
+func contentHash(response *xdsapi.DiscoveryResponse) uint64 {
+	h := fnv.New64a()
+	for i := range response.Resources {
+		_, _ = h.Write(response.Resources[i].Value)
+	}
+	return h.Sum64()
+}
+
+// record adds a push, and returns true if it completes a push loop: cdsPushLoopCount
+// identical pushes within cdsPushLoopWindow. Reported once per loop.
+func (d *pushLoopDetector) record(response *xdsapi.DiscoveryResponse, now time.Time) bool {
+	h := contentHash(response)
+	if h != d.hash || now.Sub(d.start) > cdsPushLoopWindow {
+		d.hash = h
+		d.count = 1
+		d.start = now
+		return false
+	}
+	d.count++
+	return d.count == cdsPushLoopCount
+}
+
+// checkPushLoop logs and counts the push loops to the connection.
+func (con *CdsConnection) checkPushLoop(node string, response *xdsapi.DiscoveryResponse) {
+	if cdsPushLoopCount <= 0 {
+		return
+	}
+	if con.loops.record(response, time.Now()) {
+		cdsPushLoopCounter.Inc()
+		log.Warnf("CDS: push loop to %s %q, %d identical pushes (content hash %x) within %v",
+			node, con.PeerAddr, con.loops.count, con.loops.hash, cdsPushLoopWindow)
+	}
+}
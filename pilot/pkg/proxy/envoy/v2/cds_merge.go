@@ -0,0 +1,240 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/log"
+)
+
+var (
+	// cdsStrict escalates generation warnings (clusters replaced by a later source) to
+	// failures, to catch config issues in CI and staging. Off by default, set with
+	// PILOT_CDS_STRICT=1.
+	cdsStrict = os.Getenv("PILOT_CDS_STRICT") == "1"
+
+	// cdsValidate also treats the clusters failing the envoy proto validation (required
+	// fields, enum ranges) as invalid. Off by default, set with PILOT_CDS_VALIDATE=1.
+	cdsValidate = os.Getenv("PILOT_CDS_VALIDATE") == "1"
+
+	// cdsInvalidClustersFail fails the generation on invalid clusters, which envoy would NACK
+	// with the whole response, instead of dropping them. Set with
+	// PILOT_CDS_INVALID_CLUSTERS=fail, the default is drop.
+	cdsInvalidClustersFail = os.Getenv("PILOT_CDS_INVALID_CLUSTERS") == "fail"
+)
+
+// ClusterGenerator generates clusters for a node. core.ConfigGenerator implements it.
+// The generation is abandoned if ctx is cancelled, for example when the proxy disconnects.
+type ClusterGenerator interface {
+	BuildClusters(ctx context.Context, env model.Environment, node model.Proxy) ([]*xdsapi.Cluster, error)
+}
+
+// ClusterPostProcessor returns the clusters for the node, adjusted. The clusters may be shared
+// with other connections and must not be modified: changed clusters are returned as copies.
+// A nil result means no clusters.
+type ClusterPostProcessor func(clusters []*xdsapi.Cluster, node *model.Proxy) []*xdsapi.Cluster
+
+// postProcessClusters applies the ClusterPostProcessors to the clusters of the node.
+func (s *DiscoveryServer) postProcessClusters(clusters []*xdsapi.Cluster, node *model.Proxy) []*xdsapi.Cluster {
+	for _, p := range s.ClusterPostProcessors {
+		clusters = p(clusters, node)
+		if clusters == nil {
+			clusters = []*xdsapi.Cluster{}
+		}
+	}
+	return clusters
+}
+
+// nodeClusters returns the clusters of a proxy, before the subscription of its stream:
+// generated for the node and profile (shared in the cluster cache, with retries), replaced by
+// the last-known-good clusters of the node id in safe mode, with the ClusterAliases in their
+// migration window, post-processed, filtered for the network and ordered. CDS streams and FetchClusters both use it, so a polling envoy gets the
+// clusters and version of a streaming one. safe is set if the last-known-good clusters are
+// returned. keepGood records the clusters as the last-known-good of the node id, for the
+// streams: safe mode forgets them when the node disconnects.
+func (s *DiscoveryServer) nodeClusters(ctx context.Context, nodeID string, node *model.Proxy, network string,
+	profile *GenerationProfile, keepGood bool) (clusters []*xdsapi.Cluster, safe bool, err error) {
+	// Timed and counted in flight for the pushes and the fetches alike.
+	start := time.Now()
+	atomic.AddInt32(&cdsGenerationsInFlight, 1)
+	clusters, err = s.generateClusters(ctx, *node, profile)
+	atomic.AddInt32(&cdsGenerationsInFlight, -1)
+	cdsGenerationTime.Observe(time.Since(start).Seconds())
+	if err != nil && ctx.Err() != nil {
+		return nil, false, err
+	}
+	if err != nil {
+		cdsGenerationFailuresCounter.Inc()
+	}
+	if cdsSafeMode.enabled() {
+		lastGood := cdsSafeMode.lastKnownGood(nodeID)
+		if err == nil && (len(clusters) > 0 || len(lastGood) == 0) {
+			if keepGood {
+				cdsSafeMode.recordSuccess(nodeID, clusters)
+			}
+		} else {
+			// Failed, or empty for a node that had clusters: keep the config the envoy has,
+			// or serve the last-known-good clusters in safe mode.
+			if !cdsSafeMode.recordFailure() || lastGood == nil {
+				if err == nil {
+					err = errCdsGeneration
+				}
+				return nil, false, err
+			}
+			clusters, safe, err = lastGood, true, nil
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return s.proxyClusters(clusters, node, network, profile), safe, nil
+}
+
+// proxyClusters returns the generated clusters as pushed to a proxy of the network, before
+// the subscription of its stream: with the ClusterAliases in their migration window,
+// post-processed, filtered for the network and ordered.
+func (s *DiscoveryServer) proxyClusters(clusters []*xdsapi.Cluster, node *model.Proxy, network string,
+	profile *GenerationProfile) []*xdsapi.Cluster {
+	// A copy: the generated clusters are shared with the cache and the other connections.
+	clusters = append(make([]*xdsapi.Cluster, 0, len(clusters)+len(s.ClusterAliases)), clusters...)
+	clusters = s.addClusterAliases(clusters, time.Now())
+	clusters = s.postProcessClusters(clusters, node)
+	clusters = filterByNetwork(network, clusters)
+	if clusters == nil {
+		// Generators may return nil for 'no clusters', treat it the same as an empty list.
+		clusters = []*xdsapi.Cluster{}
+	}
+	return s.orderClusters(clusters, profile)
+}
+
+// buildClusters returns the clusters of the ConfigGenerator merged with the ClusterSources,
+// for a proxy with the profile.
+// Invalid clusters are dropped, or fail the generation with cdsInvalidClustersFail. Generation
+// warnings (replaced clusters) are logged, or fail the generation in strict mode.
+func (s *DiscoveryServer) buildClusters(ctx context.Context, node model.Proxy,
+	profile *GenerationProfile) ([]*xdsapi.Cluster, error) {
+	clusters, warnings, err := s.mergeClusters(ctx, node)
+	if err != nil {
+		return clusters, err
+	}
+	// A new slice: the generator may share its clusters with other calls.
+	valid := make([]*xdsapi.Cluster, 0, len(clusters))
+	var invalid []string
+	for _, c := range clusters {
+		if reason := invalidCluster(c, profile.validate()); reason != "" {
+			invalid = append(invalid, reason)
+			cdsInvalidClustersCounter.Inc()
+			continue
+		}
+		valid = append(valid, c)
+	}
+	if len(invalid) > 0 {
+		if cdsInvalidClustersFail {
+			return nil, fmt.Errorf("invalid clusters: %s", strings.Join(invalid, "; "))
+		}
+		log.Warnf("CDS: invalid clusters dropped for %s: %s", node.ID, strings.Join(invalid, "; "))
+	}
+	if len(warnings) > 0 {
+		if cdsStrict {
+			return nil, fmt.Errorf("strict mode: %s", strings.Join(warnings, "; "))
+		}
+		log.Warnf("CDS: generation warnings for %s: %s", node.ID, strings.Join(warnings, "; "))
+	}
+	return valid, nil
+}
+
+// invalidCluster returns why envoy would reject the cluster, empty if it is valid: nil,
+// without name, with an unknown discovery type, or failing the proto validation if validate
+// is set.
+func invalidCluster(c *xdsapi.Cluster, validate bool) string {
+	switch {
+	case c == nil:
+		return "nil cluster"
+	case c.Name == "":
+		return "cluster without name"
+	}
+	if _, found := xdsapi.Cluster_DiscoveryType_name[int32(c.Type)]; !found {
+		return fmt.Sprintf("cluster %q with unknown discovery type %d", c.Name, c.Type)
+	}
+	if validate {
+		if err := c.Validate(); err != nil {
+			return fmt.Sprintf("cluster %q: %v", c.Name, err)
+		}
+	}
+	return ""
+}
+
+// generatorClusters returns the clusters of the ConfigGenerator for the node, timing the call.
+func (s *DiscoveryServer) generatorClusters(ctx context.Context, node model.Proxy) ([]*xdsapi.Cluster, error) {
+	start := time.Now()
+	clusters, err := s.ConfigGenerator.BuildClusters(ctx, s.env, node)
+	cdsBuildClustersTime.Observe(time.Since(start).Seconds())
+	return clusters, err
+}
+
+// mergeClusters merges the clusters of the ConfigGenerator and the ClusterSources, and
+// returns the warnings for clusters replaced by a later source.
+func (s *DiscoveryServer) mergeClusters(ctx context.Context, node model.Proxy) ([]*xdsapi.Cluster, []string, error) {
+	clusters, err := s.generatorClusters(ctx, node)
+	if err != nil || len(s.ClusterSources) == 0 {
+		return clusters, nil, err
+	}
+	var warnings []string
+	// index of each cluster in the merged list, by name
+	index := make(map[string]int, len(clusters))
+	merged := make([]*xdsapi.Cluster, 0, len(clusters))
+	add := func(source int, c *xdsapi.Cluster) error {
+		if c == nil {
+			return nil
+		}
+		if i, found := index[c.Name]; found {
+			if s.RejectClusterConflicts {
+				return fmt.Errorf("cluster %q from source %d conflicts with a previous source", c.Name, source)
+			}
+			warnings = append(warnings, fmt.Sprintf("cluster %q replaced by source %d", c.Name, source))
+			merged[i] = c
+			return nil
+		}
+		index[c.Name] = len(merged)
+		merged = append(merged, c)
+		return nil
+	}
+	for _, c := range clusters {
+		if err := add(0, c); err != nil {
+			return nil, nil, err
+		}
+	}
+	for i, source := range s.ClusterSources {
+		clusters, err := source.BuildClusters(ctx, s.env, node)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, c := range clusters {
+			if err := add(i+1, c); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return merged, warnings, nil
+}
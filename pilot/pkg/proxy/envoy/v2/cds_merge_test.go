@@ -0,0 +1,277 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestBuildClustersMerge(t *testing.T) {
+	external := newFakeGenerator()
+	external.set(
+		&xdsapi.Cluster{Name: "b", ConnectTimeout: 2 * time.Second},
+		&xdsapi.Cluster{Name: "c", ConnectTimeout: time.Second})
+	s := newTestServer(newFakeGenerator("a", "b"))
+	s.ClusterSources = []ClusterGenerator{external}
+
+	clusters, err := s.buildClusters(context.Background(), model.Proxy{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, c := range clusters {
+		got = append(got, c.Name)
+	}
+	if len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Fatalf("merged clusters %v, want [a b c]", got)
+	}
+	if clusters[1].ConnectTimeout != 2*time.Second {
+		t.Errorf("conflicting cluster b from %v, want the later source to win", clusters[1].ConnectTimeout)
+	}
+
+	s.RejectClusterConflicts = true
+	if _, err := s.buildClusters(context.Background(), model.Proxy{}, nil); err == nil {
+		t.Error("conflicting cluster b was accepted with RejectClusterConflicts")
+	}
+}
+
+func TestBuildClustersStrict(t *testing.T) {
+	defer func() { cdsStrict = false }()
+
+	g := newFakeGenerator("a", "b")
+	s := newTestServer(g)
+	s.ClusterSources = []ClusterGenerator{newFakeGenerator("b")}
+
+	cdsStrict = false
+	if _, err := s.buildClusters(context.Background(), model.Proxy{}, nil); err != nil {
+		t.Errorf("replaced cluster failed the generation without strict mode: %v", err)
+	}
+	cdsStrict = true
+	if _, err := s.buildClusters(context.Background(), model.Proxy{}, nil); err == nil {
+		t.Error("replaced cluster didn't fail the generation in strict mode")
+	}
+
+	// Invalid clusters are dropped, whether strict or not.
+	s.ClusterSources = nil
+	g.set(&xdsapi.Cluster{Name: "a"}, nil)
+	if clusters, err := s.buildClusters(context.Background(), model.Proxy{}, nil); err != nil || len(clusters) != 1 {
+		t.Errorf("got %d clusters, %v in strict mode, want the valid cluster", len(clusters), err)
+	}
+}
+
+func TestNodeClustersAliases(t *testing.T) {
+	const (
+		oldName = "outbound|80||reviews.default.svc.cluster.local"
+		newName = "outbound|80|v1|reviews.default.svc.cluster.local"
+	)
+	g := newFakeGenerator()
+	g.set(&xdsapi.Cluster{Name: newName, ConnectTimeout: time.Second,
+		EdsClusterConfig: &xdsapi.Cluster_EdsClusterConfig{}})
+	s := newTestServer(g)
+	s.ClusterAliases = []ClusterAlias{
+		{OldName: oldName, NewName: newName, Until: time.Now().Add(time.Hour)},
+		{OldName: "expired", NewName: newName, Until: time.Now().Add(-time.Hour)},
+		{OldName: "missing", NewName: "not generated", Until: time.Now().Add(time.Hour)},
+	}
+
+	clusters, _, err := s.nodeClusters(context.Background(), testNodeID, &model.Proxy{}, "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 || clusters[0].Name != newName || clusters[1].Name != oldName {
+		t.Fatalf("got %v, want both %s and %s during the migration", clusters, newName, oldName)
+	}
+	if got := clusters[1].EdsClusterConfig.ServiceName; got != newName {
+		t.Errorf("alias watches EDS for %q, want %q", got, newName)
+	}
+	if clusters[0].EdsClusterConfig.ServiceName != "" {
+		t.Error("cluster modified by its alias")
+	}
+
+	// After the window only the new name is pushed.
+	s.ClusterAliases[0].Until = time.Now().Add(-time.Second)
+	clusters, _, err = s.nodeClusters(context.Background(), testNodeID, &model.Proxy{}, "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 1 || clusters[0].Name != newName {
+		t.Errorf("got %v after the migration window, want only %s", clusters, newName)
+	}
+}
+
+func TestCdsAliasExpiresWithWarmCache(t *testing.T) {
+	const (
+		oldName = "outbound|80||reviews.default.svc.cluster.local"
+		newName = "outbound|80|v1|reviews.default.svc.cluster.local"
+	)
+	withClusterCache(true, func() {
+		g := newFakeGenerator(newName)
+		s := newTestServer(g)
+		s.ClusterAliases = []ClusterAlias{{OldName: oldName, NewName: newName, Until: time.Now().Add(300 * time.Millisecond)}}
+		stream := newFakeStream("10.1.1.1:5000")
+		done := startClusterStream(s, stream)
+		defer func() {
+			stream.close()
+			_ = waitStreamDone(t, done)
+		}()
+
+		stream.sendRequest(clusterRequest(testNodeID))
+		if got := clusterNames(t, stream.recvResponse(t)); !reflect.DeepEqual(got, []string{newName, oldName}) {
+			t.Fatalf("got %v during the migration, want %s and %s", got, newName, oldName)
+		}
+		calls := g.callCount()
+
+		// The end of the window pushes the clusters without the alias, without a config
+		// change clearing the cache.
+		if got := clusterNames(t, stream.recvResponse(t)); !reflect.DeepEqual(got, []string{newName}) {
+			t.Errorf("got %v after the migration window, want only %s", got, newName)
+		}
+		if n := g.callCount(); n != calls {
+			t.Errorf("%d generations after the window, want the cached clusters", n-calls)
+		}
+	})
+}
+
+func TestBuildClustersValidate(t *testing.T) {
+	defer func() { cdsValidate = false }()
+
+	g := newFakeGenerator()
+	g.set(
+		&xdsapi.Cluster{Name: "a", ConnectTimeout: time.Second},
+		// Envoy requires a connect timeout.
+		&xdsapi.Cluster{Name: "no-timeout"},
+		&xdsapi.Cluster{Name: "bad-lb", ConnectTimeout: time.Second, LbPolicy: xdsapi.Cluster_LbPolicy(42)})
+	s := newTestServer(g)
+
+	cdsValidate = false
+	if clusters, _ := s.buildClusters(context.Background(), model.Proxy{}, nil); len(clusters) != 3 {
+		t.Errorf("got %d clusters without validation, want 3", len(clusters))
+	}
+
+	cdsValidate = true
+	clusters, err := s.buildClusters(context.Background(), model.Proxy{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 1 || clusters[0].Name != "a" {
+		t.Errorf("got %v, want only the valid cluster a", clusters)
+	}
+}
+
+func TestCdsInvalidClustersDropped(t *testing.T) {
+	defer func() { cdsInvalidClustersFail = false }()
+
+	g := newFakeGenerator()
+	g.set(
+		&xdsapi.Cluster{Name: "a", ConnectTimeout: time.Second},
+		&xdsapi.Cluster{ConnectTimeout: time.Second},
+		&xdsapi.Cluster{Name: "bad-type", ConnectTimeout: time.Second, Type: xdsapi.Cluster_DiscoveryType(42)},
+		&xdsapi.Cluster{Name: "b", ConnectTimeout: time.Second})
+	s := newTestServer(g)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+
+	// The invalid clusters don't poison the push.
+	invalid := counterValue(t, cdsInvalidClustersCounter)
+	stream.sendRequest(clusterRequest(testNodeID))
+	if got := clusterNames(t, stream.recvResponse(t)); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("got clusters %v, want the valid clusters a, b", got)
+	}
+	if n := counterValue(t, cdsInvalidClustersCounter) - invalid; n != 2 {
+		t.Errorf("counted %v invalid clusters, want 2", n)
+	}
+
+	// With PILOT_CDS_INVALID_CLUSTERS=fail they fail the push: the envoy keeps its config.
+	cdsInvalidClustersFail = true
+	sent := stream.sendCount()
+	cdsPushAll(nil)
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if stream.sendCount() != sent {
+			t.Fatal("invalid clusters pushed with PILOT_CDS_INVALID_CLUSTERS=fail")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCdsPostProcessors(t *testing.T) {
+	g := newFakeGenerator("outbound|80||a.default.svc.cluster.local", "outbound|80||b.default.svc.cluster.local")
+	s := newTestServer(g)
+	var nodes []string
+	rename := func(clusters []*xdsapi.Cluster, node *model.Proxy) []*xdsapi.Cluster {
+		nodes = append(nodes, node.ID)
+		out := make([]*xdsapi.Cluster, 0, len(clusters))
+		for _, c := range clusters {
+			if c.Name == "outbound|80||a.default.svc.cluster.local" {
+				renamed := *c
+				renamed.Name = "outbound|80||renamed.default.svc.cluster.local"
+				c = &renamed
+			}
+			out = append(out, c)
+		}
+		return out
+	}
+	// Applied in order: the second processor sees the renamed cluster.
+	var seen []string
+	record := func(clusters []*xdsapi.Cluster, _ *model.Proxy) []*xdsapi.Cluster {
+		for _, c := range clusters {
+			seen = append(seen, c.Name)
+		}
+		return clusters
+	}
+	s.ClusterPostProcessors = []ClusterPostProcessor{rename, record}
+
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	got := clusterNames(t, stream.recvResponse(t))
+	want := []string{"outbound|80||b.default.svc.cluster.local", "outbound|80||renamed.default.svc.cluster.local"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got clusters %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(seen, []string{"outbound|80||renamed.default.svc.cluster.local",
+		"outbound|80||b.default.svc.cluster.local"}) {
+		t.Errorf("second processor got %v, want the renamed clusters", seen)
+	}
+	if len(nodes) != 1 || nodes[0] != "app-644fc65469-96dza.testns" {
+		t.Errorf("processor called for nodes %v", nodes)
+	}
+	// The generated clusters are not modified.
+	if clusters, _ := g.BuildClusters(context.Background(), s.env, model.Proxy{}); clusters[0].Name != "outbound|80||a.default.svc.cluster.local" {
+		t.Errorf("generated cluster renamed to %s", clusters[0].Name)
+	}
+
+	// A nil result is no clusters.
+	s.ClusterPostProcessors = []ClusterPostProcessor{func([]*xdsapi.Cluster, *model.Proxy) []*xdsapi.Cluster { return nil }}
+	cdsPushAll(nil)
+	if resp := stream.recvResponse(t); len(resp.Resources) != 0 {
+		t.Errorf("got %d clusters from a nil post-processor, want 0", len(resp.Resources))
+	}
+}
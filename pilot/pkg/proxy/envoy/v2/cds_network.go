@@ -0,0 +1,73 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+)
+
+// Multi-network support: a proxy only gets the clusters reachable from its network.
+// The network of a proxy is set in the node metadata. Clusters are tagged with their
+// network in the "istio" filter metadata; untagged clusters are reachable from all networks.
+
+const (
+	// nodeNetworkMetadata is the node metadata key holding the network of the proxy.
+	nodeNetworkMetadata = "ISTIO_NETWORK"
+
+	// clusterMetadataFilter is the filter metadata namespace of the cluster network.
+	clusterMetadataFilter = "istio"
+
+	// clusterNetworkMetadata is the key of the cluster network, in clusterMetadataFilter.
+	clusterNetworkMetadata = "network"
+)
+
+// nodeNetwork returns the network of the node, or "" if not set.
+func nodeNetwork(node *core.Node) string {
+	if node == nil || node.Metadata == nil {
+		return ""
+	}
+	return node.Metadata.Fields[nodeNetworkMetadata].GetStringValue()
+}
+
+// clusterNetwork returns the network of the cluster, or "" if reachable from all networks.
+func clusterNetwork(c *xdsapi.Cluster) string {
+	if c.Metadata == nil {
+		return ""
+	}
+	m := c.Metadata.FilterMetadata[clusterMetadataFilter]
+	if m == nil {
+		return ""
+	}
+	return m.Fields[clusterNetworkMetadata].GetStringValue()
+}
+
+// filterByNetwork removes the clusters not reachable from the network. Proxies without a
+// network get all clusters.
+func filterByNetwork(network string, clusters []*xdsapi.Cluster) []*xdsapi.Cluster {
+	if network == "" {
+		return clusters
+	}
+	out := make([]*xdsapi.Cluster, 0, len(clusters))
+	for _, c := range clusters {
+		if c == nil {
+			continue
+		}
+		if n := clusterNetwork(c); n == "" || n == network {
+			out = append(out, c)
+		}
+	}
+	return out
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/gogo/protobuf/types"
+)
+
+func networkCluster(name, network string) *xdsapi.Cluster {
+	c := &xdsapi.Cluster{Name: name, ConnectTimeout: time.Second}
+	if network != "" {
+		c.Metadata = &core.Metadata{FilterMetadata: map[string]*types.Struct{
+			clusterMetadataFilter: {Fields: map[string]*types.Value{
+				clusterNetworkMetadata: {Kind: &types.Value_StringValue{StringValue: network}},
+			}},
+		}}
+	}
+	return c
+}
+
+func networkRequest(nodeID, network string) *xdsapi.DiscoveryRequest {
+	req := clusterRequest(nodeID)
+	if network != "" {
+		req.Node.Metadata = &types.Struct{Fields: map[string]*types.Value{
+			nodeNetworkMetadata: {Kind: &types.Value_StringValue{StringValue: network}},
+		}}
+	}
+	return req
+}
+
+func TestCdsNetworkFilter(t *testing.T) {
+	g := newFakeGenerator()
+	g.set(networkCluster("all", ""), networkCluster("net1", "network1"), networkCluster("net2", "network2"))
+	s := newTestServer(g)
+
+	cases := []struct {
+		node    string
+		network string
+		want    []string
+	}{
+		{"sidecar~10.1.1.1~a.ns~ns.svc.cluster.local", "network1", []string{"all", "net1"}},
+		{"sidecar~10.1.1.2~b.ns~ns.svc.cluster.local", "network2", []string{"all", "net2"}},
+		{"sidecar~10.1.1.3~c.ns~ns.svc.cluster.local", "", []string{"all", "net1", "net2"}},
+	}
+	for _, c := range cases {
+		stream := newFakeStream("10.1.1.1:5000")
+		done := startClusterStream(s, stream)
+		stream.sendRequest(networkRequest(c.node, c.network))
+		if got := clusterNames(t, stream.recvResponse(t)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s on %q got clusters %v, want %v", c.node, c.network, got, c.want)
+		}
+
+		key := waitCdsCon(t, c.node)
+		status := map[string]struct{ Network string }{}
+		if err := json.Unmarshal(cdsz("").Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if status[key].Network != c.network {
+			t.Errorf("Cdsz network for %s is %q, want %q", key, status[key].Network, c.network)
+		}
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}
+}
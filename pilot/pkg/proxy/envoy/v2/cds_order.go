@@ -0,0 +1,117 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+
+	"istio.io/istio/pkg/log"
+)
+
+const (
+	// clusterOrderAlphabetical sorts the clusters of a response by name. This is the default.
+	clusterOrderAlphabetical = "alphabetical"
+
+	// clusterOrderGeneration keeps the clusters in the order returned by the generator.
+	clusterOrderGeneration = "generation"
+
+	// clusterCriticalMetadata marks a critical cluster, when set to true in clusterMetadataFilter.
+	clusterCriticalMetadata = "critical"
+)
+
+var (
+	// cdsClusterOrder is the order of the clusters in CDS responses, set with PILOT_CDS_ORDER.
+	// DiscoveryServer.ClusterLess overrides it.
+	cdsClusterOrder = clusterOrderFromEnv()
+
+	// cdsCriticalPrefixes are the name prefixes of the critical clusters, for example the
+	// control plane, set as a comma separated list in PILOT_CDS_CRITICAL_PREFIXES. Critical
+	// clusters are first in the responses, so they are applied first by envoys processing
+	// large responses incrementally.
+	cdsCriticalPrefixes = criticalPrefixesFromEnv()
+)
+
+func criticalPrefixesFromEnv() []string {
+	out := []string{}
+	for _, p := range strings.Split(os.Getenv("PILOT_CDS_CRITICAL_PREFIXES"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func clusterOrderFromEnv() string {
+	order := os.Getenv("PILOT_CDS_ORDER")
+	switch order {
+	case "":
+		return clusterOrderAlphabetical
+	case clusterOrderAlphabetical, clusterOrderGeneration:
+		return order
+	}
+	log.Warnf("Invalid PILOT_CDS_ORDER %q, using %s", order, clusterOrderAlphabetical)
+	return clusterOrderAlphabetical
+}
+
+// orderClusters sorts the clusters for a response, using the ClusterLess hook if set and
+// the order of the profile otherwise, then moves the critical clusters first. Nil clusters are
+// removed. The slice is reordered in place.
+func (s *DiscoveryServer) orderClusters(clusters []*xdsapi.Cluster, profile *GenerationProfile) []*xdsapi.Cluster {
+	out := clusters[:0]
+	for _, c := range clusters {
+		if c != nil {
+			out = append(out, c)
+		}
+	}
+	switch {
+	case s.ClusterLess != nil:
+		sort.SliceStable(out, func(i, j int) bool {
+			return s.ClusterLess(out[i], out[j])
+		})
+	case profile.order() == clusterOrderAlphabetical:
+		sort.SliceStable(out, func(i, j int) bool {
+			return out[i].Name < out[j].Name
+		})
+	}
+	return criticalFirst(out)
+}
+
+// isCriticalCluster returns true if the cluster name has a critical prefix, or the cluster is
+// marked critical in its metadata.
+func isCriticalCluster(c *xdsapi.Cluster) bool {
+	for _, p := range cdsCriticalPrefixes {
+		if strings.HasPrefix(c.Name, p) {
+			return true
+		}
+	}
+	if c.Metadata == nil {
+		return false
+	}
+	m := c.Metadata.FilterMetadata[clusterMetadataFilter]
+	return m != nil && m.Fields[clusterCriticalMetadata].GetBoolValue()
+}
+
+// criticalFirst moves the critical clusters ahead of the others, keeping the order within
+// each group.
+func criticalFirst(clusters []*xdsapi.Cluster) []*xdsapi.Cluster {
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return isCriticalCluster(clusters[i]) && !isCriticalCluster(clusters[j])
+	})
+	return clusters
+}
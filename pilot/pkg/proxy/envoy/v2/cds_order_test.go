@@ -0,0 +1,96 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/gogo/protobuf/types"
+)
+
+func TestOrderClusters(t *testing.T) {
+	oldOrder := cdsClusterOrder
+	defer func() { cdsClusterOrder = oldOrder }()
+
+	// Reverse alphabetical, to check the custom hook.
+	reverse := func(a, b *xdsapi.Cluster) bool { return a.Name > b.Name }
+	// Local clusters first, keeping the generation order otherwise.
+	localFirst := func(a, b *xdsapi.Cluster) bool {
+		return strings.HasPrefix(a.Name, "local") && !strings.HasPrefix(b.Name, "local")
+	}
+
+	cases := []struct {
+		order string
+		less  func(a, b *xdsapi.Cluster) bool
+		want  []string
+	}{
+		{clusterOrderAlphabetical, nil, []string{"a", "b", "local-c", "local-d"}},
+		{clusterOrderGeneration, nil, []string{"b", "local-d", "a", "local-c"}},
+		{clusterOrderAlphabetical, reverse, []string{"local-d", "local-c", "b", "a"}},
+		{clusterOrderAlphabetical, localFirst, []string{"local-d", "local-c", "b", "a"}},
+	}
+	for _, c := range cases {
+		cdsClusterOrder = c.order
+		s := newTestServer(newFakeGenerator())
+		s.ClusterLess = c.less
+		clusters := []*xdsapi.Cluster{{Name: "b"}, {Name: "local-d"}, nil, {Name: "a"}, {Name: "local-c"}}
+
+		got := []string{}
+		for _, cl := range s.orderClusters(clusters, nil) {
+			got = append(got, cl.Name)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("order %s with hook %v: got %v, want %v", c.order, c.less != nil, got, c.want)
+		}
+	}
+}
+
+func TestOrderClustersCriticalFirst(t *testing.T) {
+	oldOrder, oldPrefixes := cdsClusterOrder, cdsCriticalPrefixes
+	cdsClusterOrder = clusterOrderAlphabetical
+	cdsCriticalPrefixes = []string{"outbound|15010||"}
+	defer func() { cdsClusterOrder, cdsCriticalPrefixes = oldOrder, oldPrefixes }()
+
+	critical := &xdsapi.Cluster{Name: "outbound|80||zipkin.istio-system.svc.cluster.local",
+		Metadata: &core.Metadata{FilterMetadata: map[string]*types.Struct{
+			clusterMetadataFilter: {Fields: map[string]*types.Value{
+				clusterCriticalMetadata: {Kind: &types.Value_BoolValue{BoolValue: true}},
+			}},
+		}}}
+	clusters := []*xdsapi.Cluster{
+		{Name: "outbound|80||a.default.svc.cluster.local"},
+		critical,
+		{Name: "outbound|15010||istio-pilot.istio-system.svc.cluster.local"},
+		{Name: "inbound|80||b.default.svc.cluster.local"},
+	}
+
+	got := []string{}
+	for _, c := range newTestServer(newFakeGenerator()).orderClusters(clusters, nil) {
+		got = append(got, c.Name)
+	}
+	want := []string{
+		"outbound|15010||istio-pilot.istio-system.svc.cluster.local",
+		"outbound|80||zipkin.istio-system.svc.cluster.local",
+		"inbound|80||b.default.svc.cluster.local",
+		"outbound|80||a.default.svc.cluster.local",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want the critical clusters first %v", got, want)
+	}
+}
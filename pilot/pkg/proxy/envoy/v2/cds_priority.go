@@ -0,0 +1,52 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"strconv"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/log"
+)
+
+// nodePriorityMetadata is the node metadata key with the push priority of the proxy, an
+// integer set by the operator. Higher priorities are pushed first.
+const nodePriorityMetadata = "CDS_PRIORITY"
+
+// Default priorities by proxy type: gateways are pushed before sidecars.
+const (
+	cdsPrioritySidecar = 0
+	cdsPriorityGateway = 10
+)
+
+// nodePriority returns the push priority of the proxy: the one set in the node metadata, or
+// else the default of its type.
+func nodePriority(node *core.Node, proxy model.Proxy) int {
+	if node != nil && node.Metadata != nil {
+		if v := node.Metadata.Fields[nodePriorityMetadata].GetStringValue(); v != "" {
+			p, err := strconv.Atoi(v)
+			if err == nil {
+				return p
+			}
+			log.Warnf("CDS: invalid %s %q for %s, using the default", nodePriorityMetadata, v, node.Id)
+		}
+	}
+	if proxy.Type == model.Ingress || proxy.Type == model.Router {
+		return cdsPriorityGateway
+	}
+	return cdsPrioritySidecar
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// nodeProfileMetadata is the node metadata key selecting the generation profile of the proxy.
+const nodeProfileMetadata = "CDS_PROFILE"
+
+// GenerationProfile tunes the cluster generation for a class of proxies, for example
+// latency-sensitive gateways and bulk sidecars. The zero values keep the server settings.
+type GenerationProfile struct {
+	// Validate drops the clusters failing the proto validation, as PILOT_CDS_VALIDATE=1.
+	Validate bool
+
+	// Order is the order of the clusters in the responses, "alphabetical" or "generation".
+	// Empty uses PILOT_CDS_ORDER. DiscoveryServer.ClusterLess takes precedence.
+	Order string
+
+	// MaxPushesPerMinute limits the pushes to each connection, as PILOT_CDS_MAX_PUSHES_PER_MINUTE.
+	MaxPushesPerMinute int
+}
+
+// generationProfile returns the profile of the proxy: the one named in the node metadata, or
+// else the one named after the proxy type. Nil if none is configured, using the server settings.
+func (s *DiscoveryServer) generationProfile(node *core.Node, proxy model.Proxy) *GenerationProfile {
+	if len(s.GenerationProfiles) == 0 {
+		return nil
+	}
+	if node != nil && node.Metadata != nil {
+		if name := node.Metadata.Fields[nodeProfileMetadata].GetStringValue(); name != "" {
+			if p := s.GenerationProfiles[name]; p != nil {
+				return p
+			}
+		}
+	}
+	return s.GenerationProfiles[string(proxy.Type)]
+}
+
+func (p *GenerationProfile) validate() bool {
+	return cdsValidate || (p != nil && p.Validate)
+}
+
+func (p *GenerationProfile) order() string {
+	if p == nil || p.Order == "" {
+		return cdsClusterOrder
+	}
+	return p.Order
+}
+
+func (p *GenerationProfile) maxPushesPerMinute() int {
+	if p == nil || p.MaxPushesPerMinute == 0 {
+		return cdsMaxPushesPerMinute
+	}
+	return p.MaxPushesPerMinute
+}
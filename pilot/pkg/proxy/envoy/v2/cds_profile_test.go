@@ -0,0 +1,62 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/gogo/protobuf/types"
+)
+
+func TestCdsGenerationProfiles(t *testing.T) {
+	g := newFakeGenerator()
+	g.set(
+		&xdsapi.Cluster{Name: "b", ConnectTimeout: time.Second},
+		// Invalid, without connect timeout.
+		&xdsapi.Cluster{Name: "c"},
+		&xdsapi.Cluster{Name: "a", ConnectTimeout: time.Second})
+	s := newTestServer(g)
+	s.GenerationProfiles = map[string]*GenerationProfile{
+		"router":   {Validate: true, Order: clusterOrderGeneration},
+		"validate": {Validate: true},
+	}
+
+	profileRequest := clusterRequest("sidecar~10.1.1.2~reviews-v1.ns~ns.svc.cluster.local")
+	profileRequest.Node.Metadata = &types.Struct{Fields: map[string]*types.Value{
+		nodeProfileMetadata: {Kind: &types.Value_StringValue{StringValue: "validate"}},
+	}}
+	cases := []struct {
+		name string
+		req  *xdsapi.DiscoveryRequest
+		want []string
+	}{
+		{"default", clusterRequest("sidecar~10.1.1.1~ratings-v1.ns~ns.svc.cluster.local"), []string{"a", "b", "c"}},
+		{"metadata", profileRequest, []string{"a", "b"}},
+		{"proxy type", clusterRequest("router~10.1.1.3~gateway.ns~ns.svc.cluster.local"), []string{"b", "a"}},
+	}
+	for _, c := range cases {
+		stream := newFakeStream("10.1.1.1:5000")
+		done := startClusterStream(s, stream)
+		stream.sendRequest(c.req)
+		if got := clusterNames(t, stream.recvResponse(t)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s profile: got %v, want %v", c.name, got, c.want)
+		}
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}
+}
@@ -0,0 +1,405 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/gogo/protobuf/types"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// addTestCdsCons registers n connections that are not backed by a stream, and returns
+// them with a function removing them.
+func addTestCdsCons(s *DiscoveryServer, n int) ([]*CdsConnection, func()) {
+	cons := make([]*CdsConnection, 0, n)
+	for i := 0; i < n; i++ {
+		con := &CdsConnection{pushChannel: make(chan bool, 1)}
+		key := fmt.Sprintf("%s-test%d", testNodeID, i)
+		_ = s.addCdsCon(key, con)
+		cons = append(cons, con)
+	}
+	return cons, func() {
+		for _, con := range cons {
+			s.removeCdsCon(con)
+		}
+	}
+}
+
+func TestCdsPushFairness(t *testing.T) {
+	s := newTestServer(newFakeGenerator())
+	cons, cleanup := addTestCdsCons(s, 4)
+	defer cleanup()
+
+	// Under continuous pushes, each connection must be served first within len(cons) rounds.
+	first := map[*CdsConnection]int{}
+	for round := 0; round < len(cons); round++ {
+		list := cdsPushList()
+		if len(list) != len(cons) {
+			t.Fatalf("round %d: got %d connections, want %d", round, len(list), len(cons))
+		}
+		first[list[0]]++
+	}
+	for i, con := range cons {
+		if first[con] != 1 {
+			t.Errorf("connection %d was served first %d times in %d rounds, want 1", i, first[con], len(cons))
+		}
+	}
+
+	// Every round reaches all connections.
+	for round := 0; round < len(cons); round++ {
+		cdsPushAll(nil)
+		for i, con := range cons {
+			select {
+			case <-con.pushChannel:
+			default:
+				t.Fatalf("round %d: connection %d was not pushed", round, i)
+			}
+		}
+	}
+}
+
+func TestCdsMaxPushRate(t *testing.T) {
+	oldMax, oldWindow := cdsMaxPushesPerMinute, cdsPushRateWindow
+	cdsMaxPushesPerMinute, cdsPushRateWindow = 2, 200*time.Millisecond
+	defer func() { cdsMaxPushesPerMinute, cdsPushRateWindow = oldMax, oldWindow }()
+
+	g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+	s := newTestServer(g)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	waitCdsCon(t, testNodeID)
+
+	for i := 0; i < 10; i++ {
+		if i == 9 {
+			g.setClusters("outbound|80||final.default.svc.cluster.local")
+		}
+		cdsPushAll(nil)
+	}
+
+	// 2 pushes in the first window, then the coalesced rest.
+	pushes := stream.recvAll(2 * cdsPushRateWindow)
+	if len(pushes) == 0 || len(pushes) > 3 {
+		t.Fatalf("got %d pushes, want 1 to 3", len(pushes))
+	}
+	last := pushes[len(pushes)-1]
+	if names := clusterNames(t, last); len(names) != 1 || names[0] != "outbound|80||final.default.svc.cluster.local" {
+		t.Errorf("last push has clusters %v, want the final state", names)
+	}
+}
+
+func TestCdsPushLoop(t *testing.T) {
+	defer resendUnchanged()()
+	oldCount := cdsPushLoopCount
+	cdsPushLoopCount = 3
+	defer func() { cdsPushLoopCount = oldCount }()
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+
+	out := captureLog(t, func() {
+		done := startClusterStream(s, stream)
+		stream.sendRequest(clusterRequest(testNodeID))
+		stream.recvResponse(t)
+		waitCdsCon(t, testNodeID)
+		// Identical content, pushed again and again.
+		for i := 0; i < 2; i++ {
+			cdsPushAll(nil)
+			stream.recvResponse(t)
+		}
+		stream.close()
+		_ = waitStreamDone(t, done)
+	})
+
+	if !strings.Contains(out, "CDS: push loop") {
+		t.Errorf("push loop was not detected, log:\n%s", out)
+	}
+}
+
+func labelsRequest(nodeID string, labels map[string]string) *xdsapi.DiscoveryRequest {
+	fields := map[string]*types.Value{}
+	for k, v := range labels {
+		fields[k] = &types.Value{Kind: &types.Value_StringValue{StringValue: v}}
+	}
+	req := clusterRequest(nodeID)
+	req.Node.Metadata = &types.Struct{Fields: map[string]*types.Value{
+		nodeLabelsMetadata: {Kind: &types.Value_StructValue{StructValue: &types.Struct{Fields: fields}}},
+	}}
+	return req
+}
+
+func TestCdsPushSelector(t *testing.T) {
+	defer resendUnchanged()()
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	nodes := []struct {
+		id     string
+		labels map[string]string
+	}{
+		{"sidecar~10.1.1.1~reviews-v1.ns~ns.svc.cluster.local", map[string]string{"app": "reviews", "version": "v1"}},
+		{"sidecar~10.1.1.2~ratings-v1.ns~ns.svc.cluster.local", map[string]string{"app": "ratings", "version": "v1"}},
+	}
+	streams := []*fakeStream{}
+	for _, n := range nodes {
+		stream := newFakeStream("10.1.1.1:5000")
+		done := startClusterStream(s, stream)
+		defer func() {
+			stream.close()
+			_ = waitStreamDone(t, done)
+		}()
+		stream.sendRequest(labelsRequest(n.id, n.labels))
+		stream.recvResponse(t)
+		waitCdsCon(t, n.id)
+		streams = append(streams, stream)
+	}
+
+	cdsPushAll(model.Labels{"app": "reviews"})
+	streams[0].recvResponse(t)
+	streams[1].expectNoResponse(t, 50*time.Millisecond)
+
+	cdsPushAll(nil)
+	streams[0].recvResponse(t)
+	streams[1].recvResponse(t)
+}
+
+func TestCdsPushPriority(t *testing.T) {
+	s := newTestServer(newFakeGenerator())
+	cons, cleanup := addTestCdsCons(s, 4)
+	defer cleanup()
+	cons[1].priority = cdsPriorityGateway
+	cons[3].priority = 20
+
+	// The pushes are sent in the list order.
+	for round := 0; round < len(cons); round++ {
+		order := cdsPushList()
+		if len(order) != len(cons) {
+			t.Fatalf("round %d: got %d connections, want %d", round, len(order), len(cons))
+		}
+		if order[0] != cons[3] || order[1] != cons[1] {
+			t.Errorf("round %d: high priority connections not pushed first", round)
+		}
+	}
+}
+
+func TestCdsPushNonBlocking(t *testing.T) {
+	s := newTestServer(newFakeGenerator())
+	cons, cleanup := addTestCdsCons(s, 3)
+	defer cleanup()
+	// The loop of the first connection is stuck, it never drains its push.
+	cons[0].pushChannel <- true
+	queued := counterValue(t, cdsPushQueuedCounter)
+
+	pushed := make(chan struct{})
+	go func() {
+		cdsPushAll(nil)
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+	case <-time.After(testTimeout):
+		t.Fatal("cdsPushAll blocked on a stuck connection")
+	}
+	for i, con := range cons {
+		select {
+		case <-con.pushChannel:
+		default:
+			t.Errorf("connection %d was not pushed", i)
+		}
+	}
+	if n := counterValue(t, cdsPushQueuedCounter); n != queued+1 {
+		t.Errorf("%v connections counted with a push queued, want 1", n-queued)
+	}
+}
+
+func TestEdsLdsPushNonBlocking(t *testing.T) {
+	// The loop of the LDS connection is stuck, it never drains its push.
+	con := &LdsConnection{pushChannel: make(chan struct{}, 1)}
+	if err := addLdsCon(testNodeID, testNodeID, con); err != nil {
+		t.Fatal(err)
+	}
+	defer removeLdsCon(testNodeID, con)
+	con.pushChannel <- struct{}{}
+	queued := counterValue(t, ldsPushQueuedCounter)
+
+	pushed := make(chan struct{})
+	go func() {
+		ldsPushAll()
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+	case <-time.After(testTimeout):
+		t.Fatal("ldsPushAll blocked on a stuck connection")
+	}
+	if n := counterValue(t, ldsPushQueuedCounter); n != queued+1 {
+		t.Errorf("%v LDS connections counted with a push queued, want 1", n-queued)
+	}
+
+	// An EDS connection watching two clusters gets a single push.
+	eds := &EdsConnection{pushChannel: make(chan bool, 1)}
+	queued = counterValue(t, edsPushQueuedCounter)
+	if !eds.signalPush() || eds.signalPush() {
+		t.Error("got the second EDS push queued, want it merged with the first")
+	}
+	if n := counterValue(t, edsPushQueuedCounter); n != queued+1 {
+		t.Errorf("%v EDS pushes counted as already queued, want 1", n-queued)
+	}
+}
+
+func TestCdsCoalescedPushes(t *testing.T) {
+	s := newTestServer(newFakeGenerator())
+	cons, cleanup := addTestCdsCons(s, 1)
+	defer cleanup()
+	con := cons[0]
+	queued := counterValue(t, cdsPushQueuedCounter)
+
+	if !con.signalPush() {
+		t.Fatal("push not queued on an empty channel")
+	}
+	cdsPushAll(nil)
+	con.signalPush()
+	if n := counterValue(t, cdsPushQueuedCounter); n != queued+2 {
+		t.Errorf("push queued counter moved by %v, want 2", n-queued)
+	}
+	view := struct{ CoalescedPushes int }{}
+	w := cdsz("single=1&node=" + url.QueryEscape(testNodeID+"-test0"))
+	if err := json.Unmarshal(w.Body.Bytes(), &view); err != nil {
+		t.Fatal(err)
+	}
+	if view.CoalescedPushes != 2 {
+		t.Errorf("got %d coalesced pushes, want 2", view.CoalescedPushes)
+	}
+}
+
+func TestCdsPushNodes(t *testing.T) {
+	defer resendUnchanged()()
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	nodes := []struct {
+		id  string
+		app string
+	}{
+		{"sidecar~10.1.1.1~reviews-v1.ns1~ns1.svc.cluster.local", "reviews"},
+		{"sidecar~10.1.1.2~ratings-v1.ns2~ns2.svc.cluster.local", "ratings"},
+	}
+	streams := []*fakeStream{}
+	for _, n := range nodes {
+		stream := newFakeStream("10.1.1.1:5000")
+		done := startClusterStream(s, stream)
+		defer func() {
+			stream.close()
+			_ = waitStreamDone(t, done)
+		}()
+		stream.sendRequest(labelsRequest(n.id, map[string]string{"app": n.app}))
+		stream.recvResponse(t)
+		waitCdsCon(t, n.id)
+		streams = append(streams, stream)
+	}
+
+	if n := cdsPushNodes(namespaceFilter("ns1")); n != 1 {
+		t.Errorf("namespace push reached %d connections, want 1", n)
+	}
+	streams[0].recvResponse(t)
+	streams[1].expectNoResponse(t, cdsDebounce+50*time.Millisecond)
+
+	// The same from the debug handler.
+	if w := cdsz("push=1&namespace=ns2"); w.Code != http.StatusOK {
+		t.Errorf("namespace push returned %d", w.Code)
+	}
+	streams[1].recvResponse(t)
+	streams[0].expectNoResponse(t, cdsDebounce+50*time.Millisecond)
+
+	if w := cdsz("push=1&nodeid=" + url.QueryEscape(nodes[0].id)); w.Code != http.StatusOK {
+		t.Errorf("node id push returned %d", w.Code)
+	}
+	streams[0].recvResponse(t)
+	if w := cdsz("push=1&labels=app=ratings"); w.Code != http.StatusOK {
+		t.Errorf("labels push returned %d", w.Code)
+	}
+	streams[1].recvResponse(t)
+
+	if w := cdsz("push=1&namespace=ns3"); w.Code != http.StatusNotFound {
+		t.Errorf("push to a namespace without proxies returned %d, want 404", w.Code)
+	}
+	if w := cdsz("push=1&labels=app"); w.Code != http.StatusBadRequest {
+		t.Errorf("push with invalid labels returned %d, want 400", w.Code)
+	}
+	streams[0].expectNoResponse(t, cdsDebounce+50*time.Millisecond)
+	streams[1].expectNoResponse(t, 0)
+}
+
+func TestCdsPushServices(t *testing.T) {
+	defer resendUnchanged()()
+	const (
+		a = "outbound|80||a.default.svc.cluster.local"
+		b = "outbound|80||b.default.svc.cluster.local"
+	)
+	s := newTestServer(newFakeGenerator(a, b))
+	nodes := []struct {
+		id      string
+		cluster string
+	}{
+		{"sidecar~10.1.1.1~reviews-v1.ns1~ns1.svc.cluster.local", a},
+		{"sidecar~10.1.1.2~ratings-v1.ns2~ns2.svc.cluster.local", b},
+	}
+	streams := []*fakeStream{}
+	for _, n := range nodes {
+		stream := newFakeStream("10.1.1.1:5000")
+		done := startClusterStream(s, stream)
+		defer func() {
+			stream.close()
+			_ = waitStreamDone(t, done)
+		}()
+		req := clusterRequest(n.id)
+		req.ResourceNames = []string{n.cluster}
+		stream.sendRequest(req)
+		stream.recvResponse(t)
+		waitCdsCon(t, n.id)
+		streams = append(streams, stream)
+	}
+
+	if n := cdsPushServices("b.default.svc.cluster.local"); n != 1 {
+		t.Errorf("service push reached %d connections, want 1", n)
+	}
+	streams[1].recvResponse(t)
+	streams[0].expectNoResponse(t, cdsDebounce+50*time.Millisecond)
+
+	if w := cdsz("push=1&hosts=a.default.svc.cluster.local,c.default.svc.cluster.local"); w.Code != http.StatusOK {
+		t.Errorf("hosts push returned %d", w.Code)
+	}
+	streams[0].recvResponse(t)
+	streams[1].expectNoResponse(t, cdsDebounce+50*time.Millisecond)
+
+	// The service and instance handlers push the changed services only.
+	PushServices([]string{"b.default.svc.cluster.local"})
+	streams[1].recvResponse(t)
+	streams[0].expectNoResponse(t, cdsDebounce+50*time.Millisecond)
+
+	if n := cdsPushServices("c.default.svc.cluster.local"); n != 0 {
+		t.Errorf("push of a service without proxies reached %d connections, want 0", n)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+var (
+	// cdsGenerationRetries is the number of times a failed generation is retried before the
+	// push is abandoned, set with PILOT_CDS_GENERATION_RETRIES. Zero (the default) disables
+	// retries.
+	cdsGenerationRetries = envInt("PILOT_CDS_GENERATION_RETRIES", 0)
+
+	// cdsGenerationBudget is the total time of a generation and its retries, set with
+	// PILOT_CDS_GENERATION_BUDGET. No retry starts past it, so flapping generation doesn't
+	// hold a connection indefinitely.
+	cdsGenerationBudget = envDuration("PILOT_CDS_GENERATION_BUDGET", 5*time.Second)
+
+	// cdsGenerationRetryDelay is the delay before the first retry, doubled for each retry.
+	cdsGenerationRetryDelay = 100 * time.Millisecond
+)
+
+// buildClustersWithRetries is buildClusters, retrying failed generations within the budget.
+func (s *DiscoveryServer) buildClustersWithRetries(ctx context.Context, node model.Proxy,
+	profile *GenerationProfile) ([]*xdsapi.Cluster, error) {
+	deadline := time.Now().Add(cdsGenerationBudget)
+	clusters, err := s.buildClusters(ctx, node, profile)
+	for attempt := 0; err != nil && attempt < cdsGenerationRetries; attempt++ {
+		wait := cdsGenerationRetryDelay << uint(attempt)
+		if time.Now().Add(wait).After(deadline) {
+			cdsGenerationBudgetCounter.Inc()
+			return nil, fmt.Errorf("generation budget of %v exhausted after %d attempts: %v",
+				cdsGenerationBudget, attempt+1, err)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		clusters, err = s.buildClusters(ctx, node, profile)
+	}
+	return clusters, err
+}
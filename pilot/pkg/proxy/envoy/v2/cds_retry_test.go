@@ -0,0 +1,67 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestBuildClustersRetryBudget(t *testing.T) {
+	oldRetries, oldBudget, oldDelay := cdsGenerationRetries, cdsGenerationBudget, cdsGenerationRetryDelay
+	cdsGenerationRetries, cdsGenerationBudget, cdsGenerationRetryDelay = 10, 100*time.Millisecond, 10*time.Millisecond
+	defer func() {
+		cdsGenerationRetries, cdsGenerationBudget, cdsGenerationRetryDelay = oldRetries, oldBudget, oldDelay
+	}()
+
+	// Fails once, then recovers.
+	g := newFakeGenerator("a")
+	g.err = errors.New("flaky")
+	g.onBuild = func() {
+		if g.calls > 1 {
+			g.err = nil
+		}
+	}
+	s := newTestServer(g)
+	clusters, err := s.buildClustersWithRetries(context.Background(), model.Proxy{}, nil)
+	if err != nil || len(clusters) != 1 || g.callCount() != 2 {
+		t.Errorf("got %v, %v after %d attempts, want the cluster after 2", clusters, err, g.callCount())
+	}
+
+	// Always fails: retries after 10, 20 and 40ms, the next one would exceed the budget.
+	g = newFakeGenerator("a")
+	g.setError(errors.New("flapping"))
+	s = newTestServer(g)
+	exhausted := counterValue(t, cdsGenerationBudgetCounter)
+	start := time.Now()
+	_, err = s.buildClustersWithRetries(context.Background(), model.Proxy{}, nil)
+	if elapsed := time.Since(start); elapsed > cdsGenerationBudget {
+		t.Errorf("retries took %v, over the budget of %v", elapsed, cdsGenerationBudget)
+	}
+	if err == nil || !strings.Contains(err.Error(), "budget") {
+		t.Errorf("got error %v, want the budget exhausted", err)
+	}
+	if n := g.callCount(); n != 4 {
+		t.Errorf("generated %d times, want 4", n)
+	}
+	if n := counterValue(t, cdsGenerationBudgetCounter); n != exhausted+1 {
+		t.Errorf("budget counter increased by %v, want 1", n-exhausted)
+	}
+}
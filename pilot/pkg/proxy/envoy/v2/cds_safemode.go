@@ -0,0 +1,94 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"sync"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+
+	"istio.io/istio/pkg/log"
+)
+
+// Safe mode keeps the mesh running through config store outages. A failed generation, or
+// an empty one for a node that had clusters, doesn't replace the config of the envoy. After
+// cdsSafeModeFailures consecutive failures pilot enters safe mode and serves the last-known-good
+// clusters of each node, including to envoys reconnecting during the outage, until a
+// generation succeeds again.
+
+var (
+	// cdsSafeModeFailures is the number of consecutive failed generations entering safe mode.
+	// Zero disables safe mode: failed generations are pushed as before.
+	cdsSafeModeFailures = envInt("PILOT_CDS_SAFE_MODE_FAILURES", 3)
+
+	cdsSafeMode = &safeMode{lastGood: map[string][]*xdsapi.Cluster{}}
+)
+
+type safeMode struct {
+	mutex    sync.Mutex
+	failures int
+	active   bool
+
+	// lastGood are the clusters of the last successful generation, by node id.
+	lastGood map[string][]*xdsapi.Cluster
+}
+
+func (m *safeMode) enabled() bool {
+	return cdsSafeModeFailures > 0
+}
+
+// recordSuccess leaves safe mode, and keeps the clusters as last-known-good for the node.
+func (m *safeMode) recordSuccess(nodeID string, clusters []*xdsapi.Cluster) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.active {
+		log.Infof("CDS: generation recovered, leaving safe mode")
+		cdsSafeModeGauge.Set(0)
+	}
+	m.failures = 0
+	m.active = false
+	m.lastGood[nodeID] = clusters
+}
+
+// recordFailure tracks a failed generation, and returns true if pilot is in safe mode.
+func (m *safeMode) recordFailure() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.failures++
+	if !m.active && m.failures >= cdsSafeModeFailures {
+		m.active = true
+		cdsSafeModeGauge.Set(1)
+		log.Warnf("CDS: %d consecutive generation failures, entering safe mode: serving last-known-good clusters",
+			m.failures)
+	}
+	return m.active
+}
+
+// lastKnownGood returns the clusters of the last successful generation for the node.
+func (m *safeMode) lastKnownGood(nodeID string) []*xdsapi.Cluster {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.lastGood[nodeID]
+}
+
+// forget drops the last-known-good clusters of a disconnected node. They are kept in safe
+// mode, for envoys reconnecting during the outage.
+func (m *safeMode) forget(nodeID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.active {
+		delete(m.lastGood, nodeID)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func safeModeGauge(t *testing.T) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := cdsSafeModeGauge.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestCdsSafeMode(t *testing.T) {
+	defer resendUnchanged()()
+	oldSafeMode := cdsSafeMode
+	cdsSafeMode = &safeMode{lastGood: map[string][]*xdsapi.Cluster{}}
+	// Each push is a generation, not debounced.
+	oldDebounce := cdsDebounce
+	cdsDebounce = 0
+	defer func() {
+		cdsSafeMode = oldSafeMode
+		cdsSafeModeGauge.Set(0)
+		cdsDebounce = oldDebounce
+	}()
+
+	want := []string{"outbound|80||a.default.svc.cluster.local"}
+	g := newFakeGenerator(want...)
+	s := newTestServer(g)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	waitCdsCon(t, testNodeID)
+
+	// The config store is down.
+	g.setError(errors.New("config store unavailable"))
+	for i := 1; i < cdsSafeModeFailures; i++ {
+		cdsPushAll(nil)
+		stream.expectNoResponse(t, 20*time.Millisecond)
+	}
+	cdsPushAll(nil)
+	if got := clusterNames(t, stream.recvResponse(t)); !reflect.DeepEqual(got, want) {
+		t.Errorf("safe mode pushed %v, want the last-known-good %v", got, want)
+	}
+	if safeModeGauge(t) != 1 {
+		t.Error("safe mode is not reported")
+	}
+
+	// An envoy reconnecting during the outage gets the last-known-good clusters.
+	stream.close()
+	_ = waitStreamDone(t, done)
+	stream = newFakeStream("10.1.1.1:5000")
+	done = startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	if got := clusterNames(t, stream.recvResponse(t)); !reflect.DeepEqual(got, want) {
+		t.Errorf("reconnect in safe mode got %v, want the last-known-good %v", got, want)
+	}
+
+	// The store recovers.
+	waitCdsCon(t, testNodeID)
+	g.setError(nil)
+	g.setClusters("outbound|80||b.default.svc.cluster.local")
+	cdsPushAll(nil)
+	stream.recvResponse(t)
+	if safeModeGauge(t) != 0 {
+		t.Error("still in safe mode after recovery")
+	}
+}
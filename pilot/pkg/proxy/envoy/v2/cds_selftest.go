@@ -0,0 +1,140 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"google.golang.org/grpc"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// selfTestNodeID is the synthetic sidecar used by /debug/cdsz/selftest, if no node is set.
+const selfTestNodeID = "sidecar~127.0.0.1~cds-selftest.istio-system~istio-system.svc.cluster.local"
+
+// cdsSelfTestResult is returned by /debug/cdsz/selftest.
+type cdsSelfTestResult struct {
+	Success bool
+	Error   string `json:",omitempty"`
+	Node    string
+
+	// Clusters is the number of clusters in the response
+	Clusters int
+
+	// Size of the marshaled response, in bytes
+	Size int
+
+	Generation time.Duration
+	Marshal    time.Duration
+	Send       time.Duration
+	Total      time.Duration
+}
+
+// selfTestStream is a CDS stream without a client: Send decodes the marshaled response
+// and its clusters, as the envoy would.
+type selfTestStream struct {
+	grpc.ServerStream
+	data []byte
+}
+
+func (st *selfTestStream) Send(*xdsapi.DiscoveryResponse) error {
+	response := &xdsapi.DiscoveryResponse{}
+	if err := response.Unmarshal(st.data); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	for i := range response.Resources {
+		if err := (&xdsapi.Cluster{}).Unmarshal(response.Resources[i].Value); err != nil {
+			return fmt.Errorf("invalid cluster %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (st *selfTestStream) Recv() (*xdsapi.DiscoveryRequest, error) {
+	return nil, errors.New("self-test stream has no client")
+}
+
+// cdsSelfTest implements /debug/cdsz/selftest. It runs a synthetic node through cluster
+// generation, marshaling and a fake send, without a real proxy or a registered connection,
+// and reports the result with the time of each step. Fails with 500 if any step fails.
+// "node=ID" tests a specific node id instead of the synthetic sidecar.
+func (s *DiscoveryServer) cdsSelfTest(w http.ResponseWriter, req *http.Request) {
+	_ = req.ParseForm()
+	nodeID := req.Form.Get("node")
+	if nodeID == "" {
+		nodeID = selfTestNodeID
+	}
+	result := s.runCdsSelfTest(nodeID)
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	if !result.Success {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	_, _ = w.Write(data)
+}
+
+func (s *DiscoveryServer) runCdsSelfTest(nodeID string) *cdsSelfTestResult {
+	result := &cdsSelfTestResult{Node: nodeID}
+	start := time.Now()
+	defer func() {
+		result.Total = time.Since(start)
+	}()
+
+	node, err := model.ParseServiceNode(nodeID)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	t := time.Now()
+	rawClusters, err := s.buildClusters(context.Background(), node, nil)
+	result.Generation = time.Since(t)
+	if err != nil {
+		result.Error = "generation failed: " + err.Error()
+		return result
+	}
+
+	t = time.Now()
+	response := (&CdsConnection{}).clusters(rawClusters)
+	data, err := response.Marshal()
+	result.Marshal = time.Since(t)
+	if err != nil {
+		result.Error = "marshal failed: " + err.Error()
+		return result
+	}
+	result.Clusters = len(response.Resources)
+	result.Size = len(data)
+
+	t = time.Now()
+	err = (&selfTestStream{data: data}).Send(response)
+	result.Send = time.Since(t)
+	if err != nil {
+		result.Error = "send failed: " + err.Error()
+		return result
+	}
+	result.Success = true
+	return result
+}
@@ -0,0 +1,50 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func selfTest(t *testing.T, s *DiscoveryServer) (int, *cdsSelfTestResult) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.cdsSelfTest(w, httptest.NewRequest("GET", "/debug/cdsz/selftest", nil))
+	result := &cdsSelfTestResult{}
+	if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, result
+}
+
+func TestCdsSelfTest(t *testing.T) {
+	g := newFakeGenerator("outbound|80||a.default.svc.cluster.local", "outbound|80||b.default.svc.cluster.local")
+	s := newTestServer(g)
+
+	code, result := selfTest(t, s)
+	if code != http.StatusOK || !result.Success || result.Clusters != 2 {
+		t.Errorf("self-test on a healthy server: %d %+v", code, result)
+	}
+
+	g.setError(errors.New("generation failure"))
+	code, result = selfTest(t, s)
+	if code != http.StatusInternalServerError || result.Success || result.Error == "" {
+		t.Errorf("self-test with a generation error: %d %+v", code, result)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// cdsSendTimeout bounds each Send on a CDS, EDS or LDS stream, set with
+	// PILOT_CDS_SEND_TIMEOUT. A connection with a Send stuck past the timeout is closed, the
+	// envoy reconnects. Zero disables the timeout.
+	cdsSendTimeout = envDuration("PILOT_CDS_SEND_TIMEOUT", 5*time.Second)
+)
+
+// timeoutSender fails the Sends not completed within the timeout.
+type timeoutSender struct {
+	sender  responseSender
+	timeout time.Duration
+	// timeouts counts the Sends timed out.
+	timeouts prometheus.Counter
+}
+
+// withSendTimeout returns the sender, failing the Sends taking more than timeout, counted in
+// timeouts. A zero timeout returns the sender unchanged.
+func withSendTimeout(sender responseSender, timeout time.Duration, timeouts prometheus.Counter) responseSender {
+	if timeout <= 0 {
+		return sender
+	}
+	return &timeoutSender{sender: sender, timeout: timeout, timeouts: timeouts}
+}
+
+// Send implements responseSender. On timeout the Send keeps running in the background until
+// the stream is closed, so the caller must return from the gRPC handler without starting
+// another Send or waiting for one: gRPC closes the stream once the handler returns, which
+// ends the blocked Send and its goroutine.
+func (t *timeoutSender) Send(response *xdsapi.DiscoveryResponse) error {
+	// Buffered, so the Send goroutine can always complete.
+	done := make(chan error, 1)
+	go func() {
+		done <- t.sender.Send(response)
+	}()
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		t.timeouts.Inc()
+		return status.Errorf(codes.DeadlineExceeded, "send timed out after %v", t.timeout)
+	}
+}
@@ -0,0 +1,887 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestCdsSlowClient(t *testing.T) {
+	oldSlowSend, oldTimeout := cdsSlowSend, cdsSendTimeout
+	cdsSlowSend, cdsSendTimeout = 10*time.Millisecond, 200*time.Millisecond
+	defer func() { cdsSlowSend, cdsSendTimeout = oldSlowSend, oldTimeout }()
+	timeouts := counterValue(t, cdsSendTimeoutsCounter)
+
+	g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+	s := newTestServer(g)
+	stream := newFakeStream("10.1.1.1:5000")
+	stream.slow(50 * time.Millisecond)
+
+	out := captureLog(t, func() {
+		// A client slower than cdsSlowSend but within the send timeout is served.
+		done := startClusterStream(s, stream)
+		stream.sendRequest(clusterRequest(testNodeID))
+		if resp := stream.recvResponse(t); len(resp.Resources) != 1 {
+			t.Errorf("got %d clusters, want 1", len(resp.Resources))
+		}
+		waitCdsCon(t, testNodeID)
+		g.setClusters("outbound|80||b.default.svc.cluster.local")
+		cdsPushAll(nil)
+		stream.recvResponse(t)
+
+		// A client slower than the send timeout is closed, the envoy reconnects. Within the
+		// captured log: the stream logs until it returns.
+		stream.slow(time.Hour)
+		g.setClusters("outbound|80||c.default.svc.cluster.local")
+		cdsPushAll(nil)
+		if err := waitStreamDone(t, done); status.Code(err) != codes.DeadlineExceeded {
+			t.Errorf("stream of a client slower than the send timeout returned %v, want DeadlineExceeded", err)
+		}
+	})
+	if !strings.Contains(out, "CDS: slow send") {
+		t.Errorf("slow send to a slow client was not detected, log:\n%s", out)
+	}
+	if n := counterValue(t, cdsSendTimeoutsCounter); n != timeouts+1 {
+		t.Errorf("send timeouts counter moved by %v, want 1", n-timeouts)
+	}
+	if n := cdsConCount(testNodeID); n != 0 {
+		t.Errorf("%d connections registered after the send timeout, want 0", n)
+	}
+	// gRPC cancels the stream when StreamClusters returns, ending the blocked Send.
+	stream.cancel()
+	stream.waitSendsReturned(t)
+}
+
+func TestCdsNilClusters(t *testing.T) {
+	g := newFakeGenerator()
+	g.setNil()
+	s := newTestServer(g)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+
+	stream.sendRequest(clusterRequest(testNodeID))
+	resp := stream.recvResponse(t)
+	stream.close()
+	if err := waitStreamDone(t, done); err != nil {
+		t.Errorf("stream returned %v", err)
+	}
+
+	if resp.TypeUrl != clusterType {
+		t.Errorf("TypeUrl = %q, want %q", resp.TypeUrl, clusterType)
+	}
+	if resp.VersionInfo == "" || resp.Nonce == "" {
+		t.Errorf("empty response is missing version %q or nonce %q", resp.VersionInfo, resp.Nonce)
+	}
+	if resp.Resources == nil || len(resp.Resources) != 0 {
+		t.Errorf("Resources = %v, want empty", resp.Resources)
+	}
+}
+
+func TestCdsClustersSkipsNilEntries(t *testing.T) {
+	con := &CdsConnection{}
+	empty := con.clusters(nil)
+	if empty.Resources == nil || len(empty.Resources) != 0 {
+		t.Errorf("clusters(nil) Resources = %v, want empty", empty.Resources)
+	}
+
+	resp := con.clusters([]*xdsapi.Cluster{nil, {Name: "a"}})
+	if len(resp.Resources) != 1 {
+		t.Errorf("got %d resources, want 1", len(resp.Resources))
+	}
+}
+
+func TestCdsRateLimit(t *testing.T) {
+	defer resendUnchanged()()
+	g := newFakeGenerator("outbound|80||a.default.svc.cluster.local", "outbound|80||b.default.svc.cluster.local")
+	size := (&CdsConnection{}).clusters(g.clusters).Size()
+
+	// 10 responses per second, with a burst of 10.
+	oldMax := cdsMaxBytesPerSec
+	cdsMaxBytesPerSec = 10 * size
+	defer func() { cdsMaxBytesPerSec = oldMax }()
+
+	s := newTestServer(g)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+
+	start := time.Now()
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	waitCdsCon(t, testNodeID)
+	for i := 0; i < 13; i++ {
+		cdsPushAll(nil)
+		stream.recvResponse(t)
+	}
+	// 14 responses with a burst of 10 need at least 400ms.
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("14 pushes took %v, want them throttled to at least 400ms", elapsed)
+	}
+}
+
+func TestCdsVersionIncreases(t *testing.T) {
+	defer resendUnchanged()()
+	cdsMonotonicVersion = true
+	defer func() { cdsMonotonicVersion = false }()
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+
+	stream.sendRequest(clusterRequest(testNodeID))
+	last, err := strconv.ParseUint(stream.recvResponse(t).VersionInfo, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitCdsCon(t, testNodeID)
+	for i := 0; i < 5; i++ {
+		// The clusters don't change between pushes, the connection version must still increase.
+		PushAll()
+		v, err := strconv.ParseUint(stream.recvResponse(t).VersionInfo, 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v <= last {
+			t.Errorf("version %d after %d, want strictly increasing", v, last)
+		}
+		last = v
+	}
+}
+
+func TestCdsVersionFromContent(t *testing.T) {
+	oldSkip := cdsSkipUnchanged
+	cdsSkipUnchanged = true
+	defer func() { cdsSkipUnchanged = oldSkip }()
+
+	g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+	s := newTestServer(g)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+
+	stream.sendRequest(clusterRequest(testNodeID))
+	first := stream.recvResponse(t)
+	waitCdsCon(t, testNodeID)
+
+	// The clusters did not change: the push is skipped.
+	unchanged := counterValue(t, cdsUnchangedPushesCounter)
+	PushAll()
+	deadline := time.Now().Add(5 * time.Second)
+	for counterValue(t, cdsUnchangedPushesCounter) == unchanged {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the unchanged push")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := stream.sendCount(); n != 1 {
+		t.Fatalf("got %d sends for two pushes of identical clusters, want 1", n)
+	}
+
+	g.setClusters("outbound|80||b.default.svc.cluster.local")
+	PushAll()
+	second := stream.recvResponse(t)
+	if second.VersionInfo == first.VersionInfo {
+		t.Errorf("got version %s for different clusters, want a new version", second.VersionInfo)
+	}
+
+	// The version only depends on the clusters.
+	clusters, _ := g.BuildClusters(context.Background(), s.env, model.Proxy{})
+	if v := (&CdsConnection{}).clusters(clusters).VersionInfo; v != second.VersionInfo {
+		t.Errorf("got version %s for the same clusters, want %s", v, second.VersionInfo)
+	}
+}
+
+func TestNonceUnique(t *testing.T) {
+	const goroutines, count = 20, 500
+	nonces := make(chan string, goroutines*count)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				nonces <- nonce()
+			}
+		}()
+	}
+	wg.Wait()
+	close(nonces)
+	seen := map[string]bool{}
+	for n := range nonces {
+		if seen[n] {
+			t.Fatalf("duplicate nonce %s", n)
+		}
+		seen[n] = true
+	}
+}
+
+func TestCdsInitialPushDedup(t *testing.T) {
+	// Unchanged pushes are resent, except within the window.
+	defer resendUnchanged()()
+	cdsInitialPushWindow = time.Minute
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	waitCdsCon(t, testNodeID)
+	// A config push right after the connect, with the same clusters.
+	unchanged := counterValue(t, cdsUnchangedPushesCounter)
+	cdsPushAll(nil)
+	deadline := time.Now().Add(testTimeout)
+	for counterValue(t, cdsUnchangedPushesCounter) == unchanged {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the redundant push")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := stream.sendCount(); n != 1 {
+		t.Errorf("got %d sends after the connect and a push of the same clusters, want 1", n)
+	}
+}
+
+func TestCdsSmallChange(t *testing.T) {
+	oldPercent := cdsSmallChangePercent
+	cdsSmallChangePercent = 10
+	defer func() { cdsSmallChangePercent = oldPercent }()
+
+	names := []string{}
+	for i := 0; i < 20; i++ {
+		names = append(names, "outbound|80||"+strconv.Itoa(i)+".default.svc.cluster.local")
+	}
+	g := newFakeGenerator(names...)
+	s := newTestServer(g)
+	stream := newFakeStream("10.1.1.1:5000")
+
+	out := captureLog(t, func() {
+		done := startClusterStream(s, stream)
+		stream.sendRequest(clusterRequest(testNodeID))
+		stream.recvResponse(t)
+		waitCdsCon(t, testNodeID)
+
+		// One of 20 clusters changes.
+		g.setClusters(append(names[1:], "outbound|80||new.default.svc.cluster.local")...)
+		cdsPushAll(nil)
+		stream.recvResponse(t)
+		stream.close()
+		_ = waitStreamDone(t, done)
+	})
+
+	// The removed and the added cluster are counted.
+	if !strings.Contains(out, "changed 2 of 20 clusters") {
+		t.Errorf("small change was not detected, log:\n%s", out)
+	}
+	if strings.Count(out, "a delta push would be smaller") != 1 {
+		t.Errorf("initial push reported as a small change, log:\n%s", out)
+	}
+}
+
+func TestCdsHighAlloc(t *testing.T) {
+	oldWarn := cdsAllocWarnBytes
+	cdsAllocWarnBytes = 100 * 1024
+	defer func() { cdsAllocWarnBytes = oldWarn }()
+
+	names := []string{}
+	for i := 0; i < 5000; i++ {
+		names = append(names, "outbound|80||"+strconv.Itoa(i)+".default.svc.cluster.local")
+	}
+	s := newTestServer(newFakeGenerator(names...))
+	stream := newFakeStream("10.1.1.1:5000")
+
+	out := captureLog(t, func() {
+		done := startClusterStream(s, stream)
+		stream.sendRequest(clusterRequest(testNodeID))
+		stream.recvResponse(t)
+		stream.close()
+		_ = waitStreamDone(t, done)
+	})
+
+	if !strings.Contains(out, "CDS: high allocation") {
+		t.Errorf("large generation was not reported, log:\n%s", out)
+	}
+}
+
+func TestCdsPushBeforeRequest(t *testing.T) {
+	g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+	s := newTestServer(g)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+
+	cdsPushAll(nil)
+	stream.expectNoResponse(t, 50*time.Millisecond)
+	if g.callCount() != 0 {
+		t.Errorf("clusters generated %d times before the initial request", g.callCount())
+	}
+
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+}
+
+func TestCdsBootstrapClusters(t *testing.T) {
+	s := newTestServer(newFakeGenerator("outbound|15010||istio-pilot.istio-system.svc.cluster.local",
+		"outbound|80||a.default.svc.cluster.local", "outbound|80||b.default.svc.cluster.local"))
+	s.BootstrapClusters = newFakeGenerator("outbound|15010||istio-pilot.istio-system.svc.cluster.local")
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+
+	stream.sendRequest(clusterRequest(testNodeID))
+	if n := len(stream.recvResponse(t).Resources); n != 1 {
+		t.Errorf("first push has %d clusters, want the 1 bootstrap cluster", n)
+	}
+	if n := len(stream.recvResponse(t).Resources); n != 3 {
+		t.Errorf("second push has %d clusters, want the full 3", n)
+	}
+}
+
+func TestCdsCloseLogLevel(t *testing.T) {
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+
+	out := captureLog(t, func() {
+		stream := newFakeStream("10.1.1.1:5000")
+		done := startClusterStream(s, stream)
+		stream.sendRequest(clusterRequest(testNodeID))
+		stream.recvResponse(t)
+		stream.close()
+		_ = waitStreamDone(t, done)
+	})
+
+	if !strings.Contains(out, "CDS: close for client") {
+		t.Errorf("clean close was not logged, log:\n%s", out)
+	}
+	if strings.Contains(out, "\terror\t") {
+		t.Errorf("clean close logged at error level, log:\n%s", out)
+	}
+}
+
+func TestCdsSkipSendOnClosedContext(t *testing.T) {
+	g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+	s := newTestServer(g)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	waitCdsCon(t, testNodeID)
+
+	// The envoy disconnects while the push is generated.
+	g.mutex.Lock()
+	g.onBuild = stream.cancel
+	g.mutex.Unlock()
+	cdsPushAll(nil)
+
+	if err := waitStreamDone(t, done); err != nil {
+		t.Errorf("stream returned %v, want a clean exit", err)
+	}
+	if n := stream.sendCount(); n != 1 {
+		t.Errorf("Send called %d times, want only the initial response", n)
+	}
+}
+
+// recordingSender is a responseSender keeping all the responses.
+type recordingSender struct {
+	mutex     sync.Mutex
+	responses []*xdsapi.DiscoveryResponse
+}
+
+func (r *recordingSender) Send(resp *xdsapi.DiscoveryResponse) error {
+	r.mutex.Lock()
+	r.responses = append(r.responses, resp)
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *recordingSender) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.responses)
+}
+
+func TestCdsResponseSender(t *testing.T) {
+	defer resendUnchanged()()
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	sender := &recordingSender{}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.streamClusters(stream, sender)
+	}()
+
+	stream.sendRequest(clusterRequest(testNodeID))
+	waitCdsCon(t, testNodeID)
+	cdsPushAll(nil)
+	deadline := time.Now().Add(testTimeout)
+	for sender.count() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	stream.close()
+	if err := waitStreamDone(t, done); err != nil {
+		t.Errorf("stream returned %v", err)
+	}
+
+	if n := sender.count(); n != 2 {
+		t.Fatalf("sender got %d responses, want the initial response and 1 push", n)
+	}
+	if len(stream.responses) != 0 || stream.sendCount() != 0 {
+		t.Error("responses sent on the stream instead of the sender")
+	}
+	for _, resp := range sender.responses {
+		if len(resp.Resources) != 1 {
+			t.Errorf("got %d clusters, want 1", len(resp.Resources))
+		}
+	}
+}
+
+// cdsConCount returns the number of connections registered for the node ID.
+func cdsConCount(nodeID string) int {
+	n := 0
+	for _, k := range cdsConnections.keys() {
+		if strings.HasPrefix(k, nodeID+"-") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCdsConnectionRegistration(t *testing.T) {
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+	if n := cdsConCount(testNodeID); n != 1 {
+		t.Errorf("%d connections registered, want 1", n)
+	}
+	con := getCdsCon(key)
+
+	stream.close()
+	if err := waitStreamDone(t, done); err != nil {
+		t.Errorf("stream returned %v", err)
+	}
+	if n := cdsConCount(testNodeID); n != 0 {
+		t.Errorf("%d connections registered after close, want 0", n)
+	}
+
+	// Removing a stale connection keeps the newer one registered under the same key.
+	newer := &CdsConnection{}
+	_ = s.addCdsCon(key, newer)
+	s.removeCdsCon(con)
+	if getCdsCon(key) != newer {
+		t.Error("removing a stale connection deregistered the newer one")
+	}
+	s.removeCdsCon(newer)
+	if getCdsCon(key) != nil {
+		t.Error("connection not removed")
+	}
+}
+
+func TestCdsDuplicateNodeID(t *testing.T) {
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	// Two envoys of the same pod, with the same node id.
+	streams := []*fakeStream{newFakeStream("10.1.1.1:5000"), newFakeStream("10.1.1.1:5001")}
+	dones := []<-chan error{}
+	for _, stream := range streams {
+		dones = append(dones, startClusterStream(s, stream))
+		stream.sendRequest(clusterRequest(testNodeID))
+		stream.recvResponse(t)
+	}
+	if n := cdsConCount(testNodeID); n != 2 {
+		t.Fatalf("%d connections registered for the node, want 2", n)
+	}
+	cons := map[string]*CdsConnection{}
+	for k, con := range cdsConnectionSnapshot() {
+		if strings.HasPrefix(k, testNodeID+"-") {
+			cons[con.PeerAddr] = con
+		}
+	}
+	first, second := cons["10.1.1.1:5000"], cons["10.1.1.1:5001"]
+	if first == nil || second == nil || first.key == second.key {
+		t.Fatalf("got connections %v, want one for each stream with distinct keys", cons)
+	}
+
+	// An existing key is not overwritten.
+	if err := s.addCdsCon(first.key, &CdsConnection{}); err == nil || getCdsCon(first.key) != first {
+		t.Errorf("registering a connection under an existing key returned %v", err)
+	}
+
+	// Each stream only removes its own connection.
+	streams[0].close()
+	_ = waitStreamDone(t, dones[0])
+	if getCdsCon(first.key) != nil || getCdsCon(second.key) != second {
+		t.Error("closing the first stream didn't remove exactly its connection")
+	}
+	streams[1].close()
+	_ = waitStreamDone(t, dones[1])
+	if n := cdsConCount(testNodeID); n != 0 {
+		t.Errorf("%d connections registered after close, want 0", n)
+	}
+}
+
+func TestCdsInvalidNodeID(t *testing.T) {
+	defer resendUnchanged()()
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+
+	// The stream is closed if the node is never known.
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest("invalid"))
+	if err := waitStreamDone(t, done); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("stream returned %v for an invalid initial node id, want InvalidArgument", err)
+	}
+
+	// A bad request after a good one keeps the stream, and the node.
+	stream = newFakeStream("10.1.1.1:5000")
+	done = startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	resp := stream.recvResponse(t)
+	node := waitCdsCon(t, testNodeID)
+	ack := clusterRequest("invalid")
+	ack.VersionInfo, ack.ResponseNonce = resp.VersionInfo, resp.Nonce
+	stream.sendRequest(ack)
+	con := getCdsCon(node)
+	deadline := time.Now().Add(testTimeout)
+	for acks := 0; acks == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		con.mutex.Lock()
+		acks = con.ack.replies
+		con.mutex.Unlock()
+	}
+	if n := con.node(); n.ID != "app-644fc65469-96dza.testns" {
+		t.Errorf("connection has node %v after an invalid request", n)
+	}
+	cdsPushAll(nil)
+	stream.recvResponse(t)
+	stream.close()
+	if err := waitStreamDone(t, done); err != nil {
+		t.Errorf("stream returned %v", err)
+	}
+}
+
+func TestCdsNilNode(t *testing.T) {
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(&xdsapi.DiscoveryRequest{TypeUrl: clusterType})
+	if err := waitStreamDone(t, done); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("stream returned %v for an initial request without node, want InvalidArgument", err)
+	}
+
+	// Later requests may omit the node.
+	stream = newFakeStream("10.1.1.1:5000")
+	done = startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	resp := stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+	ack := &xdsapi.DiscoveryRequest{TypeUrl: clusterType, VersionInfo: resp.VersionInfo, ResponseNonce: resp.Nonce}
+	stream.sendRequest(ack)
+	waitEvents(t, getCdsCon(key), 4)
+	if n := getCdsCon(key).node(); n.ID != "app-644fc65469-96dza.testns" {
+		t.Errorf("connection has node %v after a request without node", n)
+	}
+	stream.close()
+	if err := waitStreamDone(t, done); err != nil {
+		t.Errorf("stream returned %v", err)
+	}
+}
+
+func TestCdsDebounce(t *testing.T) {
+	defer resendUnchanged()()
+	oldDebounce := cdsDebounce
+	cdsDebounce = time.Second
+	defer func() { cdsDebounce = oldDebounce }()
+
+	g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+	s := newTestServer(g)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	resp := stream.recvResponse(t)
+	con := getCdsCon(waitCdsCon(t, testNodeID))
+
+	for i := 0; i < 5; i++ {
+		cdsPushAll(nil)
+	}
+	// The ACK isn't delayed by the pending push.
+	ack := clusterRequest(testNodeID)
+	ack.VersionInfo, ack.ResponseNonce = resp.VersionInfo, resp.Nonce
+	stream.sendRequest(ack)
+	deadline := time.Now().Add(testTimeout)
+	for acks := 0; acks == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		con.mutex.Lock()
+		acks = con.ack.replies
+		con.mutex.Unlock()
+	}
+	if n := stream.sendCount(); n != 1 {
+		t.Errorf("%d sends before the end of the debounce, want only the initial response", n)
+	}
+
+	stream.recvResponse(t)
+	stream.expectNoResponse(t, 100*time.Millisecond)
+	if n := stream.sendCount(); n != 2 {
+		t.Errorf("%d sends for 5 push signals, want the initial response and 1 push", n)
+	}
+	if n := g.callCount(); n != 2 {
+		t.Errorf("%d generations for 5 push signals, want 2", n)
+	}
+	stream.close()
+	if err := waitStreamDone(t, done); err != nil {
+		t.Errorf("stream returned %v", err)
+	}
+}
+
+func TestCdsDebounceQuietPeriod(t *testing.T) {
+	defer resendUnchanged()()
+	oldDebounce, oldMax := cdsDebounce, cdsDebounceMax
+	cdsDebounce, cdsDebounceMax = 200*time.Millisecond, 700*time.Millisecond
+	defer func() { cdsDebounce, cdsDebounceMax = oldDebounce, oldMax }()
+
+	g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+	s := newTestServer(g)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	waitCdsCon(t, testNodeID)
+
+	// Signals closer than the debounce keep delaying the push, up to the max delay.
+	start := time.Now()
+	burst := make(chan struct{})
+	go func() {
+		defer close(burst)
+		for i := 0; i < 12; i++ {
+			cdsPushAll(nil)
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	stream.recvResponse(t)
+	if elapsed := time.Since(start); elapsed < cdsDebounceMax-cdsDebounce || elapsed > cdsDebounceMax+cdsDebounce {
+		t.Errorf("push after %v during the burst, want after the max delay %v", elapsed, cdsDebounceMax)
+	}
+	<-burst
+	// The last signals of the burst get a single push once quiet.
+	stream.recvResponse(t)
+	stream.expectNoResponse(t, cdsDebounce+100*time.Millisecond)
+	stream.close()
+	if err := waitStreamDone(t, done); err != nil {
+		t.Errorf("stream returned %v", err)
+	}
+}
+
+func TestCdsIdleTimeout(t *testing.T) {
+	oldTimeout := cdsIdleTimeout
+	cdsIdleTimeout = 100 * time.Millisecond
+	defer func() { cdsIdleTimeout = oldTimeout }()
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	resp := stream.recvResponse(t)
+	waitCdsCon(t, testNodeID)
+
+	// Requests keep the connection.
+	for i := 0; i < 4; i++ {
+		time.Sleep(cdsIdleTimeout / 2)
+		ack := clusterRequest(testNodeID)
+		ack.VersionInfo, ack.ResponseNonce = resp.VersionInfo, resp.Nonce
+		stream.sendRequest(ack)
+	}
+	if n := cdsConCount(testNodeID); n != 1 {
+		t.Fatalf("%d connections registered after requests, want 1", n)
+	}
+
+	if err := waitStreamDone(t, done); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("idle stream returned %v, want DeadlineExceeded", err)
+	}
+	if n := cdsConCount(testNodeID); n != 0 {
+		t.Errorf("%d connections registered after the idle timeout, want 0", n)
+	}
+	stream.close()
+}
+
+func TestCdsGenerationErrorSkipsSend(t *testing.T) {
+	oldFailures := cdsSafeModeFailures
+	cdsSafeModeFailures = 0
+	defer func() { cdsSafeModeFailures = oldFailures }()
+	failures := counterValue(t, cdsGenerationFailuresCounter)
+
+	g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+	g.setError(errors.New("nil dependency"))
+	s := newTestServer(g)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	waitCdsCon(t, testNodeID)
+	stream.expectNoResponse(t, 50*time.Millisecond)
+	cdsPushAll(nil)
+	stream.expectNoResponse(t, cdsDebounce+50*time.Millisecond)
+
+	if n := stream.sendCount(); n != 0 {
+		t.Errorf("%d sends with a failed generation, want 0", n)
+	}
+	if n := counterValue(t, cdsGenerationFailuresCounter); n != failures+2 {
+		t.Errorf("failures counter moved by %v, want 2", n-failures)
+	}
+
+	// The next successful generation is pushed.
+	g.setError(nil)
+	cdsPushAll(nil)
+	stream.recvResponse(t)
+	stream.close()
+	if err := waitStreamDone(t, done); err != nil {
+		t.Errorf("stream returned %v", err)
+	}
+}
+
+// blockingGenerator blocks BuildClusters until the context is cancelled.
+type blockingGenerator struct {
+	fakeGenerator
+	started chan struct{}
+	result  chan error
+}
+
+func (g *blockingGenerator) BuildClusters(ctx context.Context, env model.Environment, node model.Proxy) ([]*xdsapi.Cluster, error) {
+	close(g.started)
+	<-ctx.Done()
+	g.result <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestCdsGenerationCancelled(t *testing.T) {
+	g := &blockingGenerator{started: make(chan struct{}), result: make(chan error, 1)}
+	s := &DiscoveryServer{ConfigGenerator: g}
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	select {
+	case <-g.started:
+	case <-time.After(testTimeout):
+		t.Fatal("timeout waiting for the generation")
+	}
+
+	// The envoy disconnects during the generation.
+	stream.cancel()
+	select {
+	case err := <-g.result:
+		if err != context.Canceled {
+			t.Errorf("generation ended with %v, want context.Canceled", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("generation not cancelled")
+	}
+	if err := waitStreamDone(t, done); err != nil {
+		t.Errorf("stream returned %v", err)
+	}
+	if n := stream.sendCount(); n != 0 {
+		t.Errorf("%d sends after the disconnect, want 0", n)
+	}
+}
+
+func TestCdsSendTimeout(t *testing.T) {
+	oldTimeout := cdsSendTimeout
+	cdsSendTimeout = 50 * time.Millisecond
+	defer func() { cdsSendTimeout = oldTimeout }()
+	timeouts := counterValue(t, cdsSendTimeoutsCounter)
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	// Send blocks past the deadline, until the stream is closed.
+	stream.slow(time.Hour)
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	waitCdsCon(t, testNodeID)
+
+	if err := waitStreamDone(t, done); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("stream returned %v, want DeadlineExceeded", err)
+	}
+	if n := counterValue(t, cdsSendTimeoutsCounter); n != timeouts+1 {
+		t.Errorf("send timeouts counter moved by %v, want 1", n-timeouts)
+	}
+	if n := cdsConCount(testNodeID); n != 0 {
+		t.Errorf("%d connections registered after the send timeout, want 0", n)
+	}
+	// gRPC cancels the stream when StreamClusters returns, ending the blocked Send.
+	stream.cancel()
+	stream.waitSendsReturned(t)
+}
+
+func TestCdsMaxConnections(t *testing.T) {
+	defer resendUnchanged()()
+	oldMax := cdsMaxConnections
+	cdsMaxConnections = 1
+	defer func() { cdsMaxConnections = oldMax }()
+	rejected := counterValue(t, cdsRejectedConnectionsCounter)
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	first := newFakeStream("10.1.1.1:5000")
+	firstDone := startClusterStream(s, first)
+	first.sendRequest(clusterRequest(testNodeID))
+	first.recvResponse(t)
+	waitCdsCon(t, testNodeID)
+
+	second := newFakeStream("10.1.1.2:5000")
+	done := startClusterStream(s, second)
+	second.sendRequest(clusterRequest("sidecar~10.1.1.2~app-2.testns~testns.svc.cluster.local"))
+	if err := waitStreamDone(t, done); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("stream over the cap returned %v, want ResourceExhausted", err)
+	}
+	if n := counterValue(t, cdsRejectedConnectionsCounter); n != rejected+1 {
+		t.Errorf("rejections counter moved by %v, want 1", n-rejected)
+	}
+	second.close()
+
+	// The existing connection is still served.
+	cdsPushAll(nil)
+	first.recvResponse(t)
+	first.close()
+	if err := waitStreamDone(t, firstDone); err != nil {
+		t.Errorf("stream returned %v", err)
+	}
+}
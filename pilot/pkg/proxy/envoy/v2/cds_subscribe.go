@@ -0,0 +1,53 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"reflect"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+)
+
+// setSubscription records the cluster names in the ResourceNames of a request. An empty
+// list subscribes to all the clusters. Returns true if the subscription changed.
+func (con *CdsConnection) setSubscription(names []string) bool {
+	var subscribed map[string]bool
+	if len(names) > 0 {
+		subscribed = make(map[string]bool, len(names))
+		for _, n := range names {
+			subscribed[n] = true
+		}
+	}
+	if reflect.DeepEqual(subscribed, con.subscribed) {
+		return false
+	}
+	con.subscribed = subscribed
+	return true
+}
+
+// subscribedClusters returns the clusters the envoy subscribed to, in order. Subscribed
+// names without a cluster are ignored: the envoy doesn't get them until they are generated.
+func (con *CdsConnection) subscribedClusters(clusters []*xdsapi.Cluster) []*xdsapi.Cluster {
+	if con.subscribed == nil {
+		return clusters
+	}
+	out := make([]*xdsapi.Cluster, 0, len(con.subscribed))
+	for _, c := range clusters {
+		if c != nil && con.subscribed[c.Name] {
+			out = append(out, c)
+		}
+	}
+	return out
+}
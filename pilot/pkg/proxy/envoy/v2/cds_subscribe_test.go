@@ -0,0 +1,101 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	clusterA = "outbound|80||a.default.svc.cluster.local"
+	clusterB = "outbound|80||b.default.svc.cluster.local"
+	clusterC = "outbound|80||c.default.svc.cluster.local"
+)
+
+func TestCdsSubscription(t *testing.T) {
+	defer resendUnchanged()()
+	tests := []struct {
+		name      string
+		resources []string
+		want      []string
+	}{
+		{"empty", nil, []string{clusterA, clusterB, clusterC}},
+		{"partial", []string{clusterC, clusterA}, []string{clusterA, clusterC}},
+		{"unknown", []string{clusterB, "outbound|80||unknown.default.svc.cluster.local"}, []string{clusterB}},
+		{"only unknown", []string{"outbound|80||unknown.default.svc.cluster.local"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newFakeGenerator(clusterA, clusterB, clusterC)
+			s := newTestServer(g)
+			stream := newFakeStream("10.1.1.1:5000")
+			done := startClusterStream(s, stream)
+
+			req := clusterRequest(testNodeID)
+			req.ResourceNames = tt.resources
+			stream.sendRequest(req)
+			if got := clusterNames(t, stream.recvResponse(t)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("initial response has %v, want %v", got, tt.want)
+			}
+
+			// Later pushes keep the subscription.
+			waitCdsCon(t, testNodeID)
+			g.setClusters(clusterA, clusterB, clusterC)
+			cdsPushAll(nil)
+			if got := clusterNames(t, stream.recvResponse(t)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pushed response has %v, want %v", got, tt.want)
+			}
+
+			stream.close()
+			if err := waitStreamDone(t, done); err != nil {
+				t.Errorf("stream returned %v", err)
+			}
+		})
+	}
+}
+
+func TestCdsSubscriptionChange(t *testing.T) {
+	s := newTestServer(newFakeGenerator(clusterA, clusterB, clusterC))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+
+	req := clusterRequest(testNodeID)
+	req.ResourceNames = []string{clusterA}
+	stream.sendRequest(req)
+	resp := stream.recvResponse(t)
+
+	// An ACK for the same subscription doesn't trigger a push.
+	ack := clusterRequest(testNodeID)
+	ack.ResourceNames = []string{clusterA}
+	ack.VersionInfo, ack.ResponseNonce = resp.VersionInfo, resp.Nonce
+	stream.sendRequest(ack)
+	stream.expectNoResponse(t, 50*time.Millisecond)
+
+	// A new subscription is pushed.
+	update := clusterRequest(testNodeID)
+	update.ResourceNames = []string{clusterA, clusterB}
+	update.VersionInfo, update.ResponseNonce = resp.VersionInfo, resp.Nonce
+	stream.sendRequest(update)
+	if got, want := clusterNames(t, stream.recvResponse(t)), []string{clusterA, clusterB}; !reflect.DeepEqual(got, want) {
+		t.Errorf("response to the subscription change has %v, want %v", got, want)
+	}
+
+	stream.close()
+	if err := waitStreamDone(t, done); err != nil {
+		t.Errorf("stream returned %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/log"
+)
+
+// cdsNodeFilter selects the connections getting a targeted push.
+type cdsNodeFilter func(con *CdsConnection) bool
+
+// namespaceFilter selects the proxies of the namespace.
+func namespaceFilter(namespace string) cdsNodeFilter {
+	return func(con *CdsConnection) bool {
+		node := con.node()
+		return node != nil && proxyNamespace(node.ID) == namespace
+	}
+}
+
+// labelsFilter selects the proxies of the workloads with the labels.
+func labelsFilter(selector model.Labels) cdsNodeFilter {
+	return func(con *CdsConnection) bool {
+		return con.matchesSelector(selector)
+	}
+}
+
+// nodeIDFilter selects the connections of the node id, as sent by the proxy.
+func nodeIDFilter(id string) cdsNodeFilter {
+	return func(con *CdsConnection) bool {
+		return con.nodeID == id
+	}
+}
+
+// hostnamesFilter selects the proxies with clusters of the service hostnames, and the proxies
+// not pushed yet. Only for changes to existing services (destination rules, ports...): a new
+// service is not in the clusters of any proxy, and needs a push to all the connections.
+func hostnamesFilter(hostnames []string) cdsNodeFilter {
+	return func(con *CdsConnection) bool {
+		con.mutex.Lock()
+		defer con.mutex.Unlock()
+		if con.hosts == nil {
+			return true
+		}
+		for _, h := range hostnames {
+			if con.hosts[h] {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// clusterHosts returns the service hostnames of the clusters, from the cluster names
+// (direction|port|subset|hostname). Clusters with other names are not tied to a service.
+func clusterHosts(clusters []*xdsapi.Cluster) map[string]bool {
+	hosts := make(map[string]bool, len(clusters))
+	for _, c := range clusters {
+		if c == nil || strings.Count(c.Name, "|") != 3 {
+			continue
+		}
+		_, _, hostname, _ := model.ParseSubsetKey(c.Name)
+		hosts[hostname] = true
+	}
+	return hosts
+}
+
+func (con *CdsConnection) setHosts(hosts map[string]bool) {
+	con.mutex.Lock()
+	con.hosts = hosts
+	con.mutex.Unlock()
+}
+
+// cdsPushServices pushes to the proxies with clusters of the services, for a change of the
+// config of existing services. Returns the number of connections pushed.
+func cdsPushServices(hostnames ...string) int {
+	return cdsPushNodes(hostnamesFilter(hostnames))
+}
+
+// cdsPushNodes pushes to the connections selected by the filter, for config changes
+// affecting only some proxies. Returns the number of connections pushed.
+func cdsPushNodes(filter cdsNodeFilter) int {
+	// The selected proxies must not get clusters generated before the change.
+	cdsFetchCache.clear()
+	cdsClusterCache.clear()
+	pushed, queued := 0, 0
+	for _, cdsCon := range cdsPushList() {
+		if !filter(cdsCon) {
+			continue
+		}
+		pushed++
+		if !cdsCon.signalPush() {
+			queued++
+		}
+	}
+	if queued > 0 && cdsDebugEnabled() {
+		log.Infof("CDS: %d connections already had a push queued", queued)
+	}
+	return pushed
+}
+
+// pushFilter returns the filter of a targeted push from the Cdsz query: namespace=NS,
+// labels=k1=v1,k2=v2, nodeid=ID or hosts=h1,h2. Nil if the query has no filter.
+func pushFilter(form url.Values) (cdsNodeFilter, error) {
+	switch {
+	case form.Get("namespace") != "":
+		return namespaceFilter(form.Get("namespace")), nil
+	case form.Get("labels") != "":
+		selector := model.Labels{}
+		for _, l := range strings.Split(form.Get("labels"), ",") {
+			kv := strings.SplitN(l, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("invalid label %q, want key=value", l)
+			}
+			selector[kv[0]] = kv[1]
+		}
+		return labelsFilter(selector), nil
+	case form.Get("nodeid") != "":
+		return nodeIDFilter(form.Get("nodeid")), nil
+	case form.Get("hosts") != "":
+		return hostnamesFilter(strings.Split(form.Get("hosts"), ",")), nil
+	}
+	return nil, nil
+}
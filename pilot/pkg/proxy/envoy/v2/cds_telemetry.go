@@ -0,0 +1,83 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"time"
+)
+
+// cdsTelemetryInterval is the interval between two exports to the TelemetrySink.
+var cdsTelemetryInterval = envDuration("PILOT_CDS_TELEMETRY_INTERVAL", time.Minute)
+
+// ConnectionTelemetry is the telemetry of a CDS connection since it was established.
+type ConnectionTelemetry struct {
+	ConnectionEvent
+
+	// Pushes is the number of responses sent to the proxy, and Bytes their total size.
+	Pushes int
+	Bytes  int64
+
+	// AckLatency is the time the proxy took to ACK (or NACK) the last acknowledged response.
+	AckLatency time.Duration
+
+	// Nacks is the number of responses rejected by the proxy.
+	Nacks int
+}
+
+// TelemetrySink receives the telemetry of the CDS connections, for operators shipping it to
+// their own systems beyond Prometheus. ExportTelemetry is called on a dedicated goroutine,
+// a slow sink delays the following exports but not the pushes.
+type TelemetrySink interface {
+	ExportTelemetry(telemetry []ConnectionTelemetry)
+}
+
+// StartTelemetryExport exports the telemetry of all CDS connections to the TelemetrySink
+// every PILOT_CDS_TELEMETRY_INTERVAL, until stop is closed. It does nothing if no sink is set.
+func (s *DiscoveryServer) StartTelemetryExport(stop <-chan struct{}) {
+	if s.TelemetrySink == nil || cdsTelemetryInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(cdsTelemetryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.TelemetrySink.ExportTelemetry(s.cdsTelemetry())
+			}
+		}
+	}()
+}
+
+// cdsTelemetry snapshots the telemetry of the current connections.
+func (s *DiscoveryServer) cdsTelemetry() []ConnectionTelemetry {
+	cons := cdsConnectionSnapshot()
+
+	out := make([]ConnectionTelemetry, 0, len(cons))
+	for k, con := range cons {
+		con.mutex.Lock()
+		out = append(out, ConnectionTelemetry{
+			ConnectionEvent: s.connectionEvent(k, con),
+			Pushes:          con.pushes,
+			Bytes:           con.bytes,
+			AckLatency:      con.ack.latency,
+			Nacks:           con.ack.nacks,
+		})
+		con.mutex.Unlock()
+	}
+	return out
+}
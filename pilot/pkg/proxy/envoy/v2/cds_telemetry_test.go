@@ -0,0 +1,109 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gogo/googleapis/google/rpc"
+)
+
+// fakeTelemetrySink records the exports.
+type fakeTelemetrySink struct {
+	exports chan []ConnectionTelemetry
+}
+
+func (f *fakeTelemetrySink) ExportTelemetry(telemetry []ConnectionTelemetry) {
+	select {
+	case f.exports <- telemetry:
+	default:
+	}
+}
+
+// next waits for the next export including the connection.
+func (f *fakeTelemetrySink) next(t *testing.T, connectionID string) ConnectionTelemetry {
+	t.Helper()
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case telemetry := <-f.exports:
+			for _, c := range telemetry {
+				if c.ConnectionID == connectionID {
+					return c
+				}
+			}
+		case <-deadline:
+			t.Fatalf("no telemetry exported for %s", connectionID)
+		}
+	}
+}
+
+func TestCdsTelemetryExport(t *testing.T) {
+	defer resendUnchanged()()
+	oldInterval := cdsTelemetryInterval
+	cdsTelemetryInterval = 10 * time.Millisecond
+	defer func() { cdsTelemetryInterval = oldInterval }()
+
+	sink := &fakeTelemetrySink{exports: make(chan []ConnectionTelemetry, 1)}
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	s.TelemetrySink = sink
+	stop := make(chan struct{})
+	defer close(stop)
+	s.StartTelemetryExport(stop)
+
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	resp := stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+
+	first := sink.next(t, key)
+	if first.NodeID != testNodeID || first.PeerAddr != "10.1.1.1:5000" {
+		t.Errorf("telemetry for %q %q, want %q %q", first.NodeID, first.PeerAddr, testNodeID, "10.1.1.1:5000")
+	}
+	if first.Pushes != 1 || first.Bytes != int64(resp.Size()) {
+		t.Errorf("got %d pushes of %d bytes, want 1 of %d", first.Pushes, first.Bytes, resp.Size())
+	}
+
+	// The envoy rejects the response, and gets a new push.
+	nack := clusterRequest(testNodeID)
+	nack.ResponseNonce = resp.Nonce
+	nack.ErrorDetail = &rpc.Status{Message: "invalid cluster"}
+	stream.sendRequest(nack)
+	waitTelemetry(t, sink, key, func(c ConnectionTelemetry) bool { return c.Nacks == 1 && c.AckLatency > 0 })
+	cdsPushAll(nil)
+	stream.recvResponse(t)
+	waitTelemetry(t, sink, key, func(c ConnectionTelemetry) bool { return c.Pushes == 2 })
+}
+
+// waitTelemetry waits for an export of the connection matching f.
+func waitTelemetry(t *testing.T, sink *fakeTelemetrySink, connectionID string, f func(ConnectionTelemetry) bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		c := sink.next(t, connectionID)
+		if f(c) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected telemetry %+v", c)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// cdsThrottleGenerations is the number of concurrent cluster generations above which pilot
+	// is overloaded, set with PILOT_CDS_THROTTLE_GENERATIONS. Update pushes are then deferred
+	// by cdsThrottleDelay, shedding load. Zero (the default) disables the throttle.
+	cdsThrottleGenerations = envInt("PILOT_CDS_THROTTLE_GENERATIONS", 0)
+
+	// cdsThrottleDelay is the deferral of update pushes while pilot is overloaded, set with
+	// PILOT_CDS_THROTTLE_DELAY. Pushes deferred together are coalesced.
+	cdsThrottleDelay = envDuration("PILOT_CDS_THROTTLE_DELAY", time.Second)
+
+	// cdsGenerationsInFlight is the number of cluster generations in progress.
+	cdsGenerationsInFlight int32
+
+	// cdsLoad returns the current generation load, compared with cdsThrottleGenerations.
+	cdsLoad = func() int {
+		return int(atomic.LoadInt32(&cdsGenerationsInFlight))
+	}
+)
+
+// cdsOverloaded returns true if update pushes should be deferred.
+func cdsOverloaded() bool {
+	return cdsThrottleGenerations > 0 && cdsLoad() > cdsThrottleGenerations
+}
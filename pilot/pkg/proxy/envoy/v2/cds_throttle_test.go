@@ -0,0 +1,57 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCdsThrottleOverloaded(t *testing.T) {
+	defer resendUnchanged()()
+	oldGenerations, oldDelay, oldLoad := cdsThrottleGenerations, cdsThrottleDelay, cdsLoad
+	cdsThrottleGenerations, cdsThrottleDelay = 10, 200*time.Millisecond
+	// Simulated high load.
+	cdsLoad = func() int { return 100 }
+	defer func() { cdsThrottleGenerations, cdsThrottleDelay, cdsLoad = oldGenerations, oldDelay, oldLoad }()
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	throttled := counterValue(t, cdsThrottledCounter)
+
+	// The initial push goes through.
+	start := time.Now()
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	if elapsed := time.Since(start); elapsed >= cdsThrottleDelay {
+		t.Errorf("initial push took %v, want it not deferred", elapsed)
+	}
+	waitCdsCon(t, testNodeID)
+
+	// Updates are deferred and coalesced.
+	cdsPushAll(nil)
+	cdsPushAll(nil)
+	stream.expectNoResponse(t, cdsThrottleDelay/2)
+	stream.recvResponse(t)
+	stream.expectNoResponse(t, cdsThrottleDelay)
+	if n := counterValue(t, cdsThrottledCounter); n != throttled+1 {
+		t.Errorf("throttled counter increased by %v, want 1", n-throttled)
+	}
+}
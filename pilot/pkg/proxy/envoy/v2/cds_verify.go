@@ -0,0 +1,67 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"fmt"
+	"os"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+
+	"istio.io/istio/pkg/log"
+)
+
+var (
+	// cdsVerifyMarshal unmarshals each response back and compares it with the generated
+	// clusters, to catch marshaling corruption. Expensive, for debugging only: set with
+	// PILOT_DEBUG_CDS_VERIFY=1.
+	cdsVerifyMarshal = os.Getenv("PILOT_DEBUG_CDS_VERIFY") == "1"
+)
+
+// verifyRoundTrip returns the differences between the clusters and the resources of the
+// response built from them.
+func verifyRoundTrip(clusters []*xdsapi.Cluster, response *xdsapi.DiscoveryResponse) []string {
+	var diffs []string
+	source := make([]*xdsapi.Cluster, 0, len(clusters))
+	for _, c := range clusters {
+		if c != nil {
+			source = append(source, c)
+		}
+	}
+	if len(source) != len(response.Resources) {
+		diffs = append(diffs, fmt.Sprintf("%d clusters marshaled to %d resources", len(source), len(response.Resources)))
+	}
+	for i := 0; i < len(source) && i < len(response.Resources); i++ {
+		c := &xdsapi.Cluster{}
+		if err := types.UnmarshalAny(&response.Resources[i], c); err != nil {
+			diffs = append(diffs, fmt.Sprintf("resource %d (cluster %q): %v", i, source[i].Name, err))
+			continue
+		}
+		if !proto.Equal(c, source[i]) {
+			diffs = append(diffs, fmt.Sprintf("resource %d: cluster %q unmarshals to a different cluster %q",
+				i, source[i].Name, c.Name))
+		}
+	}
+	return diffs
+}
+
+// checkRoundTrip logs the marshaling discrepancies of the response to the node.
+func checkRoundTrip(node string, clusters []*xdsapi.Cluster, response *xdsapi.DiscoveryResponse) {
+	for _, d := range verifyRoundTrip(clusters, response) {
+		log.Errorf("CDS: marshaling discrepancy in PUSH for %s, version %s: %s", node, response.VersionInfo, d)
+	}
+}
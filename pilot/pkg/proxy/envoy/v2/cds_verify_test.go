@@ -0,0 +1,51 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/gogo/protobuf/types"
+)
+
+func TestCdsVerifyRoundTrip(t *testing.T) {
+	clusters := []*xdsapi.Cluster{
+		{Name: "outbound|80||a.default.svc.cluster.local", ConnectTimeout: time.Second},
+		nil,
+		{Name: "outbound|80||b.default.svc.cluster.local", ConnectTimeout: time.Second},
+	}
+	response := (&CdsConnection{}).clusters(clusters)
+	if diffs := verifyRoundTrip(clusters, response); len(diffs) != 0 {
+		t.Errorf("consistent response reported as %v", diffs)
+	}
+
+	// Marshaling corruption: the second resource holds another cluster.
+	other, _ := types.MarshalAny(&xdsapi.Cluster{Name: "outbound|80||c.default.svc.cluster.local"})
+	response.Resources[1] = *other
+	out := captureLog(t, func() {
+		checkRoundTrip(testNodeID, clusters, response)
+	})
+	if !strings.Contains(out, `cluster "outbound|80||b.default.svc.cluster.local" unmarshals to a different cluster`) {
+		t.Errorf("discrepancy not logged, log:\n%s", out)
+	}
+
+	response.Resources = response.Resources[:1]
+	if diffs := verifyRoundTrip(clusters, response); len(diffs) != 1 || !strings.Contains(diffs[0], "2 clusters marshaled to 1") {
+		t.Errorf("missing resource reported as %v", diffs)
+	}
+}
@@ -0,0 +1,968 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/gogo/googleapis/google/rpc"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestCdszLastPush(t *testing.T) {
+	cdsKeepLastPush = true
+	defer func() { cdsKeepLastPush = false }()
+
+	s := newTestServer(newFakeGenerator("outbound|80||lastpush.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+
+	stream.sendRequest(clusterRequest(testNodeID))
+	sent := stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+
+	body := waitLastPush(t, key)
+	if !strings.Contains(body, "outbound|80||lastpush.default.svc.cluster.local") {
+		t.Errorf("last push doesn't include the pushed cluster:\n%s", body)
+	}
+	if !strings.Contains(body, sent.Nonce) {
+		t.Errorf("last push doesn't include the nonce %q:\n%s", sent.Nonce, body)
+	}
+
+	if w := cdsz("lastpush=1&node=unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("lastpush for unknown node returned %d, want 404", w.Code)
+	}
+}
+
+// waitLastPush waits until a push is recorded for the node, since it's recorded after the
+// send completes, and returns the lastpush output.
+func waitLastPush(t *testing.T, node string) string {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		w := cdsz("lastpush=1&node=" + url.QueryEscape(node))
+		if w.Code == http.StatusOK {
+			return w.Body.String()
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("lastpush returned %d", w.Code)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCdszFreeze(t *testing.T) {
+	defer resendUnchanged()()
+	s := newTestServer(newFakeGenerator("outbound|80||freeze.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+
+	if w := cdsz("freeze=1&node=" + url.QueryEscape(key)); w.Code != http.StatusOK {
+		t.Fatalf("freeze returned %d", w.Code)
+	}
+	cdsPushAll(nil)
+	stream.expectNoResponse(t, 100*time.Millisecond)
+
+	cdsz("freeze=0&node=" + url.QueryEscape(key))
+	cdsPushAll(nil)
+	stream.recvResponse(t)
+
+	if w := cdsz("freeze=1&node=unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("freeze for unknown node returned %d, want 404", w.Code)
+	}
+}
+
+func TestCdszFlapping(t *testing.T) {
+	cdsTrackFlapping = true
+	defer func() { cdsTrackFlapping = false }()
+
+	stable := &xdsapi.Cluster{Name: "outbound|80||stable.default.svc.cluster.local", ConnectTimeout: time.Second}
+	flap := func(i int) *xdsapi.Cluster {
+		return &xdsapi.Cluster{
+			Name:           "outbound|80||flap.default.svc.cluster.local",
+			ConnectTimeout: time.Duration(1+i%2) * time.Second,
+		}
+	}
+	g := newFakeGenerator()
+	g.set(stable, flap(0))
+	s := newTestServer(g)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+	for i := 1; i <= cdsFlapMinPushes+1; i++ {
+		g.set(stable, flap(i))
+		cdsPushAll(nil)
+		stream.recvResponse(t)
+	}
+
+	flapping := map[string][]string{}
+	if err := json.Unmarshal(cdsz("flapping=1").Body.Bytes(), &flapping); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"outbound|80||flap.default.svc.cluster.local"}
+	if !reflect.DeepEqual(flapping[key], want) {
+		t.Errorf("flapping clusters = %v, want %v", flapping[key], want)
+	}
+}
+
+func TestCdszStuckInitial(t *testing.T) {
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+
+	// The proxy only sends fresh requests, never ACKs.
+	for i := 0; i < cdsStuckInitialRequests; i++ {
+		stream.sendRequest(clusterRequest(testNodeID))
+	}
+	stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		status := map[string]struct{ StuckInitial bool }{}
+		if err := json.Unmarshal(cdsz("").Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if status[key].StuckInitial {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection %s was not flagged as stuck: %v", key, status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// An ACK shows the proxy progressed.
+	ack := clusterRequest(testNodeID)
+	ack.ResponseNonce = "1"
+	stream.sendRequest(ack)
+	deadline = time.Now().Add(testTimeout)
+	for {
+		status := map[string]struct{ StuckInitial bool }{}
+		if err := json.Unmarshal(cdsz("").Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if !status[key].StuckInitial {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection %s still flagged as stuck after ACK", key)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCdszPushWait(t *testing.T) {
+	defer resendUnchanged()()
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+
+	stream.slow(100 * time.Millisecond)
+	start := time.Now()
+	w := cdsz("push=1&wait=1&node=" + url.QueryEscape(key))
+	if w.Code != http.StatusOK {
+		t.Fatalf("push and wait returned %d %s", w.Code, w.Body.String())
+	}
+	if len(stream.responses) != 1 {
+		t.Errorf("push and wait returned after %v, before the send completed", time.Since(start))
+	}
+
+	if w := cdsz("push=1&wait=1&node=unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("push and wait for an unknown node returned %d, want 404", w.Code)
+	}
+}
+
+func TestCdszSample(t *testing.T) {
+	defer resendUnchanged()()
+	cdsKeepLastPush = true
+	oldPercent := cdsSamplePercent
+	cdsSamplePercent = 0
+	defer func() {
+		cdsKeepLastPush = false
+		cdsSamplePercent = oldPercent
+	}()
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	nodes := []string{"sidecar~10.1.1.1~a.ns~ns.svc.cluster.local", "sidecar~10.1.1.2~b.ns~ns.svc.cluster.local"}
+	streams := []*fakeStream{}
+	keys := []string{}
+	for _, n := range nodes {
+		stream := newFakeStream("10.1.1.1:5000")
+		done := startClusterStream(s, stream)
+		defer func() {
+			stream.close()
+			_ = waitStreamDone(t, done)
+		}()
+		stream.sendRequest(clusterRequest(n))
+		stream.recvResponse(t)
+		streams = append(streams, stream)
+		keys = append(keys, waitCdsCon(t, n))
+	}
+
+	// Only the explicitly sampled connection records the push.
+	if w := cdsz("sample=1&node=" + url.QueryEscape(keys[0])); w.Code != http.StatusOK {
+		t.Fatalf("sample returned %d", w.Code)
+	}
+	cdsPushAll(nil)
+	for _, stream := range streams {
+		stream.recvResponse(t)
+	}
+
+	waitLastPush(t, keys[0])
+	if w := cdsz("lastpush=1&node=" + url.QueryEscape(keys[1])); w.Code != http.StatusNotFound {
+		t.Errorf("lastpush for the unsampled connection returned %d, want 404", w.Code)
+	}
+}
+
+func TestCdszSingle(t *testing.T) {
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+
+	w := cdsz("single=1&node=" + url.QueryEscape(key))
+	if w.Code != http.StatusOK {
+		t.Fatalf("single returned %d", w.Code)
+	}
+	con := struct{ PeerAddr string }{}
+	if err := json.Unmarshal(w.Body.Bytes(), &con); err != nil {
+		t.Fatal(err)
+	}
+	if con.PeerAddr != "10.1.1.1:5000" {
+		t.Errorf("single returned %s, want the connection from 10.1.1.1:5000", w.Body.String())
+	}
+
+	// A prefix of the key doesn't match.
+	if w := cdsz("single=1&node=" + url.QueryEscape(testNodeID)); w.Code != http.StatusNotFound {
+		t.Errorf("single for a key prefix returned %d, want 404", w.Code)
+	}
+}
+
+func TestCdszAckLatency(t *testing.T) {
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+
+	stream.sendRequest(clusterRequest(testNodeID))
+	resp := stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+
+	// The envoy takes 50ms to apply the config.
+	time.Sleep(50 * time.Millisecond)
+	ack := clusterRequest(testNodeID)
+	ack.VersionInfo = resp.VersionInfo
+	ack.ResponseNonce = resp.Nonce
+	stream.sendRequest(ack)
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		con := struct{ AckLatency time.Duration }{}
+		if err := json.Unmarshal(cdsz("single=1&node="+url.QueryEscape(key)).Body.Bytes(), &con); err != nil {
+			t.Fatal(err)
+		}
+		if con.AckLatency != 0 {
+			if con.AckLatency < 50*time.Millisecond || con.AckLatency > testTimeout {
+				t.Errorf("ACK latency %v, want about 50ms", con.AckLatency)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ACK latency not measured")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCdsBundle(t *testing.T) {
+	cdsKeepLastPush = true
+	defer func() { cdsKeepLastPush = false }()
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+	waitLastPush(t, key)
+
+	w := httptest.NewRecorder()
+	s.cdsBundleHandler(w, httptest.NewRequest("GET", "/debug/cdsz/bundle?node="+url.QueryEscape(key), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("bundle returned %d", w.Code)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment;") {
+		t.Errorf("bundle is not a download: %q", w.Header().Get("Content-Disposition"))
+	}
+	bundle := map[string]json.RawMessage{}
+	if err := json.Unmarshal(w.Body.Bytes(), &bundle); err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range []string{"Node", "Connection", "LastPush", "Clusters"} {
+		if _, found := bundle[section]; !found {
+			t.Errorf("bundle is missing %s:\n%s", section, w.Body.String())
+		}
+	}
+	if !strings.Contains(string(bundle["Clusters"]), "outbound|80||a.default.svc.cluster.local") {
+		t.Errorf("bundle clusters don't include the generated cluster: %s", bundle["Clusters"])
+	}
+	if _, found := bundle["Errors"]; found {
+		t.Errorf("bundle has errors: %s", bundle["Errors"])
+	}
+
+	w = httptest.NewRecorder()
+	s.cdsBundleHandler(w, httptest.NewRequest("GET", "/debug/cdsz/bundle?node=unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("bundle for an unknown node returned %d, want 404", w.Code)
+	}
+}
+
+func TestCdszClusters(t *testing.T) {
+	s := newTestServer(newFakeGenerator(
+		"outbound|80||b.default.svc.cluster.local", "outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+
+	w := httptest.NewRecorder()
+	s.cdsz(w, httptest.NewRequest("GET", "/debug/cdsz?clusters=1&node="+url.QueryEscape(key), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("clusters returned %d", w.Code)
+	}
+	clusters := []struct {
+		Name string `json:"name"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &clusters); err != nil {
+		t.Fatalf("%v:\n%s", err, w.Body.String())
+	}
+	if len(clusters) != 2 || clusters[0].Name != "outbound|80||a.default.svc.cluster.local" ||
+		clusters[1].Name != "outbound|80||b.default.svc.cluster.local" {
+		t.Errorf("got clusters %+v, want a and b in the pushed order", clusters)
+	}
+
+	w = httptest.NewRecorder()
+	s.cdsz(w, httptest.NewRequest("GET", "/debug/cdsz?clusters=1&node=unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("clusters for an unknown node returned %d, want 404", w.Code)
+	}
+}
+
+// waitEvents waits until the connection logged n events.
+func waitEvents(t *testing.T, con *CdsConnection, n int) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for len(con.eventList()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got events %v, want %d", con.eventList(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCdszEvents(t *testing.T) {
+	defer resendUnchanged()()
+	s := newTestServer(newFakeGenerator("outbound|80||events.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+
+	stream.sendRequest(clusterRequest(testNodeID))
+	first := stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+	con := getCdsCon(key)
+	ack := clusterRequest(testNodeID)
+	ack.VersionInfo, ack.ResponseNonce = first.VersionInfo, first.Nonce
+	stream.sendRequest(ack)
+	waitEvents(t, con, 4)
+
+	cdsPushAll(nil)
+	second := stream.recvResponse(t)
+	nack := clusterRequest(testNodeID)
+	nack.VersionInfo, nack.ResponseNonce = second.VersionInfo, second.Nonce
+	nack.ErrorDetail = &rpc.Status{Message: "invalid cluster"}
+	stream.sendRequest(nack)
+	waitEvents(t, con, 6)
+	stream.close()
+	_ = waitStreamDone(t, done)
+
+	// The log of the closed connection is kept.
+	w := cdsz("events=1&node=" + url.QueryEscape(key))
+	if w.Code != http.StatusOK {
+		t.Fatalf("events=1 returned %d", w.Code)
+	}
+	events := []cdsEvent{}
+	if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+		t.Fatal(err)
+	}
+	want := []cdsEvent{
+		{Type: cdsEventConnect, Detail: "10.1.1.1:5000"},
+		{Type: cdsEventRequest},
+		{Type: cdsEventPush, Detail: "initial request, version " + first.VersionInfo + ", 1 clusters"},
+		{Type: cdsEventAck, Detail: "version " + first.VersionInfo},
+		{Type: cdsEventPush, Detail: "update, version " + second.VersionInfo + ", 1 clusters"},
+		{Type: cdsEventNack, Detail: "version " + second.VersionInfo + ": invalid cluster"},
+		{Type: cdsEventDisconnect, Detail: "EOF"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got events %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i].Type != want[i].Type || events[i].Detail != want[i].Detail {
+			t.Errorf("event %d is %s %q, want %s %q", i, events[i].Type, events[i].Detail, want[i].Type, want[i].Detail)
+		}
+		if i > 0 && events[i].Time.Before(events[i-1].Time) {
+			t.Errorf("event %d recorded before event %d", i, i-1)
+		}
+	}
+
+	if w := cdsz("events=1&node=unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("events=1 for an unknown node returned %d, want 404", w.Code)
+	}
+}
+
+func TestCdsEventLogBounded(t *testing.T) {
+	oldSize := cdsEventLogSize
+	cdsEventLogSize = 3
+	defer func() { cdsEventLogSize = oldSize }()
+
+	l := &cdsEventLog{}
+	for _, d := range []string{"1", "2", "3", "4", "5"} {
+		l.add(cdsEventPush, d)
+	}
+	got := []string{}
+	for _, e := range l.list() {
+		got = append(got, e.Detail)
+	}
+	if want := []string{"3", "4", "5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want the last 3 events %v", got, want)
+	}
+}
+
+func TestCdszGroups(t *testing.T) {
+	shared := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	distinct := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local",
+		"outbound|80||b.default.svc.cluster.local"))
+	servers := []*DiscoveryServer{shared, shared, shared, distinct}
+	for i, s := range servers {
+		stream := newFakeStream("10.1.1.1:5000")
+		done := startClusterStream(s, stream)
+		defer func() {
+			stream.close()
+			_ = waitStreamDone(t, done)
+		}()
+		stream.sendRequest(clusterRequest("sidecar~10.1.1." + strconv.Itoa(i) + "~app.ns~ns.svc.cluster.local"))
+		stream.recvResponse(t)
+	}
+
+	// The push is recorded after the send.
+	deadline := time.Now().Add(testTimeout)
+	for configGroups().Connections < len(servers) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	w := cdsz("groups=1")
+	groups := &cdsConfigGroups{}
+	if err := json.Unmarshal(w.Body.Bytes(), groups); err != nil {
+		t.Fatal(err)
+	}
+	if groups.Connections != 4 || groups.DistinctConfigs != 2 || len(groups.Groups) != 2 {
+		t.Fatalf("got %s, want 4 connections sharing 2 configs", w.Body.String())
+	}
+	if len(groups.Groups[0].Connections) != 3 || len(groups.Groups[1].Connections) != 1 {
+		t.Errorf("got groups of %d and %d connections, want 3 and 1",
+			len(groups.Groups[0].Connections), len(groups.Groups[1].Connections))
+	}
+	if !strings.HasPrefix(groups.Groups[1].Connections[0], "sidecar~10.1.1.3~") {
+		t.Errorf("distinct config served to %s, want 10.1.1.3", groups.Groups[1].Connections[0])
+	}
+}
+
+func TestCdszDebugTTL(t *testing.T) {
+	debug := cdsDebugEnabled
+	old := debug()
+	defer setCdsDebug(old, 0)
+
+	// Without ttl, debug stays on.
+	cdsz("debug=1")
+	time.Sleep(20 * time.Millisecond)
+	if !debug() {
+		t.Error("debug=1 without ttl was reverted")
+	}
+
+	if w := cdsz("debug=1&ttl=x"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid ttl returned %d, want 400", w.Code)
+	}
+
+	// The handler takes seconds, the revert is tested with a shorter ttl.
+	setCdsDebug(true, 20*time.Millisecond)
+	if !debug() {
+		t.Error("debug not enabled")
+	}
+	deadline := time.Now().Add(testTimeout)
+	for debug() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if debug() {
+		t.Error("debug not reverted after the ttl")
+	}
+
+	// A later change cancels the revert.
+	setCdsDebug(true, 20*time.Millisecond)
+	cdsz("debug=1")
+	time.Sleep(50 * time.Millisecond)
+	if !debug() {
+		t.Error("debug=1 reverted by the ttl of a previous change")
+	}
+}
+
+func TestCdszDebugTTLDuringPush(t *testing.T) {
+	defer resendUnchanged()()
+	old := cdsDebugEnabled()
+	defer setCdsDebug(old, 0)
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	captureLog(t, func() {
+		stream.sendRequest(clusterRequest(testNodeID))
+		stream.recvResponse(t)
+		waitCdsCon(t, testNodeID)
+
+		// The pushes read the verbosity while the ttl turns it off.
+		for i := 0; i < 5; i++ {
+			setCdsDebug(true, time.Millisecond)
+			cdsPushAll(nil)
+			stream.recvResponse(t)
+		}
+		stream.close()
+		if err := waitStreamDone(t, done); err != nil {
+			t.Errorf("stream returned %v", err)
+		}
+	})
+}
+
+func TestCdszPushSuccessRatio(t *testing.T) {
+	defer resendUnchanged()()
+	con := &CdsConnection{}
+	data, _ := json.Marshal(con)
+	if strings.Contains(string(data), "PushSuccessRatio") {
+		t.Errorf("ratio listed before any send: %s", data)
+	}
+	response := con.clusters(nil)
+	for i := 0; i < 3; i++ {
+		con.recordDelivered(response)
+	}
+	con.recordSendFailure()
+	got := struct{ PushSuccessRatio float64 }{}
+	data, _ = json.Marshal(con)
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.PushSuccessRatio != 0.75 {
+		t.Errorf("PushSuccessRatio = %v, want 0.75 for 3 of 4 sends", got.PushSuccessRatio)
+	}
+
+	// The ratio of closed connections is observed.
+	observed := sampleCount(t, cdsPushSuccessRatio)
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	waitCdsCon(t, testNodeID)
+	stream.failSends(errors.New("connection reset"))
+	cdsPushAll(nil)
+	if err := waitStreamDone(t, done); err == nil {
+		t.Error("stream didn't fail on the send failure")
+	}
+	if n := sampleCount(t, cdsPushSuccessRatio); n != observed+1 {
+		t.Errorf("success ratio histogram has %d new observations, want 1", n-observed)
+	}
+}
+
+func TestCdszAckNackCorrelation(t *testing.T) {
+	defer resendUnchanged()()
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	first := stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+	con := getCdsCon(key)
+	reply := func(resp *xdsapi.DiscoveryResponse, nack string) {
+		req := clusterRequest(testNodeID)
+		req.VersionInfo, req.ResponseNonce = resp.VersionInfo, resp.Nonce
+		if nack != "" {
+			req.ErrorDetail = &rpc.Status{Message: nack}
+		}
+		stream.sendRequest(req)
+	}
+	type record struct {
+		AckedVersion  string
+		LastNack      string
+		StaleRequests int
+	}
+	single := func() record {
+		r := record{}
+		if err := json.Unmarshal(cdsz("single=1&node="+url.QueryEscape(key)).Body.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	reply(first, "")
+	waitEvents(t, con, 4)
+	if r := single(); r.AckedVersion != first.VersionInfo || r.LastNack != "" {
+		t.Errorf("after ACK got %+v, want version %s acked", r, first.VersionInfo)
+	}
+
+	cdsPushAll(nil)
+	second := stream.recvResponse(t)
+	reply(second, "invalid cluster")
+	waitEvents(t, con, 6)
+	if r := single(); r.AckedVersion != first.VersionInfo || r.LastNack != "invalid cluster" {
+		t.Errorf("after NACK got %+v, want version %s still acked and the NACK error", r, first.VersionInfo)
+	}
+
+	// A late reply to the first response is stale.
+	reply(first, "")
+	waitEvents(t, con, 7)
+	if r := single(); r.StaleRequests != 1 || r.AckedVersion != first.VersionInfo {
+		t.Errorf("after a stale ACK got %+v, want 1 stale request", r)
+	}
+}
+
+func TestCdszConnectionView(t *testing.T) {
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	resp := stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+	ack := clusterRequest(testNodeID)
+	ack.VersionInfo, ack.ResponseNonce = resp.VersionInfo, resp.Nonce
+	stream.sendRequest(ack)
+	waitEvents(t, getCdsCon(key), 4)
+
+	type view struct {
+		NodeID    string
+		ProxyID   string
+		Namespace string
+		Connect   time.Time
+		LastPush  *time.Time
+		Pushes    int
+		Acks      int
+		Nacks     int
+	}
+	all := map[string]view{}
+	if err := json.Unmarshal(cdsz("").Body.Bytes(), &all); err != nil {
+		t.Fatal(err)
+	}
+	con, f := all[key]
+	if !f {
+		t.Fatalf("connection %s missing in %v", key, all)
+	}
+	if con.NodeID != testNodeID || con.ProxyID != "app-644fc65469-96dza.testns" || con.Namespace != "testns" {
+		t.Errorf("got node %q, proxy %q, namespace %q, want %q", con.NodeID, con.ProxyID, con.Namespace, testNodeID)
+	}
+	if con.Connect.IsZero() || con.LastPush == nil || con.LastPush.Before(con.Connect) {
+		t.Errorf("got connect time %v and last push %v", con.Connect, con.LastPush)
+	}
+	if con.Pushes != 1 || con.Acks != 1 || con.Nacks != 0 {
+		t.Errorf("got %d pushes, %d ACKs, %d NACKs, want 1, 1, 0", con.Pushes, con.Acks, con.Nacks)
+	}
+}
+
+func TestCdszActivityTimes(t *testing.T) {
+	defer resendUnchanged()()
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+
+	type view struct {
+		Connect     time.Time
+		Uptime      time.Duration
+		LastPush    time.Time
+		LastRequest time.Time
+	}
+	// The push is recorded once Send returns.
+	get := func(after time.Time) view {
+		t.Helper()
+		deadline := time.Now().Add(testTimeout)
+		for {
+			v := view{}
+			if err := json.Unmarshal(cdsz("single=1&node="+url.QueryEscape(key)).Body.Bytes(), &v); err != nil {
+				t.Fatal(err)
+			}
+			if v.LastPush.After(after) {
+				return v
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("last push %v, want after %v", v.LastPush, after)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	first := get(time.Time{})
+	if first.LastRequest.Before(first.Connect) || first.Uptime <= 0 {
+		t.Errorf("got connect %v, last request %v, uptime %v", first.Connect, first.LastRequest, first.Uptime)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	cdsPushAll(nil)
+	stream.recvResponse(t)
+	second := get(first.LastPush)
+	if second.Uptime <= first.Uptime {
+		t.Errorf("uptime %v after %v, want increasing", second.Uptime, first.Uptime)
+	}
+	if !second.LastRequest.Equal(first.LastRequest) {
+		t.Errorf("last request moved from %v to %v without a request", first.LastRequest, second.LastRequest)
+	}
+}
+
+func TestCdszNackCount(t *testing.T) {
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	resp := stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+	con := getCdsCon(key)
+
+	events := 3
+	for _, msg := range []string{"invalid cluster", "duplicate cluster name"} {
+		nack := clusterRequest(testNodeID)
+		nack.VersionInfo, nack.ResponseNonce = resp.VersionInfo, resp.Nonce
+		nack.ErrorDetail = &rpc.Status{Message: msg}
+		stream.sendRequest(nack)
+		events++
+		waitEvents(t, con, events)
+	}
+
+	r := struct {
+		Nacks    int
+		LastNack string
+	}{}
+	if err := json.Unmarshal(cdsz("single=1&node="+url.QueryEscape(key)).Body.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Nacks != 2 || r.LastNack != "duplicate cluster name" {
+		t.Errorf("got %d NACKs, last %q, want 2 and the last error", r.Nacks, r.LastNack)
+	}
+}
+
+func TestCdszConnectionDebug(t *testing.T) {
+	defer resendUnchanged()()
+	old := cdsDebugEnabled()
+	setCdsDebug(false, 0)
+	defer setCdsDebug(old, 0)
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	ids := []string{
+		"sidecar~10.1.1.1~reviews-v1.ns~ns.svc.cluster.local",
+		"sidecar~10.1.1.2~ratings-v1.ns~ns.svc.cluster.local",
+	}
+	streams, keys := []*fakeStream{}, []string{}
+	for _, id := range ids {
+		stream := newFakeStream("10.1.1.1:5000")
+		done := startClusterStream(s, stream)
+		defer func() {
+			stream.close()
+			_ = waitStreamDone(t, done)
+		}()
+		stream.sendRequest(clusterRequest(id))
+		stream.recvResponse(t)
+		streams, keys = append(streams, stream), append(keys, waitCdsCon(t, id))
+	}
+
+	if w := cdsz("debug=1&node=" + url.QueryEscape(keys[0])); w.Code != http.StatusOK {
+		t.Fatalf("debug for a connection returned %d", w.Code)
+	}
+	if w := cdsz("debug=1&node=unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("debug for an unknown connection returned %d, want 404", w.Code)
+	}
+	if w := cdsz("debug=1&ttl=10&node=" + url.QueryEscape(keys[0])); w.Code != http.StatusBadRequest {
+		t.Errorf("debug ttl for a connection returned %d, want 400", w.Code)
+	}
+	out := captureLog(t, func() {
+		cdsPushAll(nil)
+		for _, stream := range streams {
+			stream.recvResponse(t)
+		}
+		// The log of the push follows the send.
+		time.Sleep(20 * time.Millisecond)
+	})
+	if !strings.Contains(out, "CDS: PUSH for "+keys[0]) {
+		t.Errorf("no verbose log for the debugged connection, log:\n%s", out)
+	}
+	if strings.Contains(out, keys[1]) {
+		t.Errorf("verbose log for the other connection, log:\n%s", out)
+	}
+}
+
+// cdszKeys returns the connection keys listed by Cdsz for the query, in order.
+func cdszKeys(t *testing.T, query string) []string {
+	t.Helper()
+	w := cdsz(query)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s returned %d", query, w.Code)
+	}
+	dec := json.NewDecoder(w.Body)
+	if _, err := dec.Token(); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, tok.(string))
+		var con json.RawMessage
+		if err := dec.Decode(&con); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+func TestCdszFilters(t *testing.T) {
+	s := newTestServer(newFakeGenerator())
+	now := time.Now()
+	cons := map[string]*CdsConnection{
+		"sidecar~10.1.1.1~a.ns1~ns1.svc.cluster.local-filter1": {
+			modelNode:    &model.Proxy{ID: "a.ns1"},
+			Connect:      now.Add(-time.Minute),
+			lastPushTime: now.Add(-time.Second),
+		},
+		"sidecar~10.1.1.2~b.ns2~ns2.svc.cluster.local-filter2": {
+			modelNode:    &model.Proxy{ID: "b.ns2"},
+			Connect:      now.Add(-3 * time.Minute),
+			lastPushTime: now.Add(-time.Minute),
+		},
+		"sidecar~10.1.1.3~c.ns1~ns1.svc.cluster.local-filter3": {
+			modelNode: &model.Proxy{ID: "c.ns1"},
+			Connect:   now.Add(-2 * time.Minute),
+		},
+	}
+	for k, con := range cons {
+		if err := s.addCdsCon(k, con); err != nil {
+			t.Fatal(err)
+		}
+		defer s.removeCdsCon(con)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"node=-filter", []string{"a.ns1", "b.ns2", "c.ns1"}},
+		{"node=10.1.1.2~", []string{"b.ns2"}},
+		{"node=-filter&namespace=ns1", []string{"a.ns1", "c.ns1"}},
+		{"node=-filter&namespace=other", []string{}},
+		{"node=-filter&sort=connect", []string{"b.ns2", "c.ns1", "a.ns1"}},
+		{"node=-filter&sort=lastpush", []string{"c.ns1", "b.ns2", "a.ns1"}},
+	} {
+		got := []string{}
+		for _, k := range cdszKeys(t, tc.query) {
+			got = append(got, getCdsCon(k).modelNode.ID)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s listed %v, want %v", tc.query, got, tc.want)
+		}
+	}
+	if w := cdsz("sort=size"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid sort returned %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/types"
+)
+
+// configDump is returned by /debug/config_dump, with the config of each stream of the proxy
+// by connection key.
+type configDump struct {
+	Clusters  map[string]*dumpedResponse
+	Endpoints map[string]*dumpedResponse
+	Listeners map[string]*dumpedResponse
+}
+
+// dumpedResponse is the config of a stream.
+type dumpedResponse struct {
+	// Exact is set if Response has the resources last sent on the stream. Otherwise they
+	// are generated from the current config, and may be newer.
+	Exact bool
+
+	// SentVersion is the VersionInfo of the last response sent, for CDS.
+	SentVersion string `json:",omitempty"`
+
+	Response json.RawMessage `json:",omitempty"`
+	Error    string          `json:",omitempty"`
+}
+
+// configDumpHandler implements /debug/config_dump?proxy=NODEID, returning the CDS, EDS and LDS
+// resources of the streams of the proxy. RDS is not served by this DiscoveryServer.
+//
+// The clusters are the last response sent when retained (PILOT_DEBUG_CDS_LASTPUSH=1 and
+// sampled), or else generated again with the same pipeline as a push: they are exactly the
+// ones sent when their version, a hash of their content, matches SentVersion. The listeners
+// are the ones last sent, the endpoints are the current ones.
+func (s *DiscoveryServer) configDumpHandler(w http.ResponseWriter, req *http.Request) {
+	_ = req.ParseForm()
+	proxy := req.Form.Get("proxy")
+	if proxy == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing proxy=NODEID"))
+		return
+	}
+	out := &configDump{
+		Clusters:  map[string]*dumpedResponse{},
+		Endpoints: map[string]*dumpedResponse{},
+		Listeners: map[string]*dumpedResponse{},
+	}
+	for k, con := range cdsConnections.nodeSnapshot(proxy) {
+		out.Clusters[k] = s.dumpClusters(con.(*CdsConnection))
+	}
+	for k, con := range edsConnections.nodeSnapshot(proxy) {
+		out.Endpoints[k] = s.dumpEndpoints(con.(*EdsConnection))
+	}
+	for k, con := range ldsConnections.nodeSnapshot(proxy) {
+		out.Listeners[k] = dumpListeners(con.(*LdsConnection))
+	}
+	if len(out.Clusters)+len(out.Endpoints)+len(out.Listeners) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = w.Write(data)
+}
+
+func (s *DiscoveryServer) dumpClusters(con *CdsConnection) *dumpedResponse {
+	con.mutex.Lock()
+	nodeID, node, network, profile := con.nodeID, con.modelNode, con.network, con.profile
+	rec, sent := con.lastPush, con.ack.sentVersion
+	con.mutex.Unlock()
+	out := &dumpedResponse{SentVersion: sent}
+	if rec != nil && !rec.Truncated && rec.VersionInfo == sent {
+		response := &xdsapi.DiscoveryResponse{}
+		if err := response.Unmarshal(rec.response); err == nil {
+			out.Exact = true
+			out.setResponse(response)
+			return out
+		}
+	}
+	if node == nil {
+		out.Error = "no request received"
+		return out
+	}
+	clusters, _, err := s.nodeClusters(context.Background(), nodeID, node, network, profile, false)
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	// Without the subscription of the stream: an envoy subscribed to some clusters gets
+	// another version.
+	response := (&CdsConnection{}).clusters(clusters)
+	out.Exact = response.VersionInfo == sent
+	out.setResponse(response)
+	return out
+}
+
+func (s *DiscoveryServer) dumpEndpoints(con *EdsConnection) *dumpedResponse {
+	con.mutex.Lock()
+	clusters := append([]string{}, con.Clusters...)
+	con.mutex.Unlock()
+	out := &dumpedResponse{}
+	out.setResponse(s.endpoints(clusters))
+	return out
+}
+
+func dumpListeners(con *LdsConnection) *dumpedResponse {
+	con.mutex.Lock()
+	listeners := con.HTTPListeners
+	con.mutex.Unlock()
+	response := &xdsapi.DiscoveryResponse{TypeUrl: listenerType}
+	for _, l := range listeners {
+		if a, err := types.MarshalAny(l); err == nil {
+			response.Resources = append(response.Resources, *a)
+		}
+	}
+	out := &dumpedResponse{Exact: true}
+	out.setResponse(response)
+	return out
+}
+
+// setResponse sets the response in its json form, with the resources unpacked.
+func (d *dumpedResponse) setResponse(response *xdsapi.DiscoveryResponse) {
+	var buf bytes.Buffer
+	jsonm := &jsonpb.Marshaler{}
+	if err := jsonm.Marshal(&buf, response); err != nil {
+		d.Error = err.Error()
+		return
+	}
+	d.Response = buf.Bytes()
+}
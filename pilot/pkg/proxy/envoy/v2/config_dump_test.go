@@ -0,0 +1,96 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+)
+
+func configDumpRequest(s *DiscoveryServer, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.configDumpHandler(w, httptest.NewRequest("GET", "/debug/config_dump?"+query, nil))
+	return w
+}
+
+func TestConfigDump(t *testing.T) {
+	const cluster = "outbound|80||a.default.svc.cluster.local"
+	g := newFakeGenerator(cluster)
+	s := newTestServer(g)
+	addTestEdsCluster(s, cluster)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startAdsStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	waitCdsCon(t, testNodeID)
+	stream.sendRequest(&xdsapi.DiscoveryRequest{Node: &core.Node{Id: testNodeID}, TypeUrl: endpointType, ResourceNames: []string{cluster}})
+	stream.recvResponse(t)
+	stream.sendRequest(&xdsapi.DiscoveryRequest{Node: &core.Node{Id: testNodeID}, TypeUrl: listenerType})
+	stream.recvResponse(t)
+
+	w := configDumpRequest(s, "proxy="+url.QueryEscape(testNodeID))
+	if w.Code != http.StatusOK {
+		t.Fatalf("config_dump returned %d: %s", w.Code, w.Body.String())
+	}
+	dump := &configDump{}
+	if err := json.Unmarshal(w.Body.Bytes(), dump); err != nil {
+		t.Fatalf("invalid config_dump response %q: %v", w.Body.String(), err)
+	}
+	if len(dump.Clusters) != 1 || len(dump.Endpoints) != 1 || len(dump.Listeners) != 1 {
+		t.Fatalf("got %d CDS, %d EDS and %d LDS streams, want 1 of each",
+			len(dump.Clusters), len(dump.Endpoints), len(dump.Listeners))
+	}
+	for _, d := range dump.Clusters {
+		if !d.Exact || d.SentVersion == "" || !strings.Contains(string(d.Response), cluster) {
+			t.Errorf("got clusters %+v, want the clusters sent", d)
+		}
+	}
+	for _, d := range dump.Endpoints {
+		if !strings.Contains(string(d.Response), cluster) {
+			t.Errorf("got endpoints %s, want the assignment of %s", d.Response, cluster)
+		}
+	}
+
+	// Once the config changed, the clusters generated are no longer the ones sent.
+	g.setClusters("outbound|80||b.default.svc.cluster.local")
+	cdsClusterCache.clear()
+	dump = &configDump{}
+	if err := json.Unmarshal(configDumpRequest(s, "proxy="+url.QueryEscape(testNodeID)).Body.Bytes(), dump); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range dump.Clusters {
+		if d.Exact {
+			t.Errorf("got clusters %+v flagged as sent after a config change", d)
+		}
+	}
+
+	if w := configDumpRequest(s, "proxy=unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("config_dump of an unknown proxy returned %d, want 404", w.Code)
+	}
+	if w := configDumpRequest(s, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("config_dump without proxy returned %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSink records the connection events.
+type fakeSink struct {
+	mutex   sync.Mutex
+	added   []ConnectionEvent
+	removed []ConnectionEvent
+}
+
+func (f *fakeSink) ConnectionAdded(event ConnectionEvent) {
+	f.mutex.Lock()
+	f.added = append(f.added, event)
+	f.mutex.Unlock()
+}
+
+func (f *fakeSink) ConnectionRemoved(event ConnectionEvent) {
+	f.mutex.Lock()
+	f.removed = append(f.removed, event)
+	f.mutex.Unlock()
+}
+
+func TestConnectionSink(t *testing.T) {
+	sink := &fakeSink{}
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	s.ConnectionSink = sink
+	s.PilotID = "pilot-1"
+
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+	stream.close()
+	if err := waitStreamDone(t, done); err != nil {
+		t.Errorf("stream returned %v", err)
+	}
+
+	want := ConnectionEvent{NodeID: testNodeID, ConnectionID: key, PeerAddr: "10.1.1.1:5000", PilotID: "pilot-1"}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if len(sink.added) != 1 || sink.added[0] != want {
+		t.Errorf("added events = %v, want [%v]", sink.added, want)
+	}
+	if len(sink.removed) != 1 || sink.removed[0] != want {
+		t.Errorf("removed events = %v, want [%v]", sink.removed, want)
+	}
+}
+
+func TestCdsConnectDisconnectRace(t *testing.T) {
+	sink := &fakeSink{}
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	s.ConnectionSink = sink
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream := newFakeStream("10.1.1.1:5000")
+			done := startClusterStream(s, stream)
+			if i%2 == 0 {
+				// The request races with the disconnect.
+				stream.sendRequest(clusterRequest("sidecar~10.1.2." + strconv.Itoa(i) + "~app.ns~ns.svc.cluster.local"))
+			}
+			stream.close()
+			_ = waitStreamDone(t, done)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, k := range cdsConnections.keys() {
+		if k == "" || strings.HasPrefix(k, "sidecar~10.1.2.") {
+			t.Errorf("stray connection %q after disconnect", k)
+		}
+	}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if len(sink.added) != len(sink.removed) {
+		t.Errorf("%d connections added and %d removed", len(sink.added), len(sink.removed))
+	}
+	for _, e := range sink.added {
+		if e.ConnectionID == "" {
+			t.Error("connection added with an empty key")
+		}
+	}
+}
@@ -44,7 +44,19 @@ func (s *DiscoveryServer) InitDebug(mux *http.ServeMux, sctl *aggregate.Controll
 
 	mux.HandleFunc("/debug/edsz", EDSz)
 
-	mux.HandleFunc("/debug/cdsz", Cdsz)
+	mux.HandleFunc("/debug/cdsz", s.cdsz)
+
+	mux.HandleFunc("/debug/cdsz/selftest", s.cdsSelfTest)
+
+	mux.HandleFunc("/debug/cdsz/bundle", s.cdsBundleHandler)
+
+	mux.HandleFunc("/debug/cdsz/deps", s.cdsDepsHandler)
+
+	mux.HandleFunc("/debug/syncz", s.syncz)
+
+	mux.HandleFunc("/debug/connectionsz", connectionsz)
+
+	mux.HandleFunc("/debug/config_dump", s.configDumpHandler)
 
 	mux.HandleFunc("/debug/ldsz", LDSz)
 
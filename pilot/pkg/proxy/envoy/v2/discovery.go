@@ -15,11 +15,17 @@
 package v2
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	ads "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
 	"google.golang.org/grpc"
 
 	"istio.io/istio/pilot/pkg/model"
@@ -36,6 +42,11 @@ var (
 	versionMutex sync.Mutex
 	// version is update by registry events.
 	version = time.Now()
+
+	// noncePrefix distinguishes the nonces of this pilot run, nonceCount the nonces within
+	// the run.
+	noncePrefix = randomNoncePrefix()
+	nonceCount  uint64
 )
 
 const (
@@ -66,6 +77,103 @@ type DiscoveryServer struct {
 	// ConfigGenerator is responsible for generating data plane configuration using Istio networking
 	// APIs and service registry info
 	ConfigGenerator core.ConfigGenerator
+
+	// ClusterSources are additional cluster generators, for example for clusters defined
+	// outside of Istio. Their clusters are merged in order after the ConfigGenerator clusters.
+	ClusterSources []ClusterGenerator
+
+	// BootstrapClusters, if set, generates a minimal cluster set (for example the control
+	// plane clusters) that is pushed first to new connections, followed by the full set.
+	// Proxies become partially functional faster on cold start.
+	BootstrapClusters ClusterGenerator
+
+	// ClusterPostProcessors adjust the clusters of each CDS push, for example to set
+	// environment-specific defaults. They are applied in order, after the generation and
+	// before the network filter, ordering and subscriptions. Set before the server starts.
+	ClusterPostProcessors []ClusterPostProcessor
+
+	// ClusterLess, if set, orders the clusters in CDS responses, for proxies sensitive to
+	// the cluster order. By default clusters are ordered as set in PILOT_CDS_ORDER.
+	ClusterLess func(a, b *xdsapi.Cluster) bool
+
+	// ClusterAliases are the renamed clusters also pushed under their old name, during their
+	// migration window. Set before the server starts.
+	ClusterAliases []ClusterAlias
+
+	// GenerationProfiles tune the cluster generation by class of proxies, keyed by the
+	// profile name set in the CDS_PROFILE node metadata, or else by proxy type. Proxies
+	// without a profile use the server settings. Set before the server starts.
+	GenerationProfiles map[string]*GenerationProfile
+
+	// ClusterCacheKey, if set, returns the cache key of the clusters generated for a proxy:
+	// proxies with the same key share the generated clusters until the next config change.
+	// Set it when the ConfigGenerator or ClusterSources depend on other proxy attributes than
+	// the type, domain and sidecar IP. See PILOT_CDS_CACHE.
+	ClusterCacheKey func(node model.Proxy) string
+
+	// RejectClusterConflicts makes two sources generating a cluster with the same name an
+	// error. By default the cluster from the later source wins.
+	RejectClusterConflicts bool
+
+	// NodeAuthenticator, if set, verifies the node ID claimed by the proxies before serving
+	// them clusters. Nil accepts any node ID.
+	NodeAuthenticator NodeAuthenticator
+
+	// ConnectionSink, if set, is notified when proxies connect and disconnect.
+	ConnectionSink ConnectionSink
+
+	// CdsCallbacks, if set, is notified of the lifecycle of the CDS connections: connect,
+	// pushes, NACKs and disconnect. Nil by default.
+	CdsCallbacks CdsCallbacks
+
+	// PilotID identifies this pilot in connection events. Defaults to the host name.
+	PilotID string
+
+	// TelemetrySink, if set, periodically receives the telemetry of the CDS connections once
+	// StartTelemetryExport is called. No telemetry is exported by default.
+	TelemetrySink TelemetrySink
+
+	// aliasMutex protects aliasPush.
+	aliasMutex sync.Mutex
+	// aliasPush is the end of the migration window a push is scheduled at, zero if none.
+	aliasPush time.Time
+}
+
+// ConnectionEvent describes a proxy connecting to or disconnecting from this pilot.
+type ConnectionEvent struct {
+	// NodeID is the node id sent by the proxy.
+	NodeID string
+
+	// ConnectionID is the key of the connection in /debug/cdsz. Unique for each stream.
+	ConnectionID string
+
+	// PeerAddr is the address of the proxy.
+	PeerAddr string
+
+	// PilotID is the identity of the pilot serving the proxy.
+	PilotID string
+}
+
+// ConnectionSink receives the connection events of a DiscoveryServer, for example to let a
+// coordinator build a global map of which pilot serves which proxy in a multi-pilot deployment.
+// The methods are called on the stream goroutines, and should not block.
+type ConnectionSink interface {
+	ConnectionAdded(event ConnectionEvent)
+	ConnectionRemoved(event ConnectionEvent)
+}
+
+// CdsCallbacks receives the lifecycle events of the CDS connections, for embedders forwarding
+// them to tracing or audit pipelines. The node is the connection key, as listed by /debug/cdsz.
+// The methods are called on the stream goroutines, and should not block.
+type CdsCallbacks interface {
+	// OnConnect is called when the proxy at peer sent its initial request.
+	OnConnect(node string, peer string)
+	// OnPush is called after a response is sent to the proxy.
+	OnPush(node string, clusterCount int, version string)
+	// OnNack is called when the proxy rejects a response.
+	OnNack(node string, err error)
+	// OnDisconnect is called when the stream of the proxy closes.
+	OnDisconnect(node string)
 }
 
 // NewDiscoveryServer creates DiscoveryServer that sources data from Pilot's internal mesh data structures
@@ -75,10 +183,12 @@ func NewDiscoveryServer(grpcServer *grpc.Server, env model.Environment, generato
 		env:             env,
 		ConfigGenerator: generator,
 	}
+	out.PilotID, _ = os.Hostname()
 
 	xdsapi.RegisterEndpointDiscoveryServiceServer(out.GrpcServer, out)
 	xdsapi.RegisterListenerDiscoveryServiceServer(out.GrpcServer, out)
 	xdsapi.RegisterClusterDiscoveryServiceServer(out.GrpcServer, out)
+	ads.RegisterAggregatedDiscoveryServiceServer(out.GrpcServer, out)
 
 	if len(periodicRefreshDuration) > 0 {
 		periodicRefresh()
@@ -113,7 +223,8 @@ func PushAll() {
 
 	log.Infoa("XDS: Registry event - pushing all configs")
 
-	cdsPushAll()
+	// The clusters of each cache key are generated once, before signaling the connections.
+	cdsPushAllWithClusters(context.Background())
 
 	// TODO: rename to XdsLegacyPushAll
 	edsPushAll() // we want endpoints ready first
@@ -121,8 +232,71 @@ func PushAll() {
 	ldsPushAll()
 }
 
+// PushServices is PushAll for a change of existing services, from the service and instance
+// handlers of v1 discoveryService: the CDS push only goes to the proxies with clusters of the
+// service hostnames (and the proxies not pushed yet). The endpoints and listeners are pushed
+// to all the proxies. Config changes, of unknown scope, and new services use PushAll.
+func PushServices(hostnames []string) {
+	versionMutex.Lock()
+	version = time.Now()
+	versionMutex.Unlock()
+
+	log.Infof("XDS: Registry event for services %v - pushing", hostnames)
+
+	pushed := cdsPushServices(hostnames...)
+	if cdsDebugEnabled() {
+		log.Infof("CDS: %d connections pushed for services %v", pushed, hostnames)
+	}
+
+	edsPushAll()
+
+	ldsPushAll()
+}
+
+// envDuration returns the duration set in the named environment variable, or def
+// if the variable is unset or can't be parsed.
+func envDuration(name string, def time.Duration) time.Duration {
+	val := os.Getenv(name)
+	if val == "" {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		log.Warnf("Invalid duration %q for %s, using default %v", val, name, def)
+		return def
+	}
+	return d
+}
+
+// envInt returns the integer set in the named environment variable, or def
+// if the variable is unset or can't be parsed.
+func envInt(name string, def int) int {
+	val := os.Getenv(name)
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		log.Warnf("Invalid integer %q for %s, using default %v", val, name, def)
+		return def
+	}
+	return n
+}
+
+// nonce returns a nonce unique across the connections and the runs of the pilot, so replies
+// can be matched with their response. Safe for concurrent use.
 func nonce() string {
-	return time.Now().String()
+	return noncePrefix + strconv.FormatUint(atomic.AddUint64(&nonceCount, 1), 10)
+}
+
+// randomNoncePrefix returns a random prefix for the nonces, or the start time if the random
+// source fails.
+func randomNoncePrefix() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36) + "-"
+	}
+	return hex.EncodeToString(b) + "-"
 }
 
 func versionInfo() string {
@@ -73,6 +73,10 @@ var (
 	edsClusterMutex sync.Mutex
 	edsClusters     = map[string]*EdsCluster{}
 
+	// edsConnections has one connection for each EDS stream, by connectionID. The clusters
+	// watched by the streams are in edsClusters.
+	edsConnections = newConnectionRegistry(edsConnectionsGauge)
+
 	// Tracks connections, increment on each new connection.
 	connectionNumber = int64(0)
 )
@@ -114,6 +118,45 @@ type EdsConnection struct {
 	// Sending on this channel results in  push. We may also make it a channel of objects so
 	// same info can be sent to all clients, without recomputing.
 	pushChannel chan bool
+
+	// drained is closed by DrainConnections, to close the stream.
+	drained   chan struct{}
+	drainOnce sync.Once
+
+	// mutex protects lastPushTime, and Clusters for the readers outside of the stream.
+	mutex sync.Mutex
+
+	// lastPushTime is the time of the last response sent.
+	lastPushTime time.Time
+}
+
+// lastPushAt returns the time of the last response sent, zero if none.
+func (con *EdsConnection) lastPushAt() time.Time {
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	return con.lastPushTime
+}
+
+// signalPush queues a push to the connection without blocking, like CdsConnection.signalPush.
+// A connection watching several clusters gets a single push for all of them. Returns false if
+// a push was already queued.
+func (con *EdsConnection) signalPush() bool {
+	select {
+	case con.pushChannel <- true:
+		return true
+	default:
+		edsPushQueuedCounter.Inc()
+		return false
+	}
+}
+
+// drain asks the stream of the connection to close, after the push queued if any.
+func (con *EdsConnection) drain() {
+	con.drainOnce.Do(func() {
+		if con.drained != nil {
+			close(con.drained)
+		}
+	})
 }
 
 // Endpoints aggregate a DiscoveryResponse for pushing.
@@ -282,6 +325,7 @@ func connectionID(node string) string {
 
 // StreamEndpoints implements xdsapi.EndpointDiscoveryServiceServer.StreamEndpoints().
 func (s *DiscoveryServer) StreamEndpoints(stream xdsapi.EndpointDiscoveryService_StreamEndpointsServer) error {
+	sender := withSendTimeout(stream, cdsSendTimeout, edsSendTimeoutsCounter)
 	peerInfo, ok := peer.FromContext(stream.Context())
 	peerAddr := "Unknown peer address"
 	if ok {
@@ -292,9 +336,12 @@ func (s *DiscoveryServer) StreamEndpoints(stream xdsapi.EndpointDiscoveryService
 	reqChannel := make(chan *xdsapi.DiscoveryRequest, 1)
 
 	initialRequestReceived := false
+	// registered is set once the stream is in edsConnections.
+	registered := false
 
 	con := &EdsConnection{
 		pushChannel: make(chan bool, 1),
+		drained:     make(chan struct{}),
 		PeerAddr:    peerAddr,
 		Clusters:    []string{},
 		Connect:     time.Now(),
@@ -302,6 +349,8 @@ func (s *DiscoveryServer) StreamEndpoints(stream xdsapi.EndpointDiscoveryService
 	// node is the key used in the cluster map. It includes the pod name and an unique identifier,
 	// since multiple envoys may connect from the same pod.
 	var node string
+	// closing is set once drained: the stream closes after the queued push.
+	closing := false
 	go func() {
 		defer close(reqChannel)
 		for {
@@ -351,6 +400,7 @@ func (s *DiscoveryServer) StreamEndpoints(stream xdsapi.EndpointDiscoveryService
 				// TODO: once the deps are updated, log the ErrorCode if set (missing in current version)
 				if discReq.ErrorDetail != nil {
 					log.Warnf("EDS: ACK ERROR %v %s %v", peerAddr, node, discReq.String())
+					edsNacksCounter.Inc()
 				}
 				if edsDebug {
 					log.Infof("EDS: ACK %s %s %s %s", node, discReq.VersionInfo, con.Clusters, discReq.String())
@@ -362,7 +412,17 @@ func (s *DiscoveryServer) StreamEndpoints(stream xdsapi.EndpointDiscoveryService
 			if edsDebug {
 				log.Infof("EDS: REQ %s %v %v raw: %s ", node, con.Clusters, peerAddr, discReq.String())
 			}
+			if !registered && node != "" {
+				if err := edsConnections.add(node, discReq.Node.Id, con, rejectDraining); err != nil {
+					log.Warnf("EDS: rejecting connection %s %q: %v", node, peerAddr, err)
+					return err
+				}
+				registered = true
+				defer edsConnections.remove(node, con)
+			}
+			con.mutex.Lock()
 			con.Clusters = discReq.GetResourceNames()
+			con.mutex.Unlock()
 			initialRequestReceived = true
 
 			for _, c := range con.Clusters {
@@ -370,6 +430,13 @@ func (s *DiscoveryServer) StreamEndpoints(stream xdsapi.EndpointDiscoveryService
 			}
 
 		case <-con.pushChannel:
+
+		case <-con.drained:
+			if len(con.pushChannel) == 0 || len(con.Clusters) == 0 {
+				return nil
+			}
+			<-con.pushChannel
+			closing = true
 		}
 
 		if len(con.Clusters) == 0 {
@@ -379,16 +446,24 @@ func (s *DiscoveryServer) StreamEndpoints(stream xdsapi.EndpointDiscoveryService
 		}
 
 		response := s.endpoints(con.Clusters)
-		err := stream.Send(response)
+		err := sender.Send(response)
 		if err != nil {
 			log.Warnf("EDS: Send failure, closing grpc %v", err)
+			edsSendFailuresCounter.Inc()
 			return err
 		}
+		edsPushesCounter.Inc()
+		con.mutex.Lock()
+		con.lastPushTime = time.Now()
+		con.mutex.Unlock()
 
 		if edsDebug {
 			log.Infof("EDS: PUSH for %s %q clusters %v, Response: \n%s\n",
 				node, peerAddr, con.Clusters, response.String())
 		}
+		if closing {
+			return nil
+		}
 	}
 }
 
@@ -405,7 +480,7 @@ func edsPushAll() {
 		updateCluster(clusterName, edsCluster)
 		edsCluster.mutex.Lock()
 		for _, edsCon := range edsCluster.EdsClients {
-			edsCon.pushChannel <- true
+			edsCon.signalPush()
 		}
 		edsCluster.mutex.Unlock()
 	}
@@ -0,0 +1,410 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/log"
+)
+
+// Unit test helpers for driving the xDS streams without a real gRPC connection or
+// a full pilot. The integration tests in xds_test.go use a real local pilot instead.
+
+const (
+	testNodeID = "sidecar~10.1.1.1~app-644fc65469-96dza.testns~testns.svc.cluster.local"
+
+	// testTimeout bounds the wait for any expected stream event.
+	testTimeout = 5 * time.Second
+)
+
+// resendUnchanged makes the update pushes resend an unchanged config, for the tests pushing to
+// get a new response. By default an unchanged push is skipped. The returned func restores the
+// settings.
+func resendUnchanged() func() {
+	oldSkip, oldWindow := cdsSkipUnchanged, cdsInitialPushWindow
+	cdsSkipUnchanged, cdsInitialPushWindow = false, 0
+	return func() { cdsSkipUnchanged, cdsInitialPushWindow = oldSkip, oldWindow }
+}
+
+// fakeStream implements xdsapi.ClusterDiscoveryService_StreamClustersServer.
+// Requests are injected with sendRequest, responses are read with recvResponse.
+type fakeStream struct {
+	grpc.ServerStream
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	requests  chan *xdsapi.DiscoveryRequest
+	responses chan *xdsapi.DiscoveryResponse
+	closeOnce sync.Once
+
+	mutex sync.Mutex
+	// sendDelay is added to each Send, simulating a slow client.
+	sendDelay time.Duration
+	// sendErr, if set, is returned by Send instead of delivering the response.
+	sendErr error
+	// sends counts the calls to Send.
+	sends int
+	// inFlight counts the calls to Send not returned yet.
+	inFlight int
+}
+
+func newFakeStream(peerAddr string) *fakeStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	if peerAddr != "" {
+		addr, _ := net.ResolveTCPAddr("tcp", peerAddr)
+		ctx = peer.NewContext(ctx, &peer.Peer{Addr: addr})
+	}
+	return &fakeStream{
+		ctx:       ctx,
+		cancel:    cancel,
+		requests:  make(chan *xdsapi.DiscoveryRequest, 10),
+		responses: make(chan *xdsapi.DiscoveryResponse, 100),
+	}
+}
+
+// slow registers the stream as a slow client: each Send is delayed by d.
+func (f *fakeStream) slow(d time.Duration) {
+	f.mutex.Lock()
+	f.sendDelay = d
+	f.mutex.Unlock()
+}
+
+// failSends makes all following Sends fail with err. A nil err restores normal sends.
+func (f *fakeStream) failSends(err error) {
+	f.mutex.Lock()
+	f.sendErr = err
+	f.mutex.Unlock()
+}
+
+func (f *fakeStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeStream) Send(resp *xdsapi.DiscoveryResponse) error {
+	f.mutex.Lock()
+	delay, err := f.sendDelay, f.sendErr
+	f.sends++
+	f.inFlight++
+	f.mutex.Unlock()
+	defer func() {
+		f.mutex.Lock()
+		f.inFlight--
+		f.mutex.Unlock()
+	}()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-f.ctx.Done():
+			return f.ctx.Err()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	select {
+	case f.responses <- resp:
+		return nil
+	case <-f.ctx.Done():
+		return f.ctx.Err()
+	}
+}
+
+func (f *fakeStream) Recv() (*xdsapi.DiscoveryRequest, error) {
+	select {
+	case req, ok := <-f.requests:
+		if !ok {
+			return nil, io.EOF
+		}
+		return req, nil
+	case <-f.ctx.Done():
+		return nil, status.Error(codes.Canceled, f.ctx.Err().Error())
+	}
+}
+
+// sendCount returns the number of calls to Send.
+func (f *fakeStream) sendCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.sends
+}
+
+// waitSendsReturned waits until no call to Send is in progress.
+func (f *fakeStream) waitSendsReturned(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		f.mutex.Lock()
+		n := f.inFlight
+		f.mutex.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sends still in progress", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// sendRequest delivers a request from the client to the server.
+func (f *fakeStream) sendRequest(req *xdsapi.DiscoveryRequest) {
+	f.requests <- req
+}
+
+// close simulates a clean client-side close of the stream.
+func (f *fakeStream) close() {
+	f.closeOnce.Do(func() {
+		close(f.requests)
+	})
+}
+
+// recvResponse waits for the next response sent by the server.
+func (f *fakeStream) recvResponse(t *testing.T) *xdsapi.DiscoveryResponse {
+	t.Helper()
+	select {
+	case resp := <-f.responses:
+		return resp
+	case <-time.After(testTimeout):
+		t.Fatal("timeout waiting for response")
+		return nil
+	}
+}
+
+// recvAll returns the responses sent by the server, until none is sent for quiet.
+func (f *fakeStream) recvAll(quiet time.Duration) []*xdsapi.DiscoveryResponse {
+	out := []*xdsapi.DiscoveryResponse{}
+	for {
+		select {
+		case resp := <-f.responses:
+			out = append(out, resp)
+		case <-time.After(quiet):
+			return out
+		}
+	}
+}
+
+// expectNoResponse verifies the server doesn't send anything within d.
+func (f *fakeStream) expectNoResponse(t *testing.T, d time.Duration) {
+	t.Helper()
+	select {
+	case resp := <-f.responses:
+		t.Fatalf("unexpected response %v", resp)
+	case <-time.After(d):
+	}
+}
+
+// clusterRequest builds a CDS request for the node.
+func clusterRequest(nodeID string) *xdsapi.DiscoveryRequest {
+	return &xdsapi.DiscoveryRequest{
+		Node:    &core.Node{Id: nodeID},
+		TypeUrl: clusterType,
+	}
+}
+
+// clusterNames returns the names of the clusters in the response.
+func clusterNames(t *testing.T, resp *xdsapi.DiscoveryResponse) []string {
+	t.Helper()
+	out := []string{}
+	for i := range resp.Resources {
+		c := &xdsapi.Cluster{}
+		if err := c.Unmarshal(resp.Resources[i].Value); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, c.Name)
+	}
+	return out
+}
+
+// fakeGenerator is a ConfigGenerator returning a fixed set of clusters.
+type fakeGenerator struct {
+	mutex    sync.Mutex
+	clusters []*xdsapi.Cluster
+	err      error
+	calls    int
+	// onBuild, if set, is called by BuildClusters.
+	onBuild func()
+}
+
+func newFakeGenerator(names ...string) *fakeGenerator {
+	g := &fakeGenerator{}
+	g.setClusters(names...)
+	return g
+}
+
+func (g *fakeGenerator) setClusters(names ...string) {
+	clusters := make([]*xdsapi.Cluster, 0, len(names))
+	for _, n := range names {
+		clusters = append(clusters, &xdsapi.Cluster{Name: n, ConnectTimeout: time.Second})
+	}
+	g.set(clusters...)
+}
+
+// set replaces the generated clusters.
+func (g *fakeGenerator) set(clusters ...*xdsapi.Cluster) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.clusters = append([]*xdsapi.Cluster{}, clusters...)
+}
+
+// setNil makes BuildClusters return a nil slice.
+func (g *fakeGenerator) setNil() {
+	g.mutex.Lock()
+	g.clusters = nil
+	g.mutex.Unlock()
+}
+
+func (g *fakeGenerator) setError(err error) {
+	g.mutex.Lock()
+	g.err = err
+	g.mutex.Unlock()
+}
+
+func (g *fakeGenerator) callCount() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.calls
+}
+
+func (g *fakeGenerator) BuildListeners(env model.Environment, node model.Proxy) ([]*xdsapi.Listener, error) {
+	return nil, nil
+}
+
+func (g *fakeGenerator) BuildClusters(ctx context.Context, env model.Environment, node model.Proxy) ([]*xdsapi.Cluster, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.calls++
+	if g.onBuild != nil {
+		g.onBuild()
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+	if g.clusters == nil {
+		return nil, nil
+	}
+	out := make([]*xdsapi.Cluster, 0, len(g.clusters))
+	for _, c := range g.clusters {
+		if c == nil {
+			out = append(out, nil)
+			continue
+		}
+		cc := *c
+		out = append(out, &cc)
+	}
+	return out, nil
+}
+
+func (g *fakeGenerator) BuildRoutes(env model.Environment, node model.Proxy, routeName string) ([]*xdsapi.RouteConfiguration, error) {
+	return nil, nil
+}
+
+// newTestServer creates a DiscoveryServer using the generator, without a gRPC server.
+func newTestServer(g *fakeGenerator) *DiscoveryServer {
+	return &DiscoveryServer{ConfigGenerator: g}
+}
+
+// startClusterStream runs StreamClusters for the stream in the background. The returned
+// channel receives the result of StreamClusters.
+func startClusterStream(s *DiscoveryServer, stream *fakeStream) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.StreamClusters(stream)
+	}()
+	return done
+}
+
+// waitStreamDone waits for StreamClusters to return, and returns its result.
+func waitStreamDone(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(testTimeout):
+		t.Fatal("timeout waiting for stream to close")
+		return nil
+	}
+}
+
+// captureLog redirects the pilot log to a temporary file while f runs, and returns
+// the logged output.
+func captureLog(t *testing.T, f func()) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "cdslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+
+	o := log.DefaultOptions()
+	o.OutputPaths = []string{path}
+	_ = o.SetOutputLevel(log.DebugLevel)
+	if err := log.Configure(o); err != nil {
+		t.Fatal(err)
+	}
+	f()
+	_ = log.Sync()
+	_ = log.Configure(log.DefaultOptions())
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+// waitCdsCon waits until a connection for the node ID is registered, and returns its key.
+func waitCdsCon(t *testing.T, nodeID string) string {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		for _, k := range cdsConnections.keys() {
+			if strings.HasPrefix(k, nodeID+"-") {
+				return k
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("connection for %s not registered", nodeID)
+	return ""
+}
+
+// cdsz calls the Cdsz debug handler with the query, and returns the recorder.
+func cdsz(query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	Cdsz(w, httptest.NewRequest("GET", "/debug/cdsz?"+query, nil))
+	return w
+}
@@ -19,6 +19,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
@@ -39,8 +40,8 @@ import (
 var (
 	ldsDebug = os.Getenv("PILOT_DEBUG_LDS") != "0"
 
-	ldsClientsMutex sync.RWMutex
-	ldsClients      = map[string]*LdsConnection{}
+	// ldsConnections has one connection for each LDS stream, by connectionID.
+	ldsConnections = newConnectionRegistry(ldsConnectionsGauge)
 )
 
 // LdsConnection is a listener connection type.
@@ -58,17 +59,28 @@ type LdsConnection struct {
 	// same info can be sent to all clients, without recomputing.
 	pushChannel chan struct{}
 
+	// drained is closed by DrainConnections, to close the stream.
+	drained   chan struct{}
+	drainOnce sync.Once
+
 	// TODO: migrate other fields as needed from model.Proxy and replace it
 
 	//HttpConnectionManagers map[string]*http_conn.HttpConnectionManager
 
 	HTTPListeners []*xdsapi.Listener
 
+	// mutex protects HTTPListeners and lastPushTime, read by LDSz.
+	mutex sync.Mutex
+
+	// lastPushTime is the time of the last response sent.
+	lastPushTime time.Time
+
 	// TODO: TcpListeners (may combine mongo/etc)
 }
 
 // StreamListeners implements the DiscoveryServer interface.
 func (s *DiscoveryServer) StreamListeners(stream xdsapi.ListenerDiscoveryService_StreamListenersServer) error {
+	sender := withSendTimeout(stream, cdsSendTimeout, ldsSendTimeoutsCounter)
 	peerInfo, ok := peer.FromContext(stream.Context())
 	peerAddr := unknownPeerAddressStr
 	if ok {
@@ -82,16 +94,18 @@ func (s *DiscoveryServer) StreamListeners(stream xdsapi.ListenerDiscoveryService
 
 	// true if the stream received the initial discovery request.
 	initialRequestReceived := false
+	// closing is set once drained: the stream closes after the queued push.
+	closing := false
 
 	con := &LdsConnection{
 		pushChannel:   make(chan struct{}, 1),
+		drained:       make(chan struct{}),
 		PeerAddr:      peerAddr,
 		Connect:       time.Now(),
 		HTTPListeners: []*xdsapi.Listener{},
 	}
 	go func() {
 		defer close(reqChannel)
-		defer removeLdsCon(nodeID)
 		for {
 			req, err := stream.Recv()
 			if err != nil {
@@ -122,6 +136,7 @@ func (s *DiscoveryServer) StreamListeners(stream xdsapi.ListenerDiscoveryService
 			if initialRequestReceived {
 				if discReq.ErrorDetail != nil {
 					log.Warnf("LDS: ACK ERROR %v %s %v", peerAddr, nt.ID, discReq.String())
+					ldsNacksCounter.Inc()
 				}
 				if ldsDebug {
 					log.Infof("LDS: ACK %v", discReq.String())
@@ -131,34 +146,70 @@ func (s *DiscoveryServer) StreamListeners(stream xdsapi.ListenerDiscoveryService
 			initialRequestReceived = true
 			nodeID = nt.ID
 			con.Node = nodeID
-			addLdsCon(nodeID, con)
+			key := connectionID(discReq.Node.Id)
+			if err := addLdsCon(key, discReq.Node.Id, con); err != nil {
+				log.Warnf("LDS: rejecting connection %s %q: %v", key, peerAddr, err)
+				return err
+			}
+			defer removeLdsCon(key, con)
 
 			if ldsDebug {
 				log.Infof("LDS: REQ %v %s %s", peerAddr, nt.ID, discReq.String())
 			}
 		case <-con.pushChannel:
+
+		case <-con.drained:
+			if len(con.pushChannel) == 0 || !initialRequestReceived {
+				return nil
+			}
+			<-con.pushChannel
+			closing = true
 		}
 
+		buildStart := time.Now()
 		ls, err := s.ConfigGenerator.BuildListeners(s.env, node)
+		ldsBuildListenersTime.Observe(time.Since(buildStart).Seconds())
 		if err != nil {
 			log.Warnf("LDS: config failure, closing grpc %v", err)
 			return err
 		}
+		con.mutex.Lock()
 		con.HTTPListeners = ls
+		con.mutex.Unlock()
 		response, err := ldsDiscoveryResponse(ls, node)
 		if err != nil {
 			log.Warnf("LDS: config failure, closing grpc %v", err)
 			return err
 		}
-		err = stream.Send(response)
+		err = sender.Send(response)
 		if err != nil {
 			log.Warnf("LDS: Send failure, closing grpc %v", err)
+			ldsSendFailuresCounter.Inc()
 			return err
 		}
+		ldsPushesCounter.Inc()
+		con.mutex.Lock()
+		con.lastPushTime = time.Now()
+		con.mutex.Unlock()
 		if ldsDebug {
 			log.Infof("LDS: PUSH for node:%s addr:%q listeners:%d", node, peerAddr, len(ls))
 		}
+		if closing {
+			return nil
+		}
+
+	}
+}
 
+// signalPush queues a push to the connection without blocking on a busy stream, like
+// CdsConnection.signalPush. Returns false if a push was already queued.
+func (con *LdsConnection) signalPush() bool {
+	select {
+	case con.pushChannel <- struct{}{}:
+		return true
+	default:
+		ldsPushQueuedCounter.Inc()
+		return false
 	}
 }
 
@@ -166,16 +217,9 @@ func (s *DiscoveryServer) StreamListeners(stream xdsapi.ListenerDiscoveryService
 // Primary code path is from v1 discoveryService.clearCache(), which is added as a handler
 // to the model ConfigStorageCache and Controller.
 func ldsPushAll() {
-	ldsClientsMutex.RLock()
-	// Create a temp map to avoid locking the add/remove
-	tmpMap := map[string]*LdsConnection{}
-	for k, v := range ldsClients {
-		tmpMap[k] = v
-	}
-	ldsClientsMutex.RUnlock()
-
-	for _, client := range tmpMap {
-		client.pushChannel <- struct{}{}
+	// A copy of the connections, to avoid locking the add/remove.
+	for _, client := range ldsConnections.snapshot() {
+		client.(*LdsConnection).signalPush()
 	}
 }
 
@@ -189,10 +233,15 @@ func LDSz(w http.ResponseWriter, req *http.Request) {
 	}
 	if req.Form.Get("push") != "" {
 		ldsPushAll()
-		fmt.Fprintf(w, "Pushed to %d servers", len(ldsClients))
+		fmt.Fprintf(w, "Pushed to %d servers", ldsConnections.len())
 		return
 	}
-	ldsClientsMutex.RLock()
+	cons := ldsConnections.snapshot()
+	keys := make([]string, 0, len(cons))
+	for k := range cons {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 
 	//data, err := json.Marshal(ldsClients)
 
@@ -201,7 +250,8 @@ func LDSz(w http.ResponseWriter, req *http.Request) {
 	// better ways, but this is mainly for debugging.
 	fmt.Fprint(w, "[\n")
 	comma2 := false
-	for _, c := range ldsClients {
+	for _, k := range keys {
+		c := cons[k].(*LdsConnection)
 		if comma2 {
 			fmt.Fprint(w, ",\n")
 		} else {
@@ -209,7 +259,10 @@ func LDSz(w http.ResponseWriter, req *http.Request) {
 		}
 		fmt.Fprintf(w, "\n\n  {\"node\": \"%s\", \"addr\": \"%s\", \"connect\": \"%v\",\"listeners\":[\n", c.Node, c.PeerAddr, c.Connect)
 		comma1 := false
-		for _, ls := range c.HTTPListeners {
+		c.mutex.Lock()
+		listeners := c.HTTPListeners
+		c.mutex.Unlock()
+		for _, ls := range listeners {
 			if comma1 {
 				fmt.Fprint(w, ",\n")
 			} else {
@@ -225,8 +278,6 @@ func LDSz(w http.ResponseWriter, req *http.Request) {
 	}
 	fmt.Fprint(w, "]\n")
 
-	ldsClientsMutex.RUnlock()
-
 	//if err != nil {
 	//	_, _ = w.Write([]byte(err.Error()))
 	//	return
@@ -235,20 +286,33 @@ func LDSz(w http.ResponseWriter, req *http.Request) {
 	//_, _ = w.Write(data)
 }
 
-func addLdsCon(s string, connection *LdsConnection) {
-	ldsClientsMutex.Lock()
-	defer ldsClientsMutex.Unlock()
-	ldsClients[s] = connection
+// addLdsCon tracks the connection of the node id by its connectionID key, for push and debug.
+// Fails with Unavailable if pilot is draining.
+func addLdsCon(key string, node string, connection *LdsConnection) error {
+	return ldsConnections.add(key, node, connection, rejectDraining)
 }
 
-func removeLdsCon(s string) {
-	ldsClientsMutex.Lock()
-	defer ldsClientsMutex.Unlock()
-
-	if ldsClients[s] == nil {
-		log.Errorf("Removing LDS connection for non-existing node %s.", s)
+// removeLdsCon is called when the gRPC stream is closed. Only the connection itself is removed.
+func removeLdsCon(key string, connection *LdsConnection) {
+	if !ldsConnections.remove(key, connection) {
+		log.Errorf("Removing LDS connection for non-existing node %s.", key)
 	}
-	delete(ldsClients, s)
+}
+
+// drain asks the stream of the connection to close, after the push queued if any.
+func (con *LdsConnection) drain() {
+	con.drainOnce.Do(func() {
+		if con.drained != nil {
+			close(con.drained)
+		}
+	})
+}
+
+// lastPushAt returns the time of the last response sent, zero if none.
+func (con *LdsConnection) lastPushAt() time.Time {
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	return con.lastPushTime
 }
 
 // FetchListeners implements the DiscoveryServer interface.
@@ -0,0 +1,407 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "pilot"
+	metricsCds       = "cds"
+	metricsEds       = "eds"
+	metricsLds       = "lds"
+)
+
+var (
+	cdsStuckInitialCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "stuck_initial",
+			Help:      "Count of CDS connections that keep sending initial requests without ever ACKing",
+		})
+
+	cdsHighAllocCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "high_alloc_pushes",
+			Help:      "Count of CDS pushes allocating more than PILOT_CDS_ALLOC_WARN_BYTES",
+		})
+
+	cdsPushLoopCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "push_loops",
+			Help:      "Count of CDS push loops: identical content pushed repeatedly to a connection",
+		})
+
+	cdsClusterExplosionCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "cluster_count_explosions",
+			Help:      "Count of fleet-wide jumps of the median CDS cluster count beyond PILOT_CDS_EXPLOSION_FACTOR",
+		})
+
+	cdsMedianClustersGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "median_clusters",
+			Help:      "Median number of clusters last pushed to the CDS connections",
+		})
+
+	cdsGenerationBudgetCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "generation_budget_exhausted",
+			Help:      "Count of CDS pushes abandoned after failed generation retries exhausted PILOT_CDS_GENERATION_BUDGET",
+		})
+
+	cdsThrottledCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "throttled_pushes",
+			Help:      "Count of CDS update pushes deferred because pilot is overloaded",
+		})
+
+	cdsClusterCacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "cluster_cache_hits",
+			Help:      "Count of CDS pushes served from clusters generated for another connection",
+		})
+
+	cdsSharedResponsesCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "shared_responses",
+			Help:      "Count of CDS responses reusing the resources marshaled for another connection",
+		})
+
+	cdsConnectionsGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "connections",
+			Help:      "Number of CDS connections",
+		})
+
+	cdsPushesCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "pushes",
+			Help:      "Count of CDS responses sent",
+		})
+
+	cdsSendFailuresCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "send_failures",
+			Help:      "Count of CDS responses that failed to send",
+		})
+
+	cdsRejectedConnectionsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "rejected_connections",
+			Help:      "Count of CDS streams rejected over PILOT_CDS_MAX_CONNECTIONS",
+		})
+
+	cdsSendTimeoutsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "send_timeouts",
+			Help:      "Count of CDS connections closed on a Send not completed within PILOT_CDS_SEND_TIMEOUT",
+		})
+
+	cdsGenerationFailuresCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "generation_failures",
+			Help:      "Count of CDS pushes and fetches with a failed cluster generation",
+		})
+
+	cdsPushQueuedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "push_already_queued",
+			Help:      "Count of CDS push signals skipped because the connection already had a push queued",
+		})
+
+	cdsUnchangedPushesCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "unchanged_pushes",
+			Help:      "Count of CDS update pushes skipped because the clusters did not change",
+		})
+
+	cdsCompressionSavedBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "compression_saved_bytes",
+			Help:      "Bytes saved by the gzip compression of CDS responses",
+		})
+
+	cdsInvalidClustersCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "invalid_clusters",
+			Help:      "Count of clusters dropped from the CDS responses for failing validation or marshaling",
+		})
+
+	cdsNacksCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "nacks",
+			Help:      "Count of CDS responses rejected by the envoys",
+		})
+
+	cdsAuthFailuresCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "auth_failures",
+			Help:      "Count of CDS requests rejected by the NodeAuthenticator",
+		})
+
+	cdsBuildClustersTime = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "build_clusters_seconds",
+			Help:      "Duration of the ConfigGenerator BuildClusters calls",
+			Buckets:   []float64{.001, .01, .1, .5, 1, 5},
+		})
+
+	cdsGenerationTime = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "generation_seconds",
+			Help:      "Time to generate the clusters of a CDS push or fetch",
+			Buckets:   []float64{.001, .01, .1, .5, 1, 5},
+		})
+
+	cdsPushTime = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "push_seconds",
+			Help:      "Time from the start of a CDS push to the end of its send",
+			Buckets:   []float64{.001, .01, .1, .5, 1, 5, 10},
+		})
+
+	cdsSerializationTime = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "serialization_seconds",
+			Help:      "Time to marshal the clusters of a CDS push into the response",
+			Buckets:   []float64{.001, .01, .1, .5, 1, 5},
+		})
+
+	cdsSafeModeGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "safe_mode",
+			Help:      "1 if CDS serves last-known-good clusters after persistent generation failures",
+		})
+
+	cdsPushSuccessRatio = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "push_success_ratio",
+			Help:      "Ratio of the CDS responses successfully sent to a connection, observed when it closes",
+			Buckets:   []float64{.1, .5, .9, .99, 1},
+		})
+
+	cdsAckLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsCds,
+			Name:      "ack_latency_seconds",
+			Help:      "Time between a CDS response and its ACK or NACK by the envoy",
+			Buckets:   []float64{.01, .1, 1, 3, 10, 30, 60},
+		})
+
+	edsConnectionsGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsEds,
+			Name:      "connections",
+			Help:      "Number of EDS streams",
+		})
+
+	edsPushesCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsEds,
+			Name:      "pushes",
+			Help:      "Count of EDS responses sent",
+		})
+
+	edsSendFailuresCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsEds,
+			Name:      "send_failures",
+			Help:      "Count of EDS responses that failed to send, closing the stream",
+		})
+
+	edsSendTimeoutsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsEds,
+			Name:      "send_timeouts",
+			Help:      "Count of EDS connections closed on a Send not completed within PILOT_CDS_SEND_TIMEOUT",
+		})
+
+	edsPushQueuedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsEds,
+			Name:      "push_already_queued",
+			Help:      "Count of EDS push signals merged with a push already queued for the connection",
+		})
+
+	edsNacksCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsEds,
+			Name:      "nacks",
+			Help:      "Count of EDS responses rejected by the envoys",
+		})
+
+	ldsConnectionsGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsLds,
+			Name:      "connections",
+			Help:      "Number of LDS streams",
+		})
+
+	ldsPushesCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsLds,
+			Name:      "pushes",
+			Help:      "Count of LDS responses sent",
+		})
+
+	ldsSendFailuresCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsLds,
+			Name:      "send_failures",
+			Help:      "Count of LDS responses that failed to send, closing the stream",
+		})
+
+	ldsSendTimeoutsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsLds,
+			Name:      "send_timeouts",
+			Help:      "Count of LDS connections closed on a Send not completed within PILOT_CDS_SEND_TIMEOUT",
+		})
+
+	ldsPushQueuedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsLds,
+			Name:      "push_already_queued",
+			Help:      "Count of LDS push signals merged with a push already queued for the connection",
+		})
+
+	ldsNacksCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsLds,
+			Name:      "nacks",
+			Help:      "Count of LDS responses rejected by the envoys",
+		})
+
+	ldsBuildListenersTime = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsLds,
+			Name:      "build_listeners_seconds",
+			Help:      "Duration of the ConfigGenerator BuildListeners calls",
+			Buckets:   []float64{.001, .01, .1, .5, 1, 5},
+		})
+)
+
+func init() {
+	prometheus.MustRegister(cdsStuckInitialCounter)
+	prometheus.MustRegister(cdsHighAllocCounter)
+	prometheus.MustRegister(cdsAckLatency)
+	prometheus.MustRegister(cdsPushSuccessRatio)
+	prometheus.MustRegister(cdsPushLoopCounter)
+	prometheus.MustRegister(cdsClusterExplosionCounter)
+	prometheus.MustRegister(cdsMedianClustersGauge)
+	prometheus.MustRegister(cdsGenerationTime)
+	prometheus.MustRegister(cdsConnectionsGauge)
+	prometheus.MustRegister(cdsPushesCounter)
+	prometheus.MustRegister(cdsSendFailuresCounter)
+	prometheus.MustRegister(cdsBuildClustersTime)
+	prometheus.MustRegister(cdsPushQueuedCounter)
+	prometheus.MustRegister(cdsUnchangedPushesCounter)
+	prometheus.MustRegister(cdsCompressionSavedBytes)
+	prometheus.MustRegister(cdsAuthFailuresCounter)
+	prometheus.MustRegister(cdsNacksCounter)
+	prometheus.MustRegister(cdsInvalidClustersCounter)
+	prometheus.MustRegister(cdsGenerationFailuresCounter)
+	prometheus.MustRegister(cdsSendTimeoutsCounter)
+	prometheus.MustRegister(cdsRejectedConnectionsCounter)
+	prometheus.MustRegister(cdsGenerationBudgetCounter)
+	prometheus.MustRegister(cdsThrottledCounter)
+	prometheus.MustRegister(cdsClusterCacheHits)
+	prometheus.MustRegister(cdsSharedResponsesCounter)
+	prometheus.MustRegister(cdsSafeModeGauge)
+	prometheus.MustRegister(cdsSerializationTime)
+	prometheus.MustRegister(cdsPushTime)
+	prometheus.MustRegister(edsConnectionsGauge)
+	prometheus.MustRegister(edsPushesCounter)
+	prometheus.MustRegister(edsSendFailuresCounter)
+	prometheus.MustRegister(edsSendTimeoutsCounter)
+	prometheus.MustRegister(edsNacksCounter)
+	prometheus.MustRegister(edsPushQueuedCounter)
+	prometheus.MustRegister(ldsConnectionsGauge)
+	prometheus.MustRegister(ldsPushesCounter)
+	prometheus.MustRegister(ldsSendFailuresCounter)
+	prometheus.MustRegister(ldsSendTimeoutsCounter)
+	prometheus.MustRegister(ldsNacksCounter)
+	prometheus.MustRegister(ldsPushQueuedCounter)
+	prometheus.MustRegister(ldsBuildListenersTime)
+}
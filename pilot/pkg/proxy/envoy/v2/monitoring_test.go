@@ -0,0 +1,200 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/gogo/googleapis/google/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// sampleCount returns the number of observations of the histogram.
+func sampleCount(t *testing.T, h prometheus.Histogram) uint64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := h.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+// counterValue returns the value of the counter.
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestCdsPushTimeMetrics(t *testing.T) {
+	generation, serialization := sampleCount(t, cdsGenerationTime), sampleCount(t, cdsSerializationTime)
+	push := sampleCount(t, cdsPushTime)
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	stream.close()
+	_ = waitStreamDone(t, done)
+
+	if n := sampleCount(t, cdsGenerationTime); n != generation+1 {
+		t.Errorf("generation histogram has %d new observations, want 1", n-generation)
+	}
+	if n := sampleCount(t, cdsSerializationTime); n != serialization+1 {
+		t.Errorf("serialization histogram has %d new observations, want 1", n-serialization)
+	}
+	if n := sampleCount(t, cdsPushTime); n != push+1 {
+		t.Errorf("push histogram has %d new observations, want 1", n-push)
+	}
+}
+
+func TestCdsFetchTimeMetrics(t *testing.T) {
+	cdsFetchCache.clear()
+	defer cdsFetchCache.clear()
+	generation, builds := sampleCount(t, cdsGenerationTime), sampleCount(t, cdsBuildClustersTime)
+
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	if _, err := s.FetchClusters(context.Background(), clusterRequest(testNodeID)); err != nil {
+		t.Fatal(err)
+	}
+	if n := sampleCount(t, cdsGenerationTime); n != generation+1 {
+		t.Errorf("generation histogram has %d new observations for a fetch, want 1", n-generation)
+	}
+	if n := sampleCount(t, cdsBuildClustersTime); n != builds+1 {
+		t.Errorf("build histogram has %d new observations for a fetch, want 1", n-builds)
+	}
+}
+
+// gaugeValue returns the value of the gauge.
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := g.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestCdsPushMetrics(t *testing.T) {
+	defer resendUnchanged()()
+	connections := gaugeValue(t, cdsConnectionsGauge)
+	pushes, failures := counterValue(t, cdsPushesCounter), counterValue(t, cdsSendFailuresCounter)
+	builds := sampleCount(t, cdsBuildClustersTime)
+
+	g := newFakeGenerator("outbound|80||a.default.svc.cluster.local")
+	s := newTestServer(g)
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	stream.sendRequest(clusterRequest(testNodeID))
+	stream.recvResponse(t)
+	waitCdsCon(t, testNodeID)
+	if n := gaugeValue(t, cdsConnectionsGauge); n != connections+1 {
+		t.Errorf("connections gauge is %v, want %v", n, connections+1)
+	}
+
+	g.setClusters("outbound|80||b.default.svc.cluster.local")
+	cdsPushAll(nil)
+	stream.recvResponse(t)
+	// The push is counted once Send returns, after the response is received.
+	deadline := time.Now().Add(testTimeout)
+	for counterValue(t, cdsPushesCounter) < pushes+2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := counterValue(t, cdsPushesCounter); n != pushes+2 {
+		t.Errorf("pushes counter moved by %v, want 2", n-pushes)
+	}
+	if n := sampleCount(t, cdsBuildClustersTime); n != builds+2 {
+		t.Errorf("build histogram has %d new observations, want 2", n-builds)
+	}
+
+	stream.failSends(errors.New("connection reset"))
+	cdsPushAll(nil)
+	if err := waitStreamDone(t, done); err == nil {
+		t.Error("stream returned nil after a send failure")
+	}
+	if n := counterValue(t, cdsSendFailuresCounter); n != failures+1 {
+		t.Errorf("send failures counter moved by %v, want 1", n-failures)
+	}
+	if n := gaugeValue(t, cdsConnectionsGauge); n != connections {
+		t.Errorf("connections gauge is %v after the close, want %v", n, connections)
+	}
+}
+
+func TestEdsLdsMetrics(t *testing.T) {
+	const cluster = "outbound|80||a.default.svc.cluster.local"
+	s := newTestServer(newFakeGenerator(cluster))
+	addTestEdsCluster(s, cluster)
+	streams := []struct {
+		name        string
+		start       func(stream *fakeStream) error
+		req         *xdsapi.DiscoveryRequest
+		connections prometheus.Gauge
+		pushes      prometheus.Counter
+		nacks       prometheus.Counter
+	}{
+		{"EDS", func(stream *fakeStream) error { return s.StreamEndpoints(stream) },
+			&xdsapi.DiscoveryRequest{Node: &core.Node{Id: testNodeID}, TypeUrl: endpointType, ResourceNames: []string{cluster}},
+			edsConnectionsGauge, edsPushesCounter, edsNacksCounter},
+		{"LDS", func(stream *fakeStream) error { return s.StreamListeners(stream) },
+			&xdsapi.DiscoveryRequest{Node: &core.Node{Id: testNodeID}, TypeUrl: listenerType},
+			ldsConnectionsGauge, ldsPushesCounter, ldsNacksCounter},
+	}
+	for _, tc := range streams {
+		t.Run(tc.name, func(t *testing.T) {
+			connections := gaugeValue(t, tc.connections)
+			pushes, nacks := counterValue(t, tc.pushes), counterValue(t, tc.nacks)
+
+			stream := newFakeStream("10.1.1.1:5000")
+			done := make(chan error, 1)
+			go func() { done <- tc.start(stream) }()
+			stream.sendRequest(tc.req)
+			resp := stream.recvResponse(t)
+			if n := gaugeValue(t, tc.connections); n != connections+1 {
+				t.Errorf("connections gauge is %v, want %v", n, connections+1)
+			}
+
+			nack := *tc.req
+			nack.ResponseNonce = resp.Nonce
+			nack.ErrorDetail = &rpc.Status{Message: "invalid config"}
+			stream.sendRequest(&nack)
+			deadline := time.Now().Add(testTimeout)
+			for counterValue(t, tc.nacks) == nacks && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			stream.close()
+			_ = waitStreamDone(t, done)
+
+			if n := counterValue(t, tc.pushes); n != pushes+1 {
+				t.Errorf("pushes counter moved by %v, want 1", n-pushes)
+			}
+			if n := counterValue(t, tc.nacks); n != nacks+1 {
+				t.Errorf("nacks counter moved by %v, want 1", n-nacks)
+			}
+			if n := gaugeValue(t, tc.connections); n != connections {
+				t.Errorf("connections gauge is %v after the close, want %v", n, connections)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"math"
+	"time"
+)
+
+// byteRateLimiter is a token bucket over the bytes sent on a connection, with a burst of one
+// second worth of bytes. A message larger than the available tokens is not rejected: the bucket
+// goes into debt, and the sender waits until the debt is repaid. Not safe for concurrent use,
+// each stream owns its limiter.
+type byteRateLimiter struct {
+	// rate in bytes per second
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newByteRateLimiter(bytesPerSecond int) *byteRateLimiter {
+	return &byteRateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n bytes from the bucket, and returns how long the caller must wait before
+// sending them.
+func (l *byteRateLimiter) reserve(n int) time.Duration {
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// pushRateLimiter caps the number of pushes to a connection in a sliding window.
+// Not safe for concurrent use.
+type pushRateLimiter struct {
+	max    int
+	window time.Duration
+	// pushes are the times of the pushes in the window, oldest first
+	pushes []time.Time
+}
+
+func newPushRateLimiter(max int, window time.Duration) *pushRateLimiter {
+	return &pushRateLimiter{max: max, window: window}
+}
+
+// wait returns how long until the next push is allowed, or 0 if it is allowed now.
+func (l *pushRateLimiter) wait(now time.Time) time.Duration {
+	i := 0
+	for i < len(l.pushes) && now.Sub(l.pushes[i]) >= l.window {
+		i++
+	}
+	l.pushes = l.pushes[i:]
+	if len(l.pushes) < l.max {
+		return 0
+	}
+	return l.pushes[0].Add(l.window).Sub(now)
+}
+
+// record adds a push.
+func (l *pushRateLimiter) record(now time.Time) {
+	l.pushes = append(l.pushes, now)
+}
@@ -0,0 +1,228 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// xdsConnection is a stream registered in a connectionRegistry.
+type xdsConnection interface {
+	// lastPushAt returns the time of the last response sent, zero if none.
+	lastPushAt() time.Time
+	// drain asks the stream to close once its current response is sent.
+	drain()
+}
+
+// connectionRegistry tracks the streams of an xDS type, for push and debug. Each stream is
+// registered with a key unique to it (connectionID), since several envoys may connect with
+// the same node id: the registry counts the streams of each node.
+type connectionRegistry struct {
+	mutex       sync.Mutex
+	connections map[string]registryEntry
+	// nodes is the number of registered connections of each node id.
+	nodes map[string]int
+
+	// gauge, if set, is updated with the number of connections.
+	gauge prometheus.Gauge
+}
+
+type registryEntry struct {
+	node string
+	con  xdsConnection
+}
+
+func newConnectionRegistry(gauge prometheus.Gauge) *connectionRegistry {
+	return &connectionRegistry{
+		connections: map[string]registryEntry{},
+		nodes:       map[string]int{},
+		gauge:       gauge,
+	}
+}
+
+// add registers the connection of the node with the key. check, if set, is called under the
+// registry lock with the current number of connections, and rejects the connection if it
+// returns an error. Fails with AlreadyExists if another connection has the key. Adding a
+// registered connection again is a no-op.
+func (r *connectionRegistry) add(key, node string, con xdsConnection, check func(connections int) error) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if existing, f := r.connections[key]; f {
+		if existing.con != con {
+			return status.Errorf(codes.AlreadyExists, "connection %s already registered", key)
+		}
+		return nil
+	}
+	if check != nil {
+		if err := check(len(r.connections)); err != nil {
+			return err
+		}
+	}
+	r.connections[key] = registryEntry{node: node, con: con}
+	r.nodes[node]++
+	r.updateGauge()
+	return nil
+}
+
+// remove unregisters the connection with the key. Returns false if the key is not registered
+// or belongs to another connection, which is left registered.
+func (r *connectionRegistry) remove(key string, con xdsConnection) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	e, f := r.connections[key]
+	if !f || e.con != con {
+		return false
+	}
+	delete(r.connections, key)
+	if r.nodes[e.node]--; r.nodes[e.node] <= 0 {
+		delete(r.nodes, e.node)
+	}
+	r.updateGauge()
+	return true
+}
+
+func (r *connectionRegistry) updateGauge() {
+	if r.gauge != nil {
+		r.gauge.Set(float64(len(r.connections)))
+	}
+}
+
+// get returns the connection with the key, or nil.
+func (r *connectionRegistry) get(key string) xdsConnection {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.connections[key].con
+}
+
+// snapshot returns a copy of the connections by key, to use without locking the add/remove.
+func (r *connectionRegistry) snapshot() map[string]xdsConnection {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	out := make(map[string]xdsConnection, len(r.connections))
+	for k, e := range r.connections {
+		out[k] = e.con
+	}
+	return out
+}
+
+// nodeSnapshot returns a copy of the connections of the node id, by key.
+func (r *connectionRegistry) nodeSnapshot(node string) map[string]xdsConnection {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	out := map[string]xdsConnection{}
+	for k, e := range r.connections {
+		if e.node == node {
+			out[k] = e.con
+		}
+	}
+	return out
+}
+
+// byNode returns a copy of the connections, by node id.
+func (r *connectionRegistry) byNode() map[string][]xdsConnection {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	out := map[string][]xdsConnection{}
+	for _, e := range r.connections {
+		out[e.node] = append(out[e.node], e.con)
+	}
+	return out
+}
+
+// keys returns the sorted keys of the connections.
+func (r *connectionRegistry) keys() []string {
+	r.mutex.Lock()
+	keys := make([]string, 0, len(r.connections))
+	for k := range r.connections {
+		keys = append(keys, k)
+	}
+	r.mutex.Unlock()
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *connectionRegistry) len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.connections)
+}
+
+// nodeConnections returns the number of connections of the node id.
+func (r *connectionRegistry) nodeConnections(node string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.nodes[node]
+}
+
+// registryNode is the summary of the connections of a node in /debug/connectionsz.
+type registryNode struct {
+	Connections int
+	// LastPush is the time of the last response sent on any connection of the node.
+	LastPush time.Time
+}
+
+// registryStatus is the summary of a registry in /debug/connectionsz.
+type registryStatus struct {
+	Connections int
+	Nodes       map[string]*registryNode
+}
+
+func (r *connectionRegistry) status() registryStatus {
+	r.mutex.Lock()
+	entries := make([]registryEntry, 0, len(r.connections))
+	for _, e := range r.connections {
+		entries = append(entries, e)
+	}
+	r.mutex.Unlock()
+
+	out := registryStatus{Connections: len(entries), Nodes: map[string]*registryNode{}}
+	for _, e := range entries {
+		n := out.Nodes[e.node]
+		if n == nil {
+			n = &registryNode{}
+			out.Nodes[e.node] = n
+		}
+		n.Connections++
+		if t := e.con.lastPushAt(); t.After(n.LastPush) {
+			n.LastPush = t
+		}
+	}
+	return out
+}
+
+// connectionsz implements /debug/connectionsz, summarizing the streams of each xDS type by
+// node id: the number of streams of the node and the time of its last push.
+func connectionsz(w http.ResponseWriter, req *http.Request) {
+	out := map[string]registryStatus{
+		"cds": cdsConnections.status(),
+		"eds": edsConnections.status(),
+		"lds": ldsConnections.status(),
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type testConnection struct {
+	lastPush time.Time
+}
+
+func (c *testConnection) lastPushAt() time.Time {
+	return c.lastPush
+}
+
+func (c *testConnection) drain() {}
+
+func TestConnectionRegistry(t *testing.T) {
+	r := newConnectionRegistry(nil)
+	first, second := &testConnection{}, &testConnection{}
+	if err := r.add("node-1", "node", first, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.add("node-1", "node", first, nil); err != nil {
+		t.Errorf("adding the connection again returned %v", err)
+	}
+	if err := r.add("node-1", "node", second, nil); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("adding another connection with the key returned %v, want AlreadyExists", err)
+	}
+	if err := r.add("node-2", "node", second, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.nodeConnections("node"); n != 2 {
+		t.Errorf("%d connections for the node, want 2", n)
+	}
+
+	// Only the connection registered with the key is removed.
+	if r.remove("node-1", second) {
+		t.Error("removed the key of another connection")
+	}
+	if !r.remove("node-1", first) || r.get("node-1") != nil {
+		t.Error("connection not removed")
+	}
+	if n := r.nodeConnections("node"); n != 1 {
+		t.Errorf("%d connections for the node after a close, want 1", n)
+	}
+
+	errFull := errors.New("full")
+	if err := r.add("node-3", "node", first, func(n int) error {
+		if n != 1 {
+			t.Errorf("check got %d connections, want 1", n)
+		}
+		return errFull
+	}); err != errFull {
+		t.Errorf("rejected connection returned %v, want the check error", err)
+	}
+	if r.len() != 1 {
+		t.Errorf("%d connections after a rejected add, want 1", r.len())
+	}
+}
+
+func TestConnectionRegistryConcurrent(t *testing.T) {
+	r := newConnectionRegistry(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			node := fmt.Sprintf("node%d", i%4)
+			for j := 0; j < 50; j++ {
+				key := fmt.Sprintf("%s-%d-%d", node, i, j)
+				con := &testConnection{}
+				if err := r.add(key, node, con, nil); err != nil {
+					t.Error(err)
+					return
+				}
+				_ = r.snapshot()
+				if !r.remove(key, con) {
+					t.Errorf("connection %s not removed", key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := r.len(); n != 0 || len(r.status().Nodes) != 0 {
+		t.Errorf("%d connections and nodes %v left after the disconnects, want none", n, r.status().Nodes)
+	}
+}
+
+func TestConnectionsz(t *testing.T) {
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	// Two LDS streams of the same node.
+	for _, addr := range []string{"10.1.1.1:5000", "10.1.1.1:5001"} {
+		stream := newFakeStream(addr)
+		done := make(chan error, 1)
+		go func() { done <- s.StreamListeners(stream) }()
+		defer func() {
+			stream.close()
+			_ = waitStreamDone(t, done)
+		}()
+		stream.sendRequest(&xdsapi.DiscoveryRequest{Node: &core.Node{Id: testNodeID}, TypeUrl: listenerType})
+		stream.recvResponse(t)
+	}
+
+	w := httptest.NewRecorder()
+	connectionsz(w, httptest.NewRequest("GET", "/debug/connectionsz", nil))
+	out := map[string]registryStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("invalid connectionsz response %q: %v", w.Body.String(), err)
+	}
+	node := out["lds"].Nodes[testNodeID]
+	if node == nil || node.Connections != 2 {
+		t.Fatalf("got LDS nodes %v, want 2 connections for %s", out["lds"].Nodes, testNodeID)
+	}
+	if _, f := out["cds"]; !f {
+		t.Error("no CDS entry in connectionsz")
+	}
+}
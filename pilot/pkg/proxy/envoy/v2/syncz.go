@@ -0,0 +1,93 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Sync states of a connection in /debug/syncz.
+const (
+	// syncNotSent is a connection without response yet.
+	syncNotSent = "NOT SENT"
+	// syncSynced is a connection that ACKed the last response sent.
+	syncSynced = "SYNCED"
+	// syncNacked is a connection that rejected the last response sent, and keeps its previous
+	// config. LastNack is the reason.
+	syncNacked = "NACKED"
+	// syncStale is a connection that didn't reply yet to the last response sent. A connection
+	// stuck in this state is not applying its config.
+	syncStale = "STALE"
+)
+
+// cdsSyncStatus is the sync state of a CDS connection, listed by /debug/syncz.
+type cdsSyncStatus struct {
+	Node   string
+	Status string
+
+	SentVersion string `json:",omitempty"`
+	SentNonce   string `json:",omitempty"`
+
+	AckedVersion string `json:",omitempty"`
+	AckedNonce   string `json:",omitempty"`
+
+	NackedNonce string `json:",omitempty"`
+	LastNack    string `json:",omitempty"`
+	Nacks       int
+}
+
+// syncStatus returns the sync state of the connection.
+func (con *CdsConnection) syncStatus() cdsSyncStatus {
+	con.mutex.Lock()
+	defer con.mutex.Unlock()
+	return cdsSyncStatus{
+		Node:         con.nodeID,
+		Status:       con.ack.status(),
+		SentVersion:  con.ack.sentVersion,
+		SentNonce:    con.ack.sentNonce,
+		AckedVersion: con.ack.ackedVersion,
+		AckedNonce:   con.ack.ackedNonce,
+		NackedNonce:  con.ack.nackedNonce,
+		LastNack:     con.ack.lastNack,
+		Nacks:        con.ack.nacks,
+	}
+}
+
+// syncz implements /debug/syncz, listing the sync state of each CDS connection by connection
+// key. node=SUBSTRING filters the connections by key, and outofsync=1 omits the synced ones.
+func (s *DiscoveryServer) syncz(w http.ResponseWriter, req *http.Request) {
+	_ = req.ParseForm()
+	substring, outOfSync := req.Form.Get("node"), req.Form.Get("outofsync") == "1"
+
+	cons := cdsConnectionSnapshot()
+	out := make(map[string]cdsSyncStatus, len(cons))
+	for k, con := range cons {
+		if !strings.Contains(k, substring) {
+			continue
+		}
+		if st := con.syncStatus(); !outOfSync || st.Status != syncSynced {
+			out[k] = st
+		}
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = w.Write(data)
+}
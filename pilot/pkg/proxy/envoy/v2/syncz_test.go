@@ -0,0 +1,106 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gogo/googleapis/google/rpc"
+)
+
+// syncStatus returns the /debug/syncz entries for the query.
+func syncStatus(t *testing.T, s *DiscoveryServer, query string) map[string]cdsSyncStatus {
+	w := httptest.NewRecorder()
+	s.syncz(w, httptest.NewRequest("GET", "/debug/syncz?"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("syncz returned %d: %s", w.Code, w.Body.String())
+	}
+	out := map[string]cdsSyncStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("invalid syncz response %q: %v", w.Body.String(), err)
+	}
+	return out
+}
+
+// waitSyncStatus waits until the connection is in the state, and returns its entry.
+func waitSyncStatus(t *testing.T, s *DiscoveryServer, key, want string) cdsSyncStatus {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		st := syncStatus(t, s, "")[key]
+		if st.Status == want {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got sync status %+v, want %s", st, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSyncz(t *testing.T) {
+	defer resendUnchanged()()
+	s := newTestServer(newFakeGenerator("outbound|80||a.default.svc.cluster.local"))
+	stream := newFakeStream("10.1.1.1:5000")
+	done := startClusterStream(s, stream)
+	defer func() {
+		stream.close()
+		_ = waitStreamDone(t, done)
+	}()
+	stream.sendRequest(clusterRequest(testNodeID))
+	resp := stream.recvResponse(t)
+	key := waitCdsCon(t, testNodeID)
+
+	st := waitSyncStatus(t, s, key, syncStale)
+	if st.Node != testNodeID || st.SentVersion != resp.VersionInfo || st.SentNonce != resp.Nonce {
+		t.Errorf("got %+v before the ACK, want the response sent", st)
+	}
+
+	ack := clusterRequest(testNodeID)
+	ack.VersionInfo, ack.ResponseNonce = resp.VersionInfo, resp.Nonce
+	stream.sendRequest(ack)
+	st = waitSyncStatus(t, s, key, syncSynced)
+	if st.AckedVersion != resp.VersionInfo || st.AckedNonce != resp.Nonce {
+		t.Errorf("got %+v after the ACK, want the response acked", st)
+	}
+	if out := syncStatus(t, s, "outofsync=1"); len(out) != 0 {
+		t.Errorf("got out of sync connections %v, want none", out)
+	}
+
+	nacks := counterValue(t, cdsNacksCounter)
+	cdsPushAll(nil)
+	pushed := stream.recvResponse(t)
+	nack := clusterRequest(testNodeID)
+	nack.VersionInfo, nack.ResponseNonce = resp.VersionInfo, pushed.Nonce
+	nack.ErrorDetail = &rpc.Status{Message: "invalid cluster"}
+	stream.sendRequest(nack)
+	st = waitSyncStatus(t, s, key, syncNacked)
+	if st.NackedNonce != pushed.Nonce || st.LastNack != "invalid cluster" || st.Nacks != 1 {
+		t.Errorf("got %+v after the NACK, want the push rejected", st)
+	}
+	if n := counterValue(t, cdsNacksCounter) - nacks; n != 1 {
+		t.Errorf("got %v NACKs counted, want 1", n)
+	}
+	if out := syncStatus(t, s, "outofsync=1&node="+testNodeID); len(out) != 1 {
+		t.Errorf("got out of sync connections %v, want the NACKing one", out)
+	}
+	if out := syncStatus(t, s, "node=other"); len(out) != 0 {
+		t.Errorf("got %v for another node, want none", out)
+	}
+}